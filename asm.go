@@ -0,0 +1,598 @@
+package bpfutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// ParseError is returned by ParseAsm, ParseTcpdump and UnmarshalBytecode if the input is not
+// valid. Line and Column are 1-based and point to the offending token.
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+// Error returns the error message including the position of the error.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+// ParseAsm reads bpf_asm instructions as defined in
+// https://www.kernel.org/doc/Documentation/networking/filter.txt
+// and returns them as []bpf.Instruction. It is the inverse of AsmString.
+//
+// Comments are introduced with `;` and reach to the end of the line. Lines starting with `#`
+// and C style comments (`/* ... */`) are ignored as well.
+//
+// Jump targets may either be given as skip count or as label, as emitted by AsmStringWithLabels.
+// A label is defined by its name followed by a colon (e.g. `L3:`), either on a line of its own or
+// in front of an instruction. Labels are resolved to skip counts, undefined and duplicate labels
+// as well as backward jumps are reported as ParseError.
+//
+// Packet loads relative to the network layer header (SKF_NET_OFF) are written as `ldb [net+9]`,
+// loads relative to the link layer header (SKF_LL_OFF) as `ldh [ll+12]`.
+func ParseAsm(r io.Reader) ([]bpf.Instruction, error) {
+	var instructions []bpf.Instruction
+	var refs []asmLabelRef
+	labels := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	lex := asmLexer{}
+	for scanner.Scan() {
+		lex.line++
+		tokens, err := lex.tokenize(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		for len(tokens) > 1 && tokens[0].isIdent() && tokens[1].text == ":" {
+			if _, ok := labels[tokens[0].text]; ok {
+				return nil, &ParseError{Line: lex.line, Column: tokens[0].column, Msg: fmt.Sprintf("duplicate label %q", tokens[0].text)}
+			}
+			labels[tokens[0].text] = len(instructions)
+			tokens = tokens[2:]
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		p := asmParser{line: lex.line, tokens: tokens, eol: len(scanner.Text()) + 1}
+		inst, err := p.instruction()
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range p.refs {
+			ref.index = len(instructions)
+			refs = append(refs, ref)
+		}
+		instructions = append(instructions, inst)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lex.inComment {
+		return nil, &ParseError{Line: lex.commentLine, Column: lex.commentColumn, Msg: "unterminated comment"}
+	}
+
+	if err := resolveLabels(instructions, labels, refs); err != nil {
+		return nil, err
+	}
+
+	return instructions, nil
+}
+
+// asmLabelRef is a reference to a label in the jump instruction at index.
+type asmLabelRef struct {
+	name      string
+	line      int
+	column    int
+	index     int
+	skipFalse bool // reference is the false branch of a conditional jump
+}
+
+// resolveLabels replaces the label references in instructions with the respective skip counts.
+func resolveLabels(instructions []bpf.Instruction, labels map[string]int, refs []asmLabelRef) error {
+	for _, ref := range refs {
+		target, ok := labels[ref.name]
+		if !ok {
+			return &ParseError{Line: ref.line, Column: ref.column, Msg: fmt.Sprintf("undefined label %q", ref.name)}
+		}
+		if target >= len(instructions) {
+			return &ParseError{Line: ref.line, Column: ref.column, Msg: fmt.Sprintf("label %q does not point to an instruction", ref.name)}
+		}
+		skip := target - ref.index - 1
+		if skip < 0 {
+			return &ParseError{Line: ref.line, Column: ref.column, Msg: fmt.Sprintf("backward jump to label %q", ref.name)}
+		}
+
+		switch inst := instructions[ref.index].(type) {
+		case bpf.Jump:
+			inst.Skip = uint32(skip)
+			instructions[ref.index] = inst
+		case bpf.JumpIf:
+			if skip > 0xff {
+				return &ParseError{Line: ref.line, Column: ref.column, Msg: fmt.Sprintf("jump to label %q out of range", ref.name)}
+			}
+			if ref.skipFalse {
+				inst.SkipFalse = uint8(skip)
+			} else {
+				inst.SkipTrue = uint8(skip)
+			}
+			instructions[ref.index] = inst
+		case bpf.JumpIfX:
+			if skip > 0xff {
+				return &ParseError{Line: ref.line, Column: ref.column, Msg: fmt.Sprintf("jump to label %q out of range", ref.name)}
+			}
+			if ref.skipFalse {
+				inst.SkipFalse = uint8(skip)
+			} else {
+				inst.SkipTrue = uint8(skip)
+			}
+			instructions[ref.index] = inst
+		}
+	}
+	return nil
+}
+
+type asmToken struct {
+	text   string
+	column int
+}
+
+func (t asmToken) isNumber() bool {
+	return len(t.text) > 0 && t.text[0] >= '0' && t.text[0] <= '9'
+}
+
+func (t asmToken) isIdent() bool {
+	return len(t.text) > 0 && isIdentChar(t.text[0]) && !t.isNumber()
+}
+
+// asmLexer splits the input into tokens line by line. It keeps the state of
+// C style comments spanning multiple lines.
+type asmLexer struct {
+	line          int
+	inComment     bool
+	commentLine   int
+	commentColumn int
+}
+
+func (l *asmLexer) tokenize(line string) ([]asmToken, error) {
+	var tokens []asmToken
+
+	if strings.HasPrefix(strings.TrimSpace(line), "#") && !l.inComment {
+		return nil, nil
+	}
+
+	for i := 0; i < len(line); {
+		if l.inComment {
+			end := strings.Index(line[i:], "*/")
+			if end < 0 {
+				return tokens, nil
+			}
+			l.inComment = false
+			i += end + 2
+			continue
+		}
+
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			return tokens, nil
+		case strings.HasPrefix(line[i:], "/*"):
+			l.inComment = true
+			l.commentLine = l.line
+			l.commentColumn = i + 1
+			i += 2
+		case isIdentChar(c):
+			start := i
+			for i < len(line) && isIdentChar(line[i]) {
+				i++
+			}
+			tokens = append(tokens, asmToken{text: line[start:i], column: start + 1})
+		case strings.IndexByte("#[]+*&(),:", c) >= 0:
+			tokens = append(tokens, asmToken{text: line[i : i+1], column: i + 1})
+			i++
+		default:
+			return nil, &ParseError{Line: l.line, Column: i + 1, Msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+// asmParser parses the tokens of a single line into a bpf.Instruction.
+type asmParser struct {
+	line   int
+	tokens []asmToken
+	pos    int
+	eol    int
+	refs   []asmLabelRef
+}
+
+func (p *asmParser) errorf(column int, format string, args ...interface{}) error {
+	return &ParseError{Line: p.line, Column: column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *asmParser) peek() (asmToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return asmToken{column: p.eol}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *asmParser) next() (asmToken, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return tok, p.errorf(tok.column, "unexpected end of line")
+	}
+	p.pos++
+	return tok, nil
+}
+
+func (p *asmParser) accept(text string) bool {
+	tok, ok := p.peek()
+	if ok && strings.EqualFold(tok.text, text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *asmParser) expect(text string) error {
+	tok, ok := p.peek()
+	if !ok {
+		return p.errorf(tok.column, "expected %q, got end of line", text)
+	}
+	if !strings.EqualFold(tok.text, text) {
+		return p.errorf(tok.column, "expected %q, got %q", text, tok.text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *asmParser) end() error {
+	if tok, ok := p.peek(); ok {
+		return p.errorf(tok.column, "unexpected %q", tok.text)
+	}
+	return nil
+}
+
+func (p *asmParser) number() (uint32, error) {
+	tok, err := p.next()
+	if err != nil {
+		return 0, err
+	}
+	if !tok.isNumber() {
+		return 0, p.errorf(tok.column, "expected number, got %q", tok.text)
+	}
+	n, err := strconv.ParseUint(tok.text, 0, 32)
+	if err != nil {
+		return 0, p.errorf(tok.column, "invalid number %q", tok.text)
+	}
+	return uint32(n), nil
+}
+
+// target parses the target of a jump, which is either a skip count or a label.
+// Labels are recorded and resolved after the whole program is parsed.
+func (p *asmParser) target(skipFalse bool) (uint32, error) {
+	tok, _ := p.peek()
+	if tok.isIdent() {
+		p.pos++
+		p.refs = append(p.refs, asmLabelRef{name: tok.text, line: p.line, column: tok.column, skipFalse: skipFalse})
+		return 0, nil
+	}
+	return p.number()
+}
+
+// skip parses the target of a conditional jump, which is limited to 8 bits.
+func (p *asmParser) skip(skipFalse bool) (uint8, error) {
+	tok, _ := p.peek()
+	n, err := p.target(skipFalse)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0xff {
+		return 0, p.errorf(tok.column, "jump offset %d out of range", n)
+	}
+	return uint8(n), nil
+}
+
+// scratch parses `M[n]`.
+func (p *asmParser) scratch() (int, error) {
+	if err := p.expect("M"); err != nil {
+		return 0, err
+	}
+	if err := p.expect("["); err != nil {
+		return 0, err
+	}
+	tok, _ := p.peek()
+	n, err := p.number()
+	if err != nil {
+		return 0, err
+	}
+	if n > 15 {
+		return 0, p.errorf(tok.column, "scratch memory index %d out of range", n)
+	}
+	return int(n), p.expect("]")
+}
+
+// offset parses the offset of a packet load, which is either a number or an offset relative
+// to the network layer header (`net+k`) or the link layer header (`ll+k`).
+func (p *asmParser) offset() (uint32, error) {
+	var base uint32
+	switch {
+	case p.accept("net"):
+		base = skfNetOff
+	case p.accept("ll"):
+		base = skfLLOff
+	default:
+		return p.number()
+	}
+	if !p.accept("+") {
+		return base, nil
+	}
+	tok, _ := p.peek()
+	n, err := p.number()
+	if err != nil {
+		return 0, err
+	}
+	if n >= skfNetOff-skfLLOff {
+		return 0, p.errorf(tok.column, "relative offset %d out of range", n)
+	}
+	return base + n, nil
+}
+
+func (p *asmParser) instruction() (bpf.Instruction, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if !tok.isIdent() {
+		return nil, p.errorf(tok.column, "expected instruction, got %q", tok.text)
+	}
+
+	var inst bpf.Instruction
+	switch mnemonic := strings.ToLower(tok.text); mnemonic {
+	case "ld", "ldb", "ldh":
+		inst, err = p.load(mnemonic)
+	case "ldx", "ldxb":
+		inst, err = p.loadX(mnemonic)
+	case "st", "stx":
+		inst, err = p.store(mnemonic)
+	case "add", "sub", "mul", "div", "mod", "and", "or", "xor", "lsh", "rsh":
+		inst, err = p.alu(mnemonic)
+	case "neg":
+		inst = bpf.NegateA{}
+	case "tax":
+		inst = bpf.TAX{}
+	case "txa":
+		inst = bpf.TXA{}
+	case "jmp", "ja":
+		var skip uint32
+		skip, err = p.target(false)
+		inst = bpf.Jump{Skip: skip}
+	case "jeq", "jneq", "jne", "jgt", "jle", "jge", "jlt", "jset":
+		inst, err = p.conditionalJump(mnemonic)
+	case "ret":
+		inst, err = p.ret()
+	default:
+		return nil, p.errorf(tok.column, "unknown instruction %q", tok.text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return inst, p.end()
+}
+
+// asmExtensions contains the names of the ancillary data extensions in `ld #name`, the
+// names of bpf_asm and the aliases derived from the SKF_AD_* constants.
+var asmExtensions = map[string]bpf.Extension{
+	"len":         bpf.ExtLen,
+	"proto":       bpf.ExtProto,
+	"type":        bpf.ExtType,
+	"poff":        bpf.ExtPayloadOffset,
+	"pay_offset":  bpf.ExtPayloadOffset,
+	"ifidx":       bpf.ExtInterfaceIndex,
+	"nla":         bpf.ExtNetlinkAttr,
+	"nlan":        bpf.ExtNetlinkAttrNested,
+	"nlattr_nest": bpf.ExtNetlinkAttrNested,
+	"mark":        bpf.ExtMark,
+	"queue":       bpf.ExtQueue,
+	"hatype":      bpf.ExtLinkLayerType,
+	"rxhash":      bpf.ExtRXHash,
+	"cpu":         bpf.ExtCPUID,
+	"vlan_tci":    bpf.ExtVLANTag,
+	"vlan_avail":  bpf.ExtVLANTagPresent,
+	"vlan_pr":     bpf.ExtVLANTagPresent,
+	"vlan_tpid":   bpf.ExtVLANProto,
+	"rand":        bpf.ExtRand,
+}
+
+var asmLoadSizes = map[string]int{
+	"ld":  4,
+	"ldh": 2,
+	"ldb": 1,
+}
+
+func (p *asmParser) load(mnemonic string) (bpf.Instruction, error) {
+	tok, _ := p.peek()
+	switch {
+	case mnemonic == "ld" && p.accept("#"):
+		ext, _ := p.peek()
+		if ext.isIdent() {
+			p.pos++
+			num, ok := asmExtensions[strings.ToLower(ext.text)]
+			if !ok {
+				return nil, p.errorf(ext.column, "unknown extension %q", ext.text)
+			}
+			return bpf.LoadExtension{Num: num}, nil
+		}
+		val, err := p.number()
+		return bpf.LoadConstant{Dst: bpf.RegA, Val: val}, err
+
+	case mnemonic == "ld" && strings.EqualFold(tok.text, "M"):
+		n, err := p.scratch()
+		return bpf.LoadScratch{Dst: bpf.RegA, N: n}, err
+
+	case p.accept("["):
+		size := asmLoadSizes[mnemonic]
+		if p.accept("x") {
+			var off uint32
+			if p.accept("+") {
+				var err error
+				if off, err = p.offset(); err != nil {
+					return nil, err
+				}
+			}
+			return bpf.LoadIndirect{Off: off, Size: size}, p.expect("]")
+		}
+		off, err := p.offset()
+		if err != nil {
+			return nil, err
+		}
+		return bpf.LoadAbsolute{Off: off, Size: size}, p.expect("]")
+	}
+
+	return nil, p.errorf(tok.column, "invalid operand for %s", mnemonic)
+}
+
+func (p *asmParser) loadX(mnemonic string) (bpf.Instruction, error) {
+	tok, _ := p.peek()
+	switch {
+	case mnemonic == "ldx" && p.accept("#"):
+		val, err := p.number()
+		return bpf.LoadConstant{Dst: bpf.RegX, Val: val}, err
+
+	case mnemonic == "ldx" && strings.EqualFold(tok.text, "M"):
+		n, err := p.scratch()
+		return bpf.LoadScratch{Dst: bpf.RegX, N: n}, err
+
+	case tok.text == "4":
+		// 4*([k]&0xf)
+		p.pos++
+		for _, text := range []string{"*", "(", "["} {
+			if err := p.expect(text); err != nil {
+				return nil, err
+			}
+		}
+		off, err := p.offset()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect("]"); err != nil {
+			return nil, err
+		}
+		if err = p.expect("&"); err != nil {
+			return nil, err
+		}
+		mask, _ := p.peek()
+		if n, err := p.number(); err != nil || n != 0xf {
+			return nil, p.errorf(mask.column, "expected mask 0xf")
+		}
+		return bpf.LoadMemShift{Off: off}, p.expect(")")
+	}
+
+	return nil, p.errorf(tok.column, "invalid operand for %s", mnemonic)
+}
+
+func (p *asmParser) store(mnemonic string) (bpf.Instruction, error) {
+	n, err := p.scratch()
+	if err != nil {
+		return nil, err
+	}
+	if mnemonic == "stx" {
+		return bpf.StoreScratch{Src: bpf.RegX, N: n}, nil
+	}
+	return bpf.StoreScratch{Src: bpf.RegA, N: n}, nil
+}
+
+var asmALUOps = map[string]bpf.ALUOp{
+	"add": bpf.ALUOpAdd,
+	"sub": bpf.ALUOpSub,
+	"mul": bpf.ALUOpMul,
+	"div": bpf.ALUOpDiv,
+	"mod": bpf.ALUOpMod,
+	"and": bpf.ALUOpAnd,
+	"or":  bpf.ALUOpOr,
+	"xor": bpf.ALUOpXor,
+	"lsh": bpf.ALUOpShiftLeft,
+	"rsh": bpf.ALUOpShiftRight,
+}
+
+func (p *asmParser) alu(mnemonic string) (bpf.Instruction, error) {
+	op := asmALUOps[mnemonic]
+	if p.accept("x") {
+		return bpf.ALUOpX{Op: op}, nil
+	}
+	if err := p.expect("#"); err != nil {
+		return nil, err
+	}
+	val, err := p.number()
+	return bpf.ALUOpConstant{Op: op, Val: val}, err
+}
+
+var asmJumpConds = map[string]bpf.JumpTest{
+	"jeq":  bpf.JumpEqual,
+	"jneq": bpf.JumpNotEqual,
+	"jne":  bpf.JumpNotEqual,
+	"jgt":  bpf.JumpGreaterThan,
+	"jle":  bpf.JumpLessOrEqual,
+	"jge":  bpf.JumpGreaterOrEqual,
+	"jlt":  bpf.JumpLessThan,
+	"jset": bpf.JumpBitsSet,
+}
+
+// conditionalJump parses `j<cond> #k,jt`, `j<cond> #k,jt,jf` and the forms comparing with X,
+// `j<cond> x,jt` and `j<cond> x,jt,jf`.
+func (p *asmParser) conditionalJump(mnemonic string) (bpf.Instruction, error) {
+	var err error
+	var val uint32
+	x := p.accept("x")
+	if !x {
+		if err = p.expect("#"); err != nil {
+			return nil, err
+		}
+		if val, err = p.number(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect(","); err != nil {
+		return nil, err
+	}
+	var skipTrue, skipFalse uint8
+	if skipTrue, err = p.skip(false); err != nil {
+		return nil, err
+	}
+	if p.accept(",") {
+		if skipFalse, err = p.skip(true); err != nil {
+			return nil, err
+		}
+	}
+
+	cond := asmJumpConds[mnemonic]
+	if x {
+		return bpf.JumpIfX{Cond: cond, SkipTrue: skipTrue, SkipFalse: skipFalse}, nil
+	}
+	return bpf.JumpIf{Cond: cond, Val: val, SkipTrue: skipTrue, SkipFalse: skipFalse}, nil
+}
+
+func (p *asmParser) ret() (bpf.Instruction, error) {
+	if p.accept("a") {
+		return bpf.RetA{}, nil
+	}
+	if err := p.expect("#"); err != nil {
+		return nil, err
+	}
+	val, err := p.number()
+	return bpf.RetConstant{Val: val}, err
+}
@@ -0,0 +1,275 @@
+package bpfutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestParseAsm(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect []bpf.Instruction
+	}{
+		{
+			input: `
+# get a random uint32 number
+ld #rand
+; if rand is greater than 4294967 (maxuint32 / 1000), drop the package
+jgt #4294967,1
+ret #1024 ; capture
+/* do not capture
+   the packet */
+ret #0
+`,
+			expect: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtRand},
+				bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 4294967, SkipTrue: 1},
+				bpf.RetConstant{Val: 1024},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			input: `
+ldh [12]
+jeq #0x800,0,3
+ldb [23]
+jneq #6,1
+ldxb 4*([14]&0xf)
+ldh [x+16]
+ret a
+`,
+			expect: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 12, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 0, SkipFalse: 3},
+				bpf.LoadAbsolute{Off: 23, Size: 1},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 6, SkipTrue: 1},
+				bpf.LoadMemShift{Off: 14},
+				bpf.LoadIndirect{Off: 16, Size: 2},
+				bpf.RetA{},
+			},
+		},
+		{
+			input: "ldh [12]\ntax\nldh [14]\njgt x,1,2\njneq X,1\nret #1\nret #0",
+			expect: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 12, Size: 2},
+				bpf.TAX{},
+				bpf.LoadAbsolute{Off: 14, Size: 2},
+				bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipTrue: 1, SkipFalse: 2},
+				bpf.JumpIfX{Cond: bpf.JumpNotEqual, SkipTrue: 1},
+				bpf.RetConstant{Val: 1},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			input: "ld #vlan_avail\njeq #0,2\nld #vlan_tci\nand #0xfff\nld #VLAN_TPID\nld #vlan_pr\nld #nlattr_nest\nld #pay_offset\nld #poff",
+			expect: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtVLANTagPresent},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 2},
+				bpf.LoadExtension{Num: bpf.ExtVLANTag},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfff},
+				bpf.LoadExtension{Num: bpf.ExtVLANProto},
+				bpf.LoadExtension{Num: bpf.ExtVLANTagPresent},
+				bpf.LoadExtension{Num: bpf.ExtNetlinkAttrNested},
+				bpf.LoadExtension{Num: bpf.ExtPayloadOffset},
+				bpf.LoadExtension{Num: bpf.ExtPayloadOffset},
+			},
+		},
+		{
+			input: "ldb [net+9]\nldh [ll + 0xc]\nldx 4*([net]&0xf)\nld [x + net+2]",
+			expect: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1},
+				bpf.LoadAbsolute{Off: skfLLOff + 12, Size: 2},
+				bpf.LoadMemShift{Off: skfNetOff},
+				bpf.LoadIndirect{Off: skfNetOff + 2, Size: 4},
+			},
+		},
+		{
+			input: "ja 3\njne #1,2\nLD [X]\n",
+			expect: []bpf.Instruction{
+				bpf.Jump{Skip: 3},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 1, SkipTrue: 2},
+				bpf.LoadIndirect{Off: 0, Size: 4},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		got, err := ParseAsm(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("ParseAsm failed with error: %s\n%s", err.Error(), test.input)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("ParseAsm failed, got: %#v, expected: %#v", got, test.expect)
+		}
+	}
+}
+
+func TestParseAsmRoundTrip(t *testing.T) {
+	input := []bpf.Instruction{
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 42},
+		bpf.LoadConstant{Dst: bpf.RegX, Val: 42},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+		bpf.LoadScratch{Dst: bpf.RegX, N: 15},
+		bpf.LoadAbsolute{Off: 42, Size: 1},
+		bpf.LoadAbsolute{Off: 42, Size: 2},
+		bpf.LoadAbsolute{Off: 42, Size: 4},
+		bpf.LoadIndirect{Off: 42, Size: 1},
+		bpf.LoadIndirect{Off: 42, Size: 2},
+		bpf.LoadIndirect{Off: 42, Size: 4},
+		bpf.LoadMemShift{Off: 42},
+		bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1},
+		bpf.LoadAbsolute{Off: skfLLOff + 12, Size: 2},
+		bpf.LoadIndirect{Off: skfNetOff + 2, Size: 2},
+		bpf.LoadMemShift{Off: skfLLOff + 14},
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.LoadExtension{Num: bpf.ExtProto},
+		bpf.LoadExtension{Num: bpf.ExtType},
+		bpf.LoadExtension{Num: bpf.ExtRand},
+		bpf.LoadExtension{Num: bpf.ExtPayloadOffset},
+		bpf.LoadExtension{Num: bpf.ExtInterfaceIndex},
+		bpf.LoadExtension{Num: bpf.ExtNetlinkAttr},
+		bpf.LoadExtension{Num: bpf.ExtNetlinkAttrNested},
+		bpf.LoadExtension{Num: bpf.ExtMark},
+		bpf.LoadExtension{Num: bpf.ExtQueue},
+		bpf.LoadExtension{Num: bpf.ExtLinkLayerType},
+		bpf.LoadExtension{Num: bpf.ExtRXHash},
+		bpf.LoadExtension{Num: bpf.ExtCPUID},
+		bpf.LoadExtension{Num: bpf.ExtVLANTag},
+		bpf.LoadExtension{Num: bpf.ExtVLANTagPresent},
+		bpf.LoadExtension{Num: bpf.ExtVLANProto},
+		bpf.StoreScratch{Src: bpf.RegA, N: 3},
+		bpf.StoreScratch{Src: bpf.RegX, N: 3},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpDiv, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpOr, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpXor, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 42},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		bpf.ALUOpX{Op: bpf.ALUOpSub},
+		bpf.ALUOpX{Op: bpf.ALUOpMul},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.ALUOpX{Op: bpf.ALUOpMod},
+		bpf.ALUOpX{Op: bpf.ALUOpAnd},
+		bpf.ALUOpX{Op: bpf.ALUOpOr},
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.ALUOpX{Op: bpf.ALUOpShiftLeft},
+		bpf.ALUOpX{Op: bpf.ALUOpShiftRight},
+		bpf.NegateA{},
+		bpf.Jump{Skip: 10},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 42, SkipTrue: 8, SkipFalse: 9},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 42, SkipTrue: 8},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 42, SkipTrue: 8},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 42, SkipTrue: 7},
+		bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 42, SkipTrue: 6},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 42, SkipTrue: 5, SkipFalse: 6},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 42, SkipTrue: 5, SkipFalse: 6},
+		bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 42, SkipTrue: 5, SkipFalse: 6},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 42, SkipTrue: 4, SkipFalse: 5},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 42, SkipTrue: 4},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 42, SkipTrue: 3, SkipFalse: 4},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 42, SkipTrue: 3},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 42, SkipTrue: 2, SkipFalse: 3},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 42, SkipTrue: 2},
+		bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 8, SkipFalse: 9},
+		bpf.JumpIfX{Cond: bpf.JumpNotEqual, SkipTrue: 8},
+		bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipTrue: 4, SkipFalse: 5},
+		bpf.JumpIfX{Cond: bpf.JumpGreaterOrEqual, SkipTrue: 3},
+		bpf.JumpIfX{Cond: bpf.JumpLessThan, SkipTrue: 3, SkipFalse: 1},
+		bpf.JumpIfX{Cond: bpf.JumpBitsSet, SkipTrue: 2, SkipFalse: 3},
+		bpf.TAX{},
+		bpf.TXA{},
+		bpf.RetA{},
+		bpf.RetConstant{Val: 42},
+	}
+
+	got, err := ParseAsm(strings.NewReader(AsmString(input)))
+	if err != nil {
+		t.Fatalf("ParseAsm failed with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, input) {
+		t.Errorf("ParseAsm does not round trip AsmString\n\ngot:\n%s\n\nexpected:\n%s", AsmString(got), AsmString(input))
+	}
+}
+
+func TestParseAsmError(t *testing.T) {
+	cases := []struct {
+		input  string
+		line   int
+		column int
+	}{
+		{input: "foo #1", line: 1, column: 1},
+		{input: "ld #1\n\n  ldb #1", line: 3, column: 7},
+		{input: "ld M[16]", line: 1, column: 6},
+		{input: "jeq #1,256", line: 1, column: 8},
+		{input: "jeq #1", line: 1, column: 7},
+		{input: "ret #1 2", line: 1, column: 8},
+		{input: "ld #foo", line: 1, column: 5},
+		{input: "ld [0x1g]", line: 1, column: 5},
+		{input: "ldx 4*([14]&0xe)", line: 1, column: 13},
+		{input: "ldb [net+0x100000]", line: 1, column: 10},
+		{input: "ldb [ll+]", line: 1, column: 9},
+		{input: "tax\nld @", line: 2, column: 4},
+		{input: "ret a\n  /* unterminated", line: 2, column: 3},
+		{input: "jmp drop\nret #0", line: 1, column: 5},
+		{input: "drop: ret #0\ndrop:\nret #0", line: 2, column: 1},
+		{input: "ret #0\nback: jeq #1,back", line: 2, column: 14},
+		{input: "jmp end\nret #0\nend:", line: 1, column: 5},
+	}
+
+	for _, test := range cases {
+		_, err := ParseAsm(strings.NewReader(test.input))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("expected ParseError for %q, got: %#v", test.input, err)
+			continue
+		}
+		if perr.Line != test.line || perr.Column != test.column {
+			t.Errorf("wrong position for %q, got: %d:%d (%s), expected: %d:%d", test.input, perr.Line, perr.Column, perr.Msg, test.line, test.column)
+		}
+	}
+}
+
+func TestParseAsmLabels(t *testing.T) {
+	input := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 2048, SkipTrue: 4},
+		bpf.LoadAbsolute{Off: 23, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 1, SkipFalse: 2},
+		bpf.Jump{Skip: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	}
+
+	got, err := ParseAsm(strings.NewReader(AsmStringWithLabels(input)))
+	if err != nil {
+		t.Fatalf("ParseAsm failed with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, input) {
+		t.Errorf("ParseAsm does not round trip AsmStringWithLabels\n\ngot:\n%s\n\nexpected:\n%s", AsmString(got), AsmString(input))
+	}
+
+	got, err = ParseAsm(strings.NewReader(`
+start:	ldh [12]
+	jneq #2048, drop
+	ldb [23]
+	jeq #6, accept, drop
+	jmp drop
+accept: ret #65535
+drop:   ret #0
+`))
+	if err != nil {
+		t.Fatalf("ParseAsm failed with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, input) {
+		t.Errorf("ParseAsm failed to resolve labels\n\ngot:\n%s\n\nexpected:\n%s", AsmString(got), AsmString(input))
+	}
+}
@@ -0,0 +1,245 @@
+// Package cfg builds the control flow graph of a classic BPF program from golang.org/x/net/bpf
+// and exports it in the Graphviz DOT format.
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils"
+)
+
+// EdgeKind describes, how the control flow passes from one block to another.
+type EdgeKind int
+
+// Kinds of edges
+const (
+	// Fallthrough continues with the directly following instruction.
+	Fallthrough EdgeKind = iota
+	// Jump is an unconditional jump.
+	Jump
+	// True is taken by a conditional jump, if the condition is true.
+	True
+	// False is taken by a conditional jump, if the condition is false.
+	False
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case Fallthrough:
+		return "fallthrough"
+	case Jump:
+		return "jump"
+	case True:
+		return "true"
+	case False:
+		return "false"
+	default:
+		return "unknown"
+	}
+}
+
+// Edge is a transition from block From to block To.
+type Edge struct {
+	From, To int
+	Kind     EdgeKind
+}
+
+// Block is a basic block, a sequence of instructions which is only entered at its first and
+// only left after its last instruction.
+type Block struct {
+	// ID is the index of the block in Graph.Blocks.
+	ID int
+	// Start and End are the indexes of the first and behind the last instruction of the block.
+	Start, End int
+	// Instructions are the instructions of the block, prog[Start:End]. The skip counts of a
+	// jump at the end of the block are unchanged and relative to its index in the program,
+	// the target blocks are given by Succs.
+	Instructions []bpf.Instruction
+	// Succs are the outgoing edges, empty if the block ends with a return or falls off the
+	// end of the program. A conditional jump with the same target for both outcomes has two
+	// edges to the same block.
+	Succs []Edge
+	// Preds are the IDs of the blocks with an edge to this block, every block is contained
+	// only once.
+	Preds []int
+}
+
+// Graph is the control flow graph of a BPF program. Blocks are ordered by their position in
+// the program, the entry block is Blocks[0].
+type Graph struct {
+	Instructions []bpf.Instruction
+	Blocks       []*Block
+	blockOf      []int
+}
+
+// New builds the control flow graph of prog. It returns an error, if prog is empty or
+// contains a jump out of the bounds of the program.
+func New(prog []bpf.Instruction) (*Graph, error) {
+	if len(prog) == 0 {
+		return nil, fmt.Errorf("empty program")
+	}
+
+	// Find the first instruction of every block
+	leader := make([]bool, len(prog)+1)
+	leader[0] = true
+	for i, instr := range prog {
+		targets, _ := targets(instr, i)
+		for _, t := range targets {
+			if t >= len(prog) {
+				return nil, fmt.Errorf("instruction %d: jump out of bounds", i)
+			}
+			leader[t] = true
+		}
+		if len(targets) > 0 || isReturn(instr) {
+			leader[i+1] = true
+		}
+	}
+
+	g := &Graph{Instructions: prog, blockOf: make([]int, len(prog))}
+	for i := range prog {
+		if leader[i] {
+			g.Blocks = append(g.Blocks, &Block{ID: len(g.Blocks), Start: i})
+		}
+		b := g.Blocks[len(g.Blocks)-1]
+		b.End = i + 1
+		g.blockOf[i] = b.ID
+	}
+
+	for _, b := range g.Blocks {
+		b.Instructions = prog[b.Start:b.End]
+		last := prog[b.End-1]
+		targets, kinds := targets(last, b.End-1)
+		if len(targets) == 0 && !isReturn(last) && b.End < len(prog) {
+			targets, kinds = []int{b.End}, []EdgeKind{Fallthrough}
+		}
+		for i, t := range targets {
+			to := g.blockOf[t]
+			b.Succs = append(b.Succs, Edge{From: b.ID, To: to, Kind: kinds[i]})
+			if i == 0 || g.blockOf[targets[0]] != to {
+				g.Blocks[to].Preds = append(g.Blocks[to].Preds, b.ID)
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// NewFromPcap builds the control flow graph of a BPF program in the format of
+// github.com/google/gopacket/pcap.
+func NewFromPcap(prog []pcap.BPFInstruction) (*Graph, error) {
+	insts, ok := bpfutils.ToBpfInstructions(prog)
+	if !ok {
+		return nil, fmt.Errorf("failed to disassemble program")
+	}
+	return New(insts)
+}
+
+// targets returns the indexes of the jump targets of the instruction instr at index i.
+func targets(instr bpf.Instruction, i int) ([]int, []EdgeKind) {
+	switch inst := instr.(type) {
+	case bpf.Jump:
+		return []int{i + 1 + int(inst.Skip)}, []EdgeKind{Jump}
+	case bpf.JumpIf:
+		return []int{i + 1 + int(inst.SkipTrue), i + 1 + int(inst.SkipFalse)}, []EdgeKind{True, False}
+	case bpf.JumpIfX:
+		return []int{i + 1 + int(inst.SkipTrue), i + 1 + int(inst.SkipFalse)}, []EdgeKind{True, False}
+	}
+	return nil, nil
+}
+
+func isReturn(instr bpf.Instruction) bool {
+	switch instr.(type) {
+	case bpf.RetA, bpf.RetConstant:
+		return true
+	}
+	return false
+}
+
+// BlockOf returns the block containing the instruction at index pc, nil if pc is out of
+// the bounds of the program.
+func (g *Graph) BlockOf(pc int) *Block {
+	if pc < 0 || pc >= len(g.blockOf) {
+		return nil
+	}
+	return g.Blocks[g.blockOf[pc]]
+}
+
+// Reaches returns true, if there is a path from block from to block to. A block reaches
+// itself.
+func (g *Graph) Reaches(from, to *Block) bool {
+	return g.reachable(from)[to.ID]
+}
+
+// Unreachable returns the blocks, which can not be reached from the entry block.
+func (g *Graph) Unreachable() []*Block {
+	var blocks []*Block
+	for id, ok := range g.reachable(g.Blocks[0]) {
+		if !ok {
+			blocks = append(blocks, g.Blocks[id])
+		}
+	}
+	return blocks
+}
+
+// reachable returns for every block, if it is reachable from block from.
+// Because BPF only allows forward jumps, a single pass in program order is sufficient.
+func (g *Graph) reachable(from *Block) []bool {
+	reachable := make([]bool, len(g.Blocks))
+	reachable[from.ID] = true
+	for _, b := range g.Blocks[from.ID:] {
+		if !reachable[b.ID] {
+			continue
+		}
+		for _, e := range b.Succs {
+			reachable[e.To] = true
+		}
+	}
+	return reachable
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format to w. Every block is a node with
+// its instructions in bpf_asm syntax, the edges of conditional jumps are labeled with
+// true and false.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var buffer bytes.Buffer
+	buffer.WriteString("digraph bpf {\n")
+	buffer.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+	for _, b := range g.Blocks {
+		label := fmt.Sprintf("%d-%d:\n%s", b.Start, b.End-1, bpfutils.AsmString(b.Instructions))
+		buffer.WriteString(fmt.Sprintf("\tb%d [label=\"%s\"];\n", b.ID, escapeDOT(label)))
+	}
+	for _, b := range g.Blocks {
+		for _, e := range b.Succs {
+			switch e.Kind {
+			case True, False:
+				buffer.WriteString(fmt.Sprintf("\tb%d -> b%d [label=\"%s\"];\n", e.From, e.To, e.Kind))
+			default:
+				buffer.WriteString(fmt.Sprintf("\tb%d -> b%d;\n", e.From, e.To))
+			}
+		}
+	}
+	buffer.WriteString("}\n")
+
+	_, err := buffer.WriteTo(w)
+	return err
+}
+
+// DOT returns the graph in the Graphviz DOT format, see WriteDOT.
+func (g *Graph) DOT() string {
+	var buffer bytes.Buffer
+	_ = g.WriteDOT(&buffer)
+	return buffer.String()
+}
+
+// escapeDOT escapes s for a double quoted DOT string with left aligned lines.
+func escapeDOT(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\l`, -1)
+}
@@ -0,0 +1,242 @@
+package cfg
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils"
+)
+
+// ip4OrIP6 accepts IPv4 and IPv6 packets, the `ret #1` is unreachable
+var ip4OrIP6 = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 2},
+	bpf.LoadConstant{Dst: bpf.RegA, Val: 0xffff},
+	bpf.Jump{Skip: 2},
+	bpf.RetConstant{Val: 0},
+	bpf.RetConstant{Val: 1},
+	bpf.RetA{},
+}
+
+func TestNew(t *testing.T) {
+	g, err := New(ip4OrIP6)
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+
+	expected := []Block{
+		{ID: 0, Start: 0, End: 2, Succs: []Edge{{From: 0, To: 2, Kind: True}, {From: 0, To: 1, Kind: False}}},
+		{ID: 1, Start: 2, End: 3, Succs: []Edge{{From: 1, To: 2, Kind: True}, {From: 1, To: 3, Kind: False}}, Preds: []int{0}},
+		{ID: 2, Start: 3, End: 5, Succs: []Edge{{From: 2, To: 5, Kind: Jump}}, Preds: []int{0, 1}},
+		{ID: 3, Start: 5, End: 6, Preds: []int{1}},
+		{ID: 4, Start: 6, End: 7},
+		{ID: 5, Start: 7, End: 8, Preds: []int{2}},
+	}
+
+	if len(g.Blocks) != len(expected) {
+		t.Fatalf("got %d blocks, expected %d", len(g.Blocks), len(expected))
+	}
+	for i, b := range g.Blocks {
+		expected[i].Instructions = ip4OrIP6[expected[i].Start:expected[i].End]
+		if !reflect.DeepEqual(*b, expected[i]) {
+			t.Errorf("block %d: got %+v, expected %+v", i, *b, expected[i])
+		}
+	}
+
+	for pc := range ip4OrIP6 {
+		if b := g.BlockOf(pc); pc < b.Start || pc >= b.End {
+			t.Errorf("instruction %d: got block %d (%d-%d)", pc, b.ID, b.Start, b.End)
+		}
+	}
+	if b := g.BlockOf(len(ip4OrIP6)); b != nil {
+		t.Errorf("got block %d for instruction out of bounds, expected nil", b.ID)
+	}
+}
+
+func TestNewFallthrough(t *testing.T) {
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+	}
+
+	g, err := New(prog)
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+
+	expected := [][]Edge{
+		{{From: 0, To: 2, Kind: True}, {From: 0, To: 1, Kind: False}},
+		{{From: 1, To: 2, Kind: Fallthrough}},
+		nil,
+	}
+	if len(g.Blocks) != len(expected) {
+		t.Fatalf("got %d blocks, expected %d", len(g.Blocks), len(expected))
+	}
+	for i, b := range g.Blocks {
+		if !reflect.DeepEqual(b.Succs, expected[i]) {
+			t.Errorf("block %d: got edges %+v, expected %+v", i, b.Succs, expected[i])
+		}
+	}
+}
+
+func TestNewSameTargets(t *testing.T) {
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1, SkipFalse: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	g, err := New(prog)
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+
+	if len(g.Blocks) != 3 {
+		t.Fatalf("got %d blocks, expected 3", len(g.Blocks))
+	}
+	expected := []Edge{{From: 0, To: 2, Kind: True}, {From: 0, To: 2, Kind: False}}
+	if !reflect.DeepEqual(g.Blocks[0].Succs, expected) {
+		t.Errorf("got edges %+v, expected %+v", g.Blocks[0].Succs, expected)
+	}
+	if !reflect.DeepEqual(g.Blocks[2].Preds, []int{0}) {
+		t.Errorf("got predecessors %v, expected [0]", g.Blocks[2].Preds)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+		err         string
+	}{
+		{
+			description: "empty",
+			err:         "empty program",
+		},
+		{
+			description: "jump out of bounds",
+			prog:        []bpf.Instruction{bpf.Jump{Skip: 1}, bpf.RetA{}},
+			err:         "instruction 0: jump out of bounds",
+		},
+		{
+			description: "conditional jump out of bounds",
+			prog:        []bpf.Instruction{bpf.JumpIf{Cond: bpf.JumpEqual, SkipFalse: 2}, bpf.RetA{}},
+			err:         "instruction 0: jump out of bounds",
+		},
+	}
+
+	for _, test := range cases {
+		if _, err := New(test.prog); err == nil || err.Error() != test.err {
+			t.Errorf("case '%s': got error %v, expected '%s'", test.description, err, test.err)
+		}
+	}
+}
+
+func TestNewFromPcap(t *testing.T) {
+	raw, err := bpf.Assemble(ip4OrIP6)
+	if err != nil {
+		t.Fatalf("failed to assemble with error: %s", err.Error())
+	}
+
+	g, err := NewFromPcap(bpfutils.ToPcapBPFInstructions(raw))
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+	if len(g.Blocks) != 6 {
+		t.Errorf("got %d blocks, expected 6", len(g.Blocks))
+	}
+
+	invalid := []pcap.BPFInstruction{{Code: 0xffff}}
+	if _, err := NewFromPcap(invalid); err == nil {
+		t.Errorf("expected error for invalid instruction")
+	}
+}
+
+func TestReachability(t *testing.T) {
+	g, err := New(ip4OrIP6)
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+
+	unreachable := g.Unreachable()
+	if len(unreachable) != 1 || unreachable[0].ID != 4 {
+		t.Errorf("got unreachable blocks %+v, expected block 4", unreachable)
+	}
+
+	cases := []struct {
+		from, to int
+		expected bool
+	}{
+		{from: 0, to: 0, expected: true},
+		{from: 0, to: 5, expected: true},
+		{from: 1, to: 3, expected: true},
+		{from: 2, to: 3, expected: false},
+		{from: 3, to: 5, expected: false},
+		{from: 0, to: 4, expected: false},
+		{from: 5, to: 0, expected: false},
+	}
+
+	for _, test := range cases {
+		if got := g.Reaches(g.Blocks[test.from], g.Blocks[test.to]); got != test.expected {
+			t.Errorf("block %d reaches block %d: %t, expected %t", test.from, test.to, got, test.expected)
+		}
+	}
+}
+
+func TestDOT(t *testing.T) {
+	g, err := New(ip4OrIP6)
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+
+	expected := `digraph bpf {
+	node [shape=box, fontname="monospace"];
+	b0 [label="0-1:\lldh [12]\ljeq #2048,1\l"];
+	b1 [label="2-2:\ljneq #34525,2\l"];
+	b2 [label="3-4:\lld #65535\ljmp 2\l"];
+	b3 [label="5-5:\lret #0\l"];
+	b4 [label="6-6:\lret #1\l"];
+	b5 [label="7-7:\lret a\l"];
+	b0 -> b2 [label="true"];
+	b0 -> b1 [label="false"];
+	b1 -> b2 [label="true"];
+	b1 -> b3 [label="false"];
+	b2 -> b5;
+}
+`
+	if got := g.DOT(); got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	var buffer bytes.Buffer
+	if err := g.WriteDOT(&buffer); err != nil || buffer.String() != expected {
+		t.Errorf("WriteDOT: got error %v and output:\n%s", err, buffer.String())
+	}
+}
+
+func TestEdgeKindString(t *testing.T) {
+	cases := []struct {
+		kind     EdgeKind
+		expected string
+	}{
+		{kind: Fallthrough, expected: "fallthrough"},
+		{kind: Jump, expected: "jump"},
+		{kind: True, expected: "true"},
+		{kind: False, expected: "false"},
+		{kind: 4, expected: "unknown"},
+	}
+
+	for _, test := range cases {
+		if got := test.kind.String(); got != test.expected {
+			t.Errorf("got %s, expected %s", got, test.expected)
+		}
+	}
+}
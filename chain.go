@@ -6,6 +6,8 @@ import (
 	"github.com/google/gopacket/pcap"
 
 	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils/internal/reloc"
 )
 
 // Possible ChainType values
@@ -13,10 +15,13 @@ const (
 	UNDEFINED = iota
 	AND
 	OR
+	NOT
+	XOR
+	ANDNOT
 )
 
 // ChainType defines possible chain operations for BPF filters.
-// Currently only AND and OR are supported. For details see documentation of function ChainFilter.
+// Supported are AND, OR, NOT, XOR and ANDNOT. For details see documentation of function ChainFilter.
 type ChainType int
 
 // String returns a string representation of ChainType.
@@ -26,6 +31,12 @@ func (c ChainType) String() string {
 		return "and"
 	case OR:
 		return "or"
+	case NOT:
+		return "not"
+	case XOR:
+		return "xor"
+	case ANDNOT:
+		return "andnot"
 	case UNDEFINED:
 		return "undefined"
 	default:
@@ -49,47 +60,67 @@ func (c ChainType) String() string {
 //   if a packet would be returned after the first block (register a > 0)
 // * OR-case: only evaluate second block,
 //   if the packet would not be returned after the first block (register a == 0)
+//
+// All jumps in the first BPF block are relocated, such that they still point to the same
+// instructions after the rewrite. If the skip count of a conditional jump exceeds 8 bits, the
+// jump is redirected to an unconditional jump (trampoline), which is able to skip up to 2^32
+// instructions. If a jump of a or b has a target beyond the end of its block, nil is returned.
+//
+// The remaining chain types are compiled with CompileExpr:
+// * NOT: invert the decision of the first block, the second block is ignored
+//   (same as CompileExpr(Not(Filter(a))))
+// * XOR: accept the packet, if exactly one of the blocks would accept it
+//   (same as CompileExpr(Xor(Filter(a), Filter(b))))
+// * ANDNOT: accept the packet, if the first block would accept it and the second block would not
+//   (same as CompileExpr(And(Filter(a), Not(Filter(b)))))
 func ChainFilter(a, b []bpf.Instruction, ct ChainType) []bpf.Instruction {
-	bpfChained := make([]bpf.Instruction, 0, len(a)+len(b)+10)
-	offset := len(a)
+	switch ct {
+	case NOT:
+		return CompileExpr(Not(Filter(a)))
+	case XOR:
+		return CompileExpr(Xor(Filter(a), Filter(b)))
+	case ANDNOT:
+		return CompileExpr(And(Filter(a), Not(Filter(b))))
+	}
+
+	p := &reloc.Program{}
 
 	// Traverse BPF block A
-	for i, instr := range a {
+	labels := p.NewLabels(len(a) + 1)
+	blockB := labels[len(a)]
+	err := p.AppendRelocated(a, labels, func(i int, instr bpf.Instruction) bool {
 		switch inst := instr.(type) {
 		case bpf.RetConstant:
 			if (ct == AND && inst.Val > 0) || (ct == OR && inst.Val == 0) {
-				// insert a jump, only if the skip value is more than 0
-				if offset-i-1 > 0 {
-					bpfChained = append(bpfChained, bpf.Jump{
-						Skip: uint32(offset - i - 1),
-					})
-				}
-				continue
+				p.Jump(blockB)
+				return true
 			}
 		case bpf.RetA:
+			ret := p.NewLabel()
 			switch ct {
 			case AND:
-				bpfChained = append(bpfChained, bpf.JumpIf{
-					Cond:     bpf.JumpNotEqual,
-					Val:      0,
-					SkipTrue: 1,
-				}, instr)
+				p.JumpIf(bpf.JumpNotEqual, 0, blockB, ret)
 			case OR:
-				bpfChained = append(bpfChained, bpf.JumpIf{
-					Cond:     bpf.JumpEqual,
-					Val:      0,
-					SkipTrue: 1,
-				}, instr)
+				p.JumpIf(bpf.JumpEqual, 0, blockB, ret)
+			default:
+				return false
 			}
-			continue
+			p.Mark(ret)
+			p.Append(instr)
+			return true
 		}
-		bpfChained = append(bpfChained, instr)
+		return false
+	})
+	if err != nil {
+		return nil
 	}
 
 	// Add BPF block B
-	bpfChained = append(bpfChained, b...)
+	if err := p.AppendRelocated(b, p.NewLabels(len(b)+1), nil); err != nil {
+		return nil
+	}
 
-	return bpfChained
+	return p.Instructions()
 }
 
 // ChainPcapFilter combines two []pcap.BPFInstruction BPF filter.
@@ -103,7 +134,11 @@ func ChainPcapFilter(a, b []pcap.BPFInstruction, ct ChainType) ([]pcap.BPFInstru
 	if !ok {
 		return nil, fmt.Errorf("Unable to convert '%#v'", b)
 	}
-	rawBpf, err := bpf.Assemble(ChainFilter(a0, b0, ct))
+	chained := ChainFilter(a0, b0, ct)
+	if chained == nil {
+		return nil, fmt.Errorf("Unable to chain filters with jumps out of range")
+	}
+	rawBpf, err := bpf.Assemble(chained)
 	if err != nil {
 		return nil, err
 	}
@@ -29,6 +29,18 @@ func TestChainTypeString(t *testing.T) {
 		},
 		{
 			input:  3,
+			output: "not",
+		},
+		{
+			input:  4,
+			output: "xor",
+		},
+		{
+			input:  5,
+			output: "andnot",
+		},
+		{
+			input:  6,
 			output: "undefined",
 		},
 	}
@@ -154,6 +166,78 @@ func TestChainFilter(t *testing.T) {
 				bpf.RetA{},
 			},
 		},
+		{
+			description: "relocate jumps crossing a RetA in the middle of the first filter",
+			inputA: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 6, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 2},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xff},
+				bpf.RetA{},
+				bpf.RetConstant{Val: 0},
+			},
+			inputB: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+			expectAnd: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 6, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 3},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xff},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0, SkipTrue: 2},
+				bpf.RetA{},
+				bpf.RetConstant{Val: 0},
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+			expectOr: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 6, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 3},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xff},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 1},
+				bpf.RetA{},
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+		},
+		{
+			description: "relocate jumps comparing with X crossing a RetA in the first filter",
+			inputA: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 6, Size: 2},
+				bpf.TAX{},
+				bpf.LoadAbsolute{Off: 8, Size: 2},
+				bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 2},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xff},
+				bpf.RetA{},
+				bpf.RetConstant{Val: 0},
+			},
+			inputB: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+			expectAnd: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 6, Size: 2},
+				bpf.TAX{},
+				bpf.LoadAbsolute{Off: 8, Size: 2},
+				bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 3},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xff},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0, SkipTrue: 2},
+				bpf.RetA{},
+				bpf.RetConstant{Val: 0},
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+			expectOr: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 6, Size: 2},
+				bpf.TAX{},
+				bpf.LoadAbsolute{Off: 8, Size: 2},
+				bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 3},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xff},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 1},
+				bpf.RetA{},
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+		},
 	}
 
 	handle, err := pcap.OpenOffline("pcap/test_loopback.pcap")
@@ -227,3 +311,225 @@ func TestChainFilter(t *testing.T) {
 
 	}
 }
+
+// Filters for the IPv6 over DLT_NULL packets in pcap/test_loopback.pcap.
+var loopbackFilters = map[string][]bpf.Instruction{
+	"ip6 and tcp": {
+		bpf.LoadAbsolute{Off: 0, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x1e000000, SkipTrue: 3},
+		bpf.LoadAbsolute{Off: 10, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	},
+	"len > 500": {
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 500, SkipFalse: 1},
+		bpf.RetConstant{Val: 262144},
+		bpf.RetConstant{Val: 0},
+	},
+	"flow label or len": {
+		bpf.LoadAbsolute{Off: 6, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 2},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xff},
+		bpf.RetA{},
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 100, SkipTrue: 1},
+		bpf.RetA{},
+		bpf.RetConstant{Val: 0},
+	},
+	"ip6 payload < 100": {
+		bpf.LoadAbsolute{Off: 8, Size: 2},
+		bpf.StoreScratch{Src: bpf.RegA, N: 1},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 100, SkipTrue: 2, SkipFalse: 0},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 1},
+		bpf.RetA{},
+		bpf.RetConstant{Val: 0},
+	},
+	"long jumps": longJumpFilter(),
+}
+
+// longJumpFilter returns a filter with a conditional jump close to the 8 bit limit,
+// which is crossed by many `ret a`. Chaining this filter needs trampolines, because
+// every `ret a` is expanded to two instructions.
+func longJumpFilter() []bpf.Instruction {
+	filter := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 500, SkipTrue: 241},
+	}
+	for i := uint32(0); i < 120; i++ {
+		filter = append(filter,
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 50 + i, SkipTrue: 1},
+			bpf.RetA{},
+		)
+	}
+	return append(filter,
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 65535},
+	)
+}
+
+func readPackets(t *testing.T, file string) [][]byte {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		t.Fatalf("failed to open pcap handle: %s", err.Error())
+	}
+	defer handle.Close()
+
+	var packets [][]byte
+	for {
+		data, _, err := handle.ReadPacketData()
+		if err != nil {
+			break
+		}
+		packets = append(packets, data)
+	}
+	if len(packets) == 0 {
+		t.Fatalf("no packets read from %s", file)
+	}
+	return packets
+}
+
+func runFilter(t *testing.T, filter []bpf.Instruction, packet []byte) int {
+	vm, err := bpf.NewVM(filter)
+	if err != nil {
+		t.Fatalf("failed to create VM with error: %s\n%s", err.Error(), AsmString(filter))
+	}
+	ret, err := vm.Run(packet)
+	if err != nil {
+		t.Fatalf("failed to run VM with error: %s\n%s", err.Error(), AsmString(filter))
+	}
+	return ret
+}
+
+func TestChainFilterSemantics(t *testing.T) {
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	for nameA, a := range loopbackFilters {
+		for nameB, b := range loopbackFilters {
+			and := ChainFilter(a, b, AND)
+			or := ChainFilter(a, b, OR)
+
+			for _, chained := range [][]bpf.Instruction{and, or} {
+				if _, err := bpf.Assemble(chained); err != nil {
+					t.Errorf("chaining '%s' with '%s': failed to assemble with error: %s", nameA, nameB, err.Error())
+				}
+			}
+
+			for i, packet := range packets {
+				retA := runFilter(t, a, packet)
+				retB := runFilter(t, b, packet)
+
+				expectAnd := 0
+				if retA > 0 {
+					expectAnd = retB
+				}
+				if got := runFilter(t, and, packet); got != expectAnd {
+					t.Errorf("packet %d: '%s' and '%s' returned %d, expected %d\n%s", i, nameA, nameB, got, expectAnd, AsmString(and))
+				}
+
+				expectOr := retA
+				if retA == 0 {
+					expectOr = retB
+				}
+				if got := runFilter(t, or, packet); got != expectOr {
+					t.Errorf("packet %d: '%s' or '%s' returned %d, expected %d\n%s", i, nameA, nameB, got, expectOr, AsmString(or))
+				}
+			}
+		}
+	}
+}
+
+func TestChainFilterNotXorAndNot(t *testing.T) {
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	for nameA, a := range loopbackFilters {
+		for nameB, b := range loopbackFilters {
+			not := ChainFilter(a, b, NOT)
+			xor := ChainFilter(a, b, XOR)
+			andNot := ChainFilter(a, b, ANDNOT)
+
+			for i, packet := range packets {
+				acceptA := runFilter(t, a, packet) > 0
+				acceptB := runFilter(t, b, packet) > 0
+
+				if got := runFilter(t, not, packet) > 0; got != !acceptA {
+					t.Errorf("packet %d: not '%s' accepted: %t, expected: %t\n%s", i, nameA, got, !acceptA, AsmString(not))
+				}
+				if got := runFilter(t, xor, packet) > 0; got != (acceptA != acceptB) {
+					t.Errorf("packet %d: '%s' xor '%s' accepted: %t, expected: %t\n%s", i, nameA, nameB, got, acceptA != acceptB, AsmString(xor))
+				}
+				if got := runFilter(t, andNot, packet) > 0; got != (acceptA && !acceptB) {
+					t.Errorf("packet %d: '%s' andnot '%s' accepted: %t, expected: %t\n%s", i, nameA, nameB, got, acceptA && !acceptB, AsmString(andNot))
+				}
+			}
+		}
+	}
+}
+
+func TestChainPcapFilterNot(t *testing.T) {
+	a, err := bpf.Assemble(loopbackFilters["len > 500"])
+	if err != nil {
+		t.Fatalf("failed to assemble with error: %s", err.Error())
+	}
+
+	got, err := ChainPcapFilter(ToPcapBPFInstructions(a), nil, NOT)
+	if err != nil {
+		t.Fatalf("ChainPcapFilter failed with error: %s", err.Error())
+	}
+	not, ok := ToBpfInstructions(got)
+	if !ok {
+		t.Fatalf("failed to convert '%#v'", got)
+	}
+
+	for i, packet := range readPackets(t, "pcap/test_loopback.pcap") {
+		if accepted, expect := runFilter(t, not, packet) > 0, len(packet) <= 500; accepted != expect {
+			t.Errorf("packet %d: accepted: %t, expected: %t\n%s", i, accepted, expect, AsmString(not))
+		}
+	}
+}
+
+func TestChainFilterJumpOutOfRange(t *testing.T) {
+	valid := []bpf.Instruction{bpf.RetConstant{Val: 1}}
+	cases := []struct {
+		description string
+		filter      []bpf.Instruction
+	}{
+		{
+			description: "jump past the end",
+			filter: []bpf.Instruction{
+				bpf.Jump{Skip: 1},
+				bpf.RetConstant{Val: 1},
+			},
+		},
+		{
+			description: "conditional jump past the end",
+			filter: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 500, SkipFalse: 2},
+				bpf.RetConstant{Val: 1},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		for _, ct := range []ChainType{AND, OR, NOT, XOR, ANDNOT} {
+			if got := ChainFilter(test.filter, valid, ct); got != nil {
+				t.Errorf("case '%s' first filter %s: got %#v, expected nil", test.description, ct, got)
+			}
+		}
+		for _, ct := range []ChainType{AND, OR, XOR, ANDNOT} {
+			if got := ChainFilter(valid, test.filter, ct); got != nil {
+				t.Errorf("case '%s' second filter %s: got %#v, expected nil", test.description, ct, got)
+			}
+		}
+
+		raw, err := bpf.Assemble(test.filter)
+		if err != nil {
+			t.Fatalf("case '%s': failed to assemble with error: %s", test.description, err.Error())
+		}
+		if _, err := ChainPcapFilter(ToPcapBPFInstructions(raw), ToPcapBPFInstructions(raw), AND); err == nil {
+			t.Errorf("case '%s': ChainPcapFilter succeeded, expected an error", test.description)
+		}
+	}
+}
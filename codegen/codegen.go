@@ -0,0 +1,464 @@
+// Package codegen compiles classic BPF programs from golang.org/x/net/bpf to straight-line Go
+// and C source code. The generated function returns the same value for a packet as the
+// program executed by bpfutils.Run, but without the overhead of an interpreter loop.
+//
+// The generated code has no access to ancillary data, only the extension `#len` is supported.
+// Loads relative to the link layer or network layer header (e.g. `ldb [net+9]`) are not
+// supported either.
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"math"
+	"strings"
+
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils"
+)
+
+// Go returns the source of the Go function
+//
+//	func name(pkt []byte) uint32
+//
+// which implements prog. The generated code does not depend on any package.
+func Go(name string, prog []bpf.Instruction) (string, error) {
+	g := newGenerator(prog, false)
+	g.line("// %s returns the verdict of a classic BPF program for pkt, it is generated by", name)
+	g.line("// github.com/breml/bpfutils/codegen.")
+	g.line("func %s(pkt []byte) uint32 {", name)
+	g.line("var a, x uint32")
+	g.line("_, _ = a, x")
+	if g.usesScratch() {
+		g.line("var m [16]uint32")
+	}
+	if err := g.body(); err != nil {
+		return "", err
+	}
+	g.line("}")
+
+	src, err := format.Source(g.buffer.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("failed to format generated code: %s", err.Error())
+	}
+	return string(src), nil
+}
+
+// C returns the source of the C function
+//
+//	uint32_t name(const uint8_t *pkt, size_t len)
+//
+// which implements prog. The generated code requires the headers stdint.h and stddef.h.
+func C(name string, prog []bpf.Instruction) (string, error) {
+	g := newGenerator(prog, true)
+	g.line("/* %s returns the verdict of a classic BPF program for pkt, it is generated by", name)
+	g.line(" * github.com/breml/bpfutils/codegen. */")
+	g.line("uint32_t %s(const uint8_t *pkt, size_t len)", name)
+	g.line("{")
+	g.line("\tuint32_t a = 0, x = 0;")
+	g.line("\t(void)a;")
+	g.line("\t(void)x;")
+	if g.usesScratch() {
+		g.line("\tuint32_t m[16] = {0};")
+	}
+	if err := g.body(); err != nil {
+		return "", err
+	}
+	g.line("}")
+	return g.buffer.String(), nil
+}
+
+func (g *generator) usesScratch() bool {
+	for _, inst := range g.prog {
+		switch inst.(type) {
+		case bpf.LoadScratch, bpf.StoreScratch:
+			return true
+		}
+	}
+	return false
+}
+
+type generator struct {
+	prog   []bpf.Instruction
+	buffer bytes.Buffer
+	// c is true for C and false for Go.
+	c bool
+}
+
+// newGenerator returns a generator for prog, whose raw instructions are disassembled. Jumps
+// with the condition bpf.JumpBitsNotSet are replaced by bpf.JumpBitsSet with swapped targets,
+// which has a bpf_asm representation for the comments.
+func newGenerator(prog []bpf.Instruction, c bool) *generator {
+	g := &generator{prog: make([]bpf.Instruction, len(prog)), c: c}
+	for i, inst := range prog {
+		if raw, ok := inst.(bpf.RawInstruction); ok {
+			inst = raw.Disassemble()
+		}
+		if jump, ok := inst.(bpf.JumpIf); ok && jump.Cond == bpf.JumpBitsNotSet {
+			inst = bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: jump.Val, SkipTrue: jump.SkipFalse, SkipFalse: jump.SkipTrue}
+		}
+		if jump, ok := inst.(bpf.JumpIfX); ok && jump.Cond == bpf.JumpBitsNotSet {
+			inst = bpf.JumpIfX{Cond: bpf.JumpBitsSet, SkipTrue: jump.SkipFalse, SkipFalse: jump.SkipTrue}
+		}
+		g.prog[i] = inst
+	}
+	return g
+}
+
+func (g *generator) line(format string, args ...interface{}) {
+	g.buffer.WriteString(fmt.Sprintf(format, args...))
+	g.buffer.WriteString("\n")
+}
+
+// stmt writes a statement, which is terminated with a semicolon for C.
+func (g *generator) stmt(format string, args ...interface{}) {
+	if g.c {
+		format += ";"
+	}
+	g.line("\t"+format, args...)
+}
+
+// ifStmt writes a statement, which is only executed if cond is true.
+func (g *generator) ifStmt(cond, format string, args ...interface{}) {
+	if g.c {
+		g.line("\tif (%s) {", cond)
+	} else {
+		g.line("\tif %s {", cond)
+	}
+	g.stmt("\t"+format, args...)
+	g.line("\t}")
+}
+
+// constant returns val as literal, C literals are marked as unsigned.
+func (g *generator) constant(val uint32) string {
+	lit := fmt.Sprintf("%d", val)
+	if val > 9 {
+		lit = fmt.Sprintf("%#x", val)
+	}
+	if g.c {
+		lit += "u"
+	}
+	return lit
+}
+
+// length returns the expression for the length of the packet.
+func (g *generator) length() string {
+	if g.c {
+		return "len"
+	}
+	return "len(pkt)"
+}
+
+// body writes the instructions of the program, which are reachable from the first one. Only
+// the jump targets get a label.
+func (g *generator) body() error {
+	reachable := make([]bool, len(g.prog)+1)
+	targets := make([]bool, len(g.prog)+1)
+	if len(g.prog) > 0 {
+		reachable[0] = true
+	}
+	for i, inst := range g.prog {
+		if !reachable[i] {
+			continue
+		}
+		next, jumps := successors(inst, i)
+		if next {
+			reachable[i+1] = true
+		}
+		for _, target := range jumps {
+			if target >= len(g.prog) {
+				return fmt.Errorf("instruction %d: jump beyond end of program", i)
+			}
+			reachable[target] = true
+			targets[target] = true
+		}
+	}
+	if reachable[len(g.prog)] {
+		return fmt.Errorf("program does not end with a return")
+	}
+
+	for i, inst := range g.prog {
+		if !reachable[i] {
+			continue
+		}
+		if targets[i] {
+			g.line("L%d:", i)
+		}
+		g.line("\t// %s", strings.TrimSpace(bpfutils.AsmString([]bpf.Instruction{inst})))
+		if err := g.instruction(inst, i); err != nil {
+			return fmt.Errorf("instruction %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+// successors returns, if the instruction at index i continues with the next instruction,
+// and the targets of the jumps, which are not the next instruction.
+func successors(instr bpf.Instruction, i int) (next bool, jumps []int) {
+	add := func(skip uint32) {
+		if skip == 0 {
+			next = true
+			return
+		}
+		jumps = append(jumps, i+1+int(skip))
+	}
+
+	switch inst := instr.(type) {
+	case bpf.Jump:
+		add(inst.Skip)
+	case bpf.JumpIf:
+		add(uint32(inst.SkipTrue))
+		add(uint32(inst.SkipFalse))
+	case bpf.JumpIfX:
+		add(uint32(inst.SkipTrue))
+		add(uint32(inst.SkipFalse))
+	case bpf.RetA, bpf.RetConstant:
+	default:
+		next = true
+	}
+	return next, jumps
+}
+
+// instruction writes the code for the instruction at index i.
+func (g *generator) instruction(instr bpf.Instruction, i int) error {
+	switch inst := instr.(type) {
+	case bpf.ALUOpConstant:
+		switch inst.Op {
+		case bpf.ALUOpDiv, bpf.ALUOpMod:
+			if inst.Val == 0 {
+				return fmt.Errorf("division by constant zero")
+			}
+		case bpf.ALUOpShiftLeft, bpf.ALUOpShiftRight:
+			if inst.Val >= 32 {
+				g.stmt("a = 0")
+				return nil
+			}
+		}
+		return g.alu(inst.Op, g.constant(inst.Val))
+
+	case bpf.ALUOpX:
+		switch inst.Op {
+		case bpf.ALUOpDiv, bpf.ALUOpMod:
+			g.ifStmt("x == 0", "return 0")
+		case bpf.ALUOpShiftLeft, bpf.ALUOpShiftRight:
+			if g.c {
+				// shifts by the width of the type or more are undefined in C
+				g.stmt("a = x < 32 ? a %s x : 0", strings.TrimSuffix(aluOperators[inst.Op], "="))
+				return nil
+			}
+		}
+		return g.alu(inst.Op, "x")
+
+	case bpf.NegateA:
+		g.stmt("a = -a")
+
+	case bpf.Jump:
+		g.jump(i, inst.Skip)
+
+	case bpf.JumpIf:
+		return g.conditionalJump(i, inst.Cond, g.constant(inst.Val), inst.SkipTrue, inst.SkipFalse)
+
+	case bpf.JumpIfX:
+		return g.conditionalJump(i, inst.Cond, "x", inst.SkipTrue, inst.SkipFalse)
+
+	case bpf.LoadAbsolute:
+		if inst.Size == 4 && inst.Off > 0xFFFFFFFF-0x1000 {
+			return g.loadExtension(bpf.Extension(inst.Off + 0x1000))
+		}
+		return g.load(inst.Size, "", inst.Off)
+
+	case bpf.LoadIndirect:
+		return g.load(inst.Size, "x", inst.Off)
+
+	case bpf.LoadMemShift:
+		if inst.Off >= skfLLOff {
+			return fmt.Errorf("loads relative to the link layer or network layer header are not supported")
+		}
+		g.boundsCheck("", uint64(inst.Off)+1)
+		g.stmt("x = %s", g.index("", uint64(inst.Off)))
+		g.stmt("x = (x & 0xf) << 2")
+
+	case bpf.LoadConstant:
+		switch inst.Dst {
+		case bpf.RegA:
+			g.stmt("a = %s", g.constant(inst.Val))
+		case bpf.RegX:
+			g.stmt("x = %s", g.constant(inst.Val))
+		default:
+			return fmt.Errorf("invalid register %d", inst.Dst)
+		}
+
+	case bpf.LoadExtension:
+		return g.loadExtension(inst.Num)
+
+	case bpf.LoadScratch:
+		if inst.N < 0 || inst.N >= 16 {
+			return fmt.Errorf("invalid scratch slot %d", inst.N)
+		}
+		switch inst.Dst {
+		case bpf.RegA:
+			g.stmt("a = m[%d]", inst.N)
+		case bpf.RegX:
+			g.stmt("x = m[%d]", inst.N)
+		default:
+			return fmt.Errorf("invalid register %d", inst.Dst)
+		}
+
+	case bpf.StoreScratch:
+		if inst.N < 0 || inst.N >= 16 {
+			return fmt.Errorf("invalid scratch slot %d", inst.N)
+		}
+		switch inst.Src {
+		case bpf.RegA:
+			g.stmt("m[%d] = a", inst.N)
+		case bpf.RegX:
+			g.stmt("m[%d] = x", inst.N)
+		default:
+			return fmt.Errorf("invalid register %d", inst.Src)
+		}
+
+	case bpf.TAX:
+		g.stmt("x = a")
+
+	case bpf.TXA:
+		g.stmt("a = x")
+
+	case bpf.RetA:
+		g.stmt("return a")
+
+	case bpf.RetConstant:
+		g.stmt("return %s", g.constant(inst.Val))
+
+	default:
+		return fmt.Errorf("unsupported instruction: %#v", inst)
+	}
+
+	return nil
+}
+
+// skfLLOff (SKF_LL_OFF) is the lowest offset of the loads relative to the link layer or the
+// network layer header.
+const skfLLOff uint32 = 0xffe00000
+
+var aluOperators = map[bpf.ALUOp]string{
+	bpf.ALUOpAdd:        "+=",
+	bpf.ALUOpSub:        "-=",
+	bpf.ALUOpMul:        "*=",
+	bpf.ALUOpDiv:        "/=",
+	bpf.ALUOpMod:        "%=",
+	bpf.ALUOpAnd:        "&=",
+	bpf.ALUOpOr:         "|=",
+	bpf.ALUOpXor:        "^=",
+	bpf.ALUOpShiftLeft:  "<<=",
+	bpf.ALUOpShiftRight: ">>=",
+}
+
+func (g *generator) alu(op bpf.ALUOp, operand string) error {
+	operator, ok := aluOperators[op]
+	if !ok {
+		return fmt.Errorf("invalid ALU operation %d", op)
+	}
+	g.stmt("a %s %s", operator, operand)
+	return nil
+}
+
+// jump writes a jump from the instruction at index i over skip instructions.
+func (g *generator) jump(i int, skip uint32) {
+	if skip > 0 {
+		g.stmt("goto L%d", i+1+int(skip))
+	}
+}
+
+// conditions contains for every jump condition the comparison of a with the operand and the
+// negated comparison.
+var conditions = map[bpf.JumpTest][2]string{
+	bpf.JumpEqual:          {"a == %s", "a != %s"},
+	bpf.JumpNotEqual:       {"a != %s", "a == %s"},
+	bpf.JumpGreaterThan:    {"a > %s", "a <= %s"},
+	bpf.JumpLessThan:       {"a < %s", "a >= %s"},
+	bpf.JumpGreaterOrEqual: {"a >= %s", "a < %s"},
+	bpf.JumpLessOrEqual:    {"a <= %s", "a > %s"},
+	bpf.JumpBitsSet:        {"(a & %s) != 0", "(a & %s) == 0"},
+}
+
+func (g *generator) conditionalJump(i int, cond bpf.JumpTest, operand string, skipTrue, skipFalse uint8) error {
+	condition, ok := conditions[cond]
+	if !ok {
+		return fmt.Errorf("invalid jump condition %d", cond)
+	}
+	switch {
+	case skipTrue == skipFalse:
+		g.jump(i, uint32(skipTrue))
+	case skipTrue == 0:
+		g.ifStmt(fmt.Sprintf(condition[1], operand), "goto L%d", i+1+int(skipFalse))
+	default:
+		g.ifStmt(fmt.Sprintf(condition[0], operand), "goto L%d", i+1+int(skipTrue))
+		g.jump(i, uint32(skipFalse))
+	}
+	return nil
+}
+
+// index returns the expression for the packet byte at offset off relative to base, which is
+// either empty or the register x.
+func (g *generator) index(base string, off uint64) string {
+	expr := fmt.Sprintf("%d", off)
+	if base != "" {
+		expr = fmt.Sprintf("%s+%d", base, off)
+	}
+	if g.c {
+		return fmt.Sprintf("(uint32_t)pkt[%s]", expr)
+	}
+	return fmt.Sprintf("uint32(pkt[%s])", expr)
+}
+
+// boundsCheck writes the check, that the packet contains end bytes after base, which is
+// either empty or the register x.
+func (g *generator) boundsCheck(base string, end uint64) {
+	switch {
+	case base != "" && g.c:
+		g.ifStmt(fmt.Sprintf("(uint64_t)%s+%d > len", base, end), "return 0")
+	case base != "":
+		g.ifStmt(fmt.Sprintf("uint64(%s)+%d > uint64(len(pkt))", base, end), "return 0")
+	case end > math.MaxInt32 && !g.c:
+		g.ifStmt(fmt.Sprintf("uint64(len(pkt)) < %d", end), "return 0")
+	default:
+		g.ifStmt(fmt.Sprintf("%s < %d", g.length(), end), "return 0")
+	}
+}
+
+// load writes the load of size bytes in network byte order at offset off relative to base,
+// which is either empty or the register x.
+func (g *generator) load(size int, base string, off uint32) error {
+	if size != 1 && size != 2 && size != 4 {
+		return fmt.Errorf("invalid load size %d", size)
+	}
+	if off >= skfLLOff {
+		return fmt.Errorf("loads relative to the link layer or network layer header are not supported")
+	}
+	g.boundsCheck(base, uint64(off)+uint64(size))
+
+	var parts []string
+	for b := 0; b < size; b++ {
+		part := g.index(base, uint64(off)+uint64(b))
+		if shift := 8 * (size - 1 - b); shift > 0 {
+			part = fmt.Sprintf("%s<<%d", part, shift)
+		}
+		parts = append(parts, part)
+	}
+	g.stmt("a = %s", strings.Join(parts, " | "))
+	return nil
+}
+
+func (g *generator) loadExtension(ext bpf.Extension) error {
+	if ext != bpf.ExtLen {
+		return fmt.Errorf("extension %d is not supported", ext)
+	}
+	if g.c {
+		g.stmt("a = (uint32_t)len")
+	} else {
+		g.stmt("a = uint32(len(pkt))")
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package codegen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils"
+)
+
+var update = flag.Bool("update", false, "update the generated functions in generated_test.go")
+
+// programs are compiled to the functions in generated_test.go.
+var programs = []struct {
+	name string
+	asm  string
+	fn   func(pkt []byte) uint32
+}{
+	{
+		// tcp portrange 58800-58810, compiled for DLT_NULL
+		name: "tcpPortrange",
+		asm: `ld [0]
+			jeq #33554432,8
+			jeq #2,7
+			jeq #402653184,6
+			jeq #469762048,5
+			jeq #503316480,4
+			jeq #24,3
+			jeq #28,2
+			jeq #30,1
+			ret #0
+			ldb [4]
+			and #240
+			jneq #64,16
+			ldb [13]
+			jneq #6,14
+			ldh [10]
+			jset #8191,12
+			ldx 4*([4]&0xf)
+			ldh [x + 4]
+			jlt #58800,3
+			ldx 4*([4]&0xf)
+			ldh [x + 4]
+			jle #58810,19
+			ldx 4*([4]&0xf)
+			ldh [x + 6]
+			jlt #58800,3
+			ldx 4*([4]&0xf)
+			ldh [x + 6]
+			jle #58810,13
+			ldb [4]
+			and #240
+			jneq #96,11
+			ldb [10]
+			jneq #6,9
+			ldh [44]
+			jlt #58800,2
+			ldh [44]
+			jle #58810,4
+			ldh [46]
+			jlt #58800,3
+			ldh [46]
+			jle #58810,0,1
+			ret #65535
+			ret #0`,
+		fn: tcpPortrange,
+	},
+	{
+		name: "scratch",
+		asm: `ld [0]
+			st M[3]
+			ldxb 4*([4]&0xf)
+			stx M[1]
+			ld #len
+			ldx M[3]
+			sub x
+			ldx M[1]
+			add x
+			ld M[7]
+			add #1
+			ret a`,
+		fn: scratch,
+	},
+	{
+		name: "division",
+		asm: `ld #len
+			and #7
+			tax
+			ld #len
+			div x
+			mod #7
+			neg
+			lsh x
+			rsh #1
+			ret a`,
+		fn: division,
+	},
+	{
+		name: "largeConstants",
+		asm: `ld [48]
+			add #0x80000000
+			jgt #0x8a000000,1,3
+			ldh [8]
+			jset #0x8000,2,3
+			ret #1
+			ja 1
+			ret #2
+			ret #0xffffffff`,
+		fn: largeConstants,
+	},
+	{
+		name: "indirect",
+		asm: `ldx #40
+			ldh [x + 4]
+			jeq #8080,2
+			ldh [x + 6]
+			jne #8080,1,2
+			ret #0
+			ret #0xffff
+			ldx #0xfffffff0
+			ld [x + 32]
+			ret a`,
+		fn: indirect,
+	},
+}
+
+func parse(t *testing.T, name, asm string) []bpf.Instruction {
+	prog, err := bpfutils.ParseAsm(strings.NewReader(asm))
+	if err != nil {
+		t.Fatalf("program '%s': failed to parse with error: %s", name, err.Error())
+	}
+	return prog
+}
+
+func TestGo(t *testing.T) {
+	var buffer bytes.Buffer
+	buffer.WriteString("// Code generated by TestGo with -update, DO NOT EDIT.\n\npackage codegen\n")
+	for _, p := range programs {
+		src, err := Go(p.name, parse(t, p.name, p.asm))
+		if err != nil {
+			t.Fatalf("program '%s': failed to generate with error: %s", p.name, err.Error())
+		}
+		buffer.WriteString("\n" + src)
+	}
+
+	if *update {
+		if err := ioutil.WriteFile("generated_test.go", buffer.Bytes(), 0644); err != nil {
+			t.Fatalf("failed to write generated_test.go with error: %s", err.Error())
+		}
+	}
+	expect, err := ioutil.ReadFile("generated_test.go")
+	if err != nil {
+		t.Fatalf("failed to read generated_test.go with error: %s", err.Error())
+	}
+	if !bytes.Equal(buffer.Bytes(), expect) {
+		t.Errorf("generated_test.go is outdated, update it with go test -update:\n%s", buffer.String())
+	}
+}
+
+func readLoopback(t *testing.T) [][]byte {
+	f, err := os.Open("../pcap/test_loopback.pcap")
+	if err != nil {
+		t.Fatalf("failed to open pcap file with error: %s", err.Error())
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read pcap file with error: %s", err.Error())
+	}
+
+	var packets [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("failed to read packet with error: %s", err.Error())
+		}
+		packets = append(packets, data)
+	}
+}
+
+// expected returns the return values of the interpreter for every program and packet.
+func expected(t *testing.T, packets [][]byte) [][]uint32 {
+	var results [][]uint32
+	for _, p := range programs {
+		prog := parse(t, p.name, p.asm)
+		var result []uint32
+		for i, packet := range packets {
+			ret, _, err := bpfutils.Run(prog, packet)
+			if err != nil {
+				t.Fatalf("program '%s', packet %d: failed to run with error: %s", p.name, i, err.Error())
+			}
+			result = append(result, ret)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestGoLoopback(t *testing.T) {
+	packets := readLoopback(t)
+	results := expected(t, packets)
+
+	for i, p := range programs {
+		for j, packet := range packets {
+			if got := p.fn(packet); got != results[i][j] {
+				t.Errorf("program '%s', packet %d: got %d, expected %d", p.name, j, got, results[i][j])
+			}
+		}
+	}
+}
+
+func TestCLoopback(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler found")
+	}
+	packets := readLoopback(t)
+	results := expected(t, packets)
+
+	dir, err := ioutil.TempDir("", "codegen")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory with error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// the test program reads the packets prefixed with their length from stdin and prints
+	// the return value of every function for every packet
+	var src bytes.Buffer
+	src.WriteString("#include <stddef.h>\n#include <stdint.h>\n#include <stdio.h>\n\n")
+	var calls []string
+	for _, p := range programs {
+		code, err := C(p.name, parse(t, p.name, p.asm))
+		if err != nil {
+			t.Fatalf("program '%s': failed to generate with error: %s", p.name, err.Error())
+		}
+		src.WriteString(code + "\n")
+		calls = append(calls, fmt.Sprintf("\t\tprintf(\"%%u\\n\", %s(pkt, len));\n", p.name))
+	}
+	src.WriteString("int main(void)\n{\n\tstatic uint8_t pkt[65536];\n\tuint8_t hdr[4];\n\tuint32_t len;\n\n")
+	src.WriteString("\twhile (fread(hdr, 1, 4, stdin) == 4) {\n")
+	src.WriteString("\t\tlen = (uint32_t)hdr[0] | (uint32_t)hdr[1] << 8 | (uint32_t)hdr[2] << 16 | (uint32_t)hdr[3] << 24;\n")
+	src.WriteString("\t\tif (len > sizeof(pkt) || fread(pkt, 1, len, stdin) != len) {\n\t\t\treturn 1;\n\t\t}\n")
+	src.WriteString(strings.Join(calls, ""))
+	src.WriteString("\t}\n\treturn 0;\n}\n")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "filter.c"), src.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write C source with error: %s", err.Error())
+	}
+	out, err := exec.Command(cc, "-std=c99", "-Wall", "-Werror", "-o", filepath.Join(dir, "filter"), filepath.Join(dir, "filter.c")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to compile with error: %s\n%s\n%s", err.Error(), out, src.String())
+	}
+
+	var input bytes.Buffer
+	for _, packet := range packets {
+		binary.Write(&input, binary.LittleEndian, uint32(len(packet)))
+		input.Write(packet)
+	}
+	cmd := exec.Command(filepath.Join(dir, "filter"))
+	cmd.Stdin = &input
+	out, err = cmd.Output()
+	if err != nil {
+		t.Fatalf("failed to run with error: %s", err.Error())
+	}
+
+	lines := strings.Fields(string(out))
+	if len(lines) != len(packets)*len(programs) {
+		t.Fatalf("got %d results, expected %d", len(lines), len(packets)*len(programs))
+	}
+	for j := range packets {
+		for i, p := range programs {
+			got, err := strconv.ParseUint(lines[j*len(programs)+i], 10, 32)
+			if err != nil {
+				t.Fatalf("failed to parse result with error: %s", err.Error())
+			}
+			if uint32(got) != results[i][j] {
+				t.Errorf("program '%s', packet %d: got %d, expected %d", p.name, j, got, results[i][j])
+			}
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package bpfutils
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
 	"unsafe"
 
 	"github.com/google/gopacket/pcap"
@@ -8,28 +13,73 @@ import (
 	"golang.org/x/net/bpf"
 )
 
-// ToPcapBPFInstructions converts a []bpf.RawInstruction into a []pcap.BPFInstruction
+// pcapLayoutMatches is true, if pcap.BPFInstruction and bpf.RawInstruction have the same memory
+// layout. It is checked once and guards the zero-copy conversions of slices, which fall back to
+// a copy of every field otherwise.
+var pcapLayoutMatches = unsafe.Sizeof(pcap.BPFInstruction{}) == unsafe.Sizeof(bpf.RawInstruction{}) &&
+	unsafe.Offsetof(pcap.BPFInstruction{}.Code) == unsafe.Offsetof(bpf.RawInstruction{}.Op) &&
+	unsafe.Sizeof(pcap.BPFInstruction{}.Code) == unsafe.Sizeof(bpf.RawInstruction{}.Op) &&
+	unsafe.Offsetof(pcap.BPFInstruction{}.Jt) == unsafe.Offsetof(bpf.RawInstruction{}.Jt) &&
+	unsafe.Sizeof(pcap.BPFInstruction{}.Jt) == unsafe.Sizeof(bpf.RawInstruction{}.Jt) &&
+	unsafe.Offsetof(pcap.BPFInstruction{}.Jf) == unsafe.Offsetof(bpf.RawInstruction{}.Jf) &&
+	unsafe.Sizeof(pcap.BPFInstruction{}.Jf) == unsafe.Sizeof(bpf.RawInstruction{}.Jf) &&
+	unsafe.Offsetof(pcap.BPFInstruction{}.K) == unsafe.Offsetof(bpf.RawInstruction{}.K) &&
+	unsafe.Sizeof(pcap.BPFInstruction{}.K) == unsafe.Sizeof(bpf.RawInstruction{}.K)
+
+// ToPcapBPFInstructions converts a []bpf.RawInstruction into a []pcap.BPFInstruction.
+// The returned slice shares its memory with in, unless the layout of the two types differs.
 //#nosec
 func ToPcapBPFInstructions(in []bpf.RawInstruction) []pcap.BPFInstruction {
+	if !pcapLayoutMatches {
+		return CopyToPcapBPFInstructions(in)
+	}
 	return *(*[]pcap.BPFInstruction)(unsafe.Pointer(&in))
 }
 
+// CopyToPcapBPFInstructions converts a []bpf.RawInstruction into a []pcap.BPFInstruction by
+// copying every instruction field by field.
+func CopyToPcapBPFInstructions(in []bpf.RawInstruction) []pcap.BPFInstruction {
+	if in == nil {
+		return nil
+	}
+	out := make([]pcap.BPFInstruction, len(in))
+	for i, inst := range in {
+		out[i] = ToPcapBPFInstruction(inst)
+	}
+	return out
+}
+
 // ToPcapBPFInstruction converts a bpf.RawInstruction into a pcap.BPFInstruction
-//#nosec
 func ToPcapBPFInstruction(in bpf.RawInstruction) pcap.BPFInstruction {
-	return *(*pcap.BPFInstruction)(unsafe.Pointer(&in))
+	return pcap.BPFInstruction{Code: in.Op, Jt: in.Jt, Jf: in.Jf, K: in.K}
 }
 
-// ToBpfRawInstructions converts a []pcap.BPFInstruction into a []bpf.RawInstruction
+// ToBpfRawInstructions converts a []pcap.BPFInstruction into a []bpf.RawInstruction.
+// The returned slice shares its memory with in, unless the layout of the two types differs.
 //#nosec
 func ToBpfRawInstructions(in []pcap.BPFInstruction) []bpf.RawInstruction {
+	if !pcapLayoutMatches {
+		return CopyToBpfRawInstructions(in)
+	}
 	return *(*[]bpf.RawInstruction)(unsafe.Pointer(&in))
 }
 
+// CopyToBpfRawInstructions converts a []pcap.BPFInstruction into a []bpf.RawInstruction by
+// copying every instruction field by field.
+func CopyToBpfRawInstructions(in []pcap.BPFInstruction) []bpf.RawInstruction {
+	if in == nil {
+		return nil
+	}
+	out := make([]bpf.RawInstruction, len(in))
+	for i, inst := range in {
+		out[i] = ToBpfRawInstruction(inst)
+	}
+	return out
+}
+
 // ToBpfRawInstruction converts a pcap.BPFInstruction into a bpf.RawInstruction
-//#nosec
 func ToBpfRawInstruction(in pcap.BPFInstruction) bpf.RawInstruction {
-	return *(*bpf.RawInstruction)(unsafe.Pointer(&in))
+	return bpf.RawInstruction{Op: in.Code, Jt: in.Jt, Jf: in.Jf, K: in.K}
 }
 
 // ToBpfInstructions converts a []pcap.BPFInstruction into a []bpf.Instructions
@@ -41,3 +91,96 @@ func ToBpfInstructions(in []pcap.BPFInstruction) ([]bpf.Instruction, bool) {
 func ToBpfInstruction(in pcap.BPFInstruction) bpf.Instruction {
 	return ToBpfRawInstruction(in).Disassemble()
 }
+
+// MarshalBytecode returns the BPF filter in the bytecode format of iptables (`-m bpf --bytecode`)
+// and tc (`bpf bytecode`), e.g. `4,40 0 0 12,21 0 1 2048,6 0 0 65535,6 0 0 0`.
+// The first field is the number of instructions, followed by one field per instruction with
+// code, jt, jf and k in decimal.
+func MarshalBytecode(in []bpf.RawInstruction) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(strconv.Itoa(len(in)))
+	for _, inst := range in {
+		buffer.WriteString(fmt.Sprintf(",%d %d %d %d", inst.Op, inst.Jt, inst.Jf, inst.K))
+	}
+	return buffer.String()
+}
+
+// UnmarshalBytecode reads a BPF filter in the bytecode format of iptables and tc, see MarshalBytecode.
+// Leading and trailing whitespace as well as a trailing comma are ignored.
+func UnmarshalBytecode(in string) ([]bpf.RawInstruction, error) {
+	column := 1 + len(in) - len(strings.TrimLeft(in, " \t\r\n"))
+	fields := strings.Split(strings.TrimSuffix(strings.TrimSpace(in), ","), ",")
+
+	errorf := func(format string, args ...interface{}) error {
+		return &ParseError{Line: 1, Column: column, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || count < 1 || count > MaxInstructions {
+		return nil, errorf("invalid instruction count %q", strings.TrimSpace(fields[0]))
+	}
+	if count != len(fields)-1 {
+		return nil, errorf("expected %d instructions, got %d", count, len(fields)-1)
+	}
+	column += len(fields[0]) + 1
+
+	instructions := make([]bpf.RawInstruction, 0, count)
+	for _, field := range fields[1:] {
+		vals := strings.Fields(field)
+		if len(vals) != 4 {
+			return nil, errorf("expected 4 values for instruction %d, got %d", len(instructions), len(vals))
+		}
+
+		var parsed [4]uint64
+		bits := [4]int{16, 8, 8, 32}
+		for i, val := range vals {
+			if parsed[i], err = strconv.ParseUint(val, 10, bits[i]); err != nil {
+				return nil, errorf("invalid value %q for instruction %d", val, len(instructions))
+			}
+		}
+
+		instructions = append(instructions, bpf.RawInstruction{Op: uint16(parsed[0]), Jt: uint8(parsed[1]), Jf: uint8(parsed[2]), K: uint32(parsed[3])})
+		column += len(field) + 1
+	}
+
+	return instructions, nil
+}
+
+// MarshalBinary returns the BPF filter as array of `struct sock_filter` as used by the Linux
+// kernel and libpcap, with 8 bytes per instruction: code (u16), jt (u8), jf (u8) and k (u32).
+// The fields code and k are encoded with order, which is binary.LittleEndian or
+// binary.BigEndian for the native byte order of the target system.
+func MarshalBinary(in []bpf.RawInstruction, order binary.ByteOrder) []byte {
+	out := make([]byte, len(in)*sockFilterSize)
+	for i, inst := range in {
+		b := out[i*sockFilterSize:]
+		order.PutUint16(b[0:], inst.Op)
+		b[2] = inst.Jt
+		b[3] = inst.Jf
+		order.PutUint32(b[4:], inst.K)
+	}
+	return out
+}
+
+// UnmarshalBinary reads a BPF filter encoded with order in the format of MarshalBinary.
+func UnmarshalBinary(in []byte, order binary.ByteOrder) ([]bpf.RawInstruction, error) {
+	if len(in)%sockFilterSize != 0 {
+		return nil, fmt.Errorf("invalid length %d, expected a multiple of %d", len(in), sockFilterSize)
+	}
+	count := len(in) / sockFilterSize
+	if count < 1 || count > MaxInstructions {
+		return nil, fmt.Errorf("invalid instruction count %d", count)
+	}
+
+	instructions := make([]bpf.RawInstruction, count)
+	for i := range instructions {
+		b := in[i*sockFilterSize:]
+		instructions[i] = bpf.RawInstruction{
+			Op: order.Uint16(b[0:]),
+			Jt: b[2],
+			Jf: b[3],
+			K:  order.Uint32(b[4:]),
+		}
+	}
+	return instructions, nil
+}
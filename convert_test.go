@@ -1,7 +1,11 @@
 package bpfutils
 
 import (
+	"bytes"
+	"encoding/binary"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/google/gopacket/pcap"
@@ -67,6 +71,16 @@ func TestToPcapBPFInstruction(t *testing.T) {
 			t.Errorf("ToBpfRawInstruction failed, got: %#v, expected: %#v", gotRaw, test.raw)
 		}
 
+		gotPcap = CopyToPcapBPFInstructions(test.raw)
+		if !reflect.DeepEqual(test.pcap, gotPcap) {
+			t.Errorf("CopyToPcapBPFInstructions failed, got: %#v, expected: %#v", gotPcap, test.pcap)
+		}
+
+		gotRaw = CopyToBpfRawInstructions(test.pcap)
+		if !reflect.DeepEqual(test.raw, gotRaw) {
+			t.Errorf("CopyToBpfRawInstructions failed, got: %#v, expected: %#v", gotRaw, test.raw)
+		}
+
 		for i, inst := range test.pcap {
 			got := ToBpfRawInstruction(inst)
 			if !reflect.DeepEqual(test.raw[i], got) {
@@ -88,3 +102,185 @@ func TestToPcapBPFInstruction(t *testing.T) {
 
 	}
 }
+
+func TestPcapLayout(t *testing.T) {
+	if !pcapLayoutMatches {
+		t.Fatalf("layout of pcap.BPFInstruction differs from bpf.RawInstruction")
+	}
+
+	raw := []bpf.RawInstruction{{Op: 0x06, K: 1}}
+	if ToPcapBPFInstructions(raw)[0].K = 2; raw[0].K != 2 {
+		t.Errorf("expected ToPcapBPFInstructions to share the memory of its input")
+	}
+	if CopyToPcapBPFInstructions(raw)[0].K = 3; raw[0].K != 2 {
+		t.Errorf("expected CopyToPcapBPFInstructions to copy its input")
+	}
+
+	// the zero-copy conversions copy, if the layout differs
+	pcapLayoutMatches = false
+	defer func() { pcapLayoutMatches = true }()
+	if ToPcapBPFInstructions(raw)[0].K = 4; raw[0].K != 2 {
+		t.Errorf("expected ToPcapBPFInstructions to copy its input, if the layout differs")
+	}
+	if got := ToBpfRawInstructions([]pcap.BPFInstruction{{Code: 0x06, K: 5}}); !reflect.DeepEqual(got, []bpf.RawInstruction{{Op: 0x06, K: 5}}) {
+		t.Errorf("ToBpfRawInstructions failed, got: %#v", got)
+	}
+	if ToPcapBPFInstructions(nil) != nil || ToBpfRawInstructions(nil) != nil {
+		t.Errorf("expected nil for nil input")
+	}
+}
+
+func TestMarshalBytecode(t *testing.T) {
+	cases := []struct {
+		raw      []bpf.RawInstruction
+		bytecode string
+	}{
+		{
+			raw: []bpf.RawInstruction{
+				{Op: 0x28, Jt: 0, Jf: 0, K: 12},
+				{Op: 0x15, Jt: 0, Jf: 1, K: 0x800},
+				{Op: 0x06, Jt: 0, Jf: 0, K: 0xffff},
+				{Op: 0x06, Jt: 0, Jf: 0, K: 0},
+			},
+			bytecode: "4,40 0 0 12,21 0 1 2048,6 0 0 65535,6 0 0 0",
+		},
+		{
+			raw: []bpf.RawInstruction{
+				{Op: 0x20, Jt: 0, Jf: 0, K: 0xfffff038},
+				{Op: 0x25, Jt: 255, Jf: 0, K: 4294967},
+			},
+			bytecode: "2,32 0 0 4294963256,37 255 0 4294967",
+		},
+	}
+
+	for _, test := range cases {
+		if got := MarshalBytecode(test.raw); got != test.bytecode {
+			t.Errorf("MarshalBytecode failed, got: %s, expected: %s", got, test.bytecode)
+		}
+
+		got, err := UnmarshalBytecode(test.bytecode)
+		if err != nil || !reflect.DeepEqual(test.raw, got) {
+			t.Errorf("UnmarshalBytecode failed with error %v, got: %#v, expected: %#v", err, got, test.raw)
+		}
+	}
+}
+
+func TestUnmarshalBytecode(t *testing.T) {
+	expected := []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 12},
+		{Op: 0x06, Jt: 0, Jf: 0, K: 0},
+	}
+
+	for _, bytecode := range []string{
+		"2,40 0 0 12,6 0 0 0",
+		"  2, 40 0 0 12 , 6 0 0 0,\n",
+	} {
+		got, err := UnmarshalBytecode(bytecode)
+		if err != nil || !reflect.DeepEqual(expected, got) {
+			t.Errorf("UnmarshalBytecode(%q) failed with error %v, got: %#v, expected: %#v", bytecode, err, got, expected)
+		}
+	}
+
+	// Bytecode of a chained filter, as used with iptables
+	chained, err := bpf.Assemble(ChainFilter(loopbackFilters["len > 500"], loopbackFilters["ip6 and tcp"], AND))
+	if err != nil {
+		t.Fatalf("failed to assemble with error: %s", err.Error())
+	}
+	got, err := UnmarshalBytecode(MarshalBytecode(chained))
+	if err != nil || !reflect.DeepEqual(chained, got) {
+		t.Errorf("round trip of chained filter failed with error %v, got: %#v, expected: %#v", err, got, chained)
+	}
+	if pcapFilter := ToPcapBPFInstructions(got); len(pcapFilter) != len(chained) {
+		t.Errorf("got %d pcap instructions, expected %d", len(pcapFilter), len(chained))
+	}
+}
+
+func TestUnmarshalBytecodeError(t *testing.T) {
+	cases := []struct {
+		bytecode string
+		err      string
+	}{
+		{bytecode: "", err: `line 1, column 1: invalid instruction count ""`},
+		{bytecode: "0", err: `line 1, column 1: invalid instruction count "0"`},
+		{bytecode: "x,6 0 0 0", err: `line 1, column 1: invalid instruction count "x"`},
+		{bytecode: "2,6 0 0 0", err: "line 1, column 1: expected 2 instructions, got 1"},
+		{bytecode: "1,6 0 0 0,6 0 0 0", err: "line 1, column 1: expected 1 instructions, got 2"},
+		{bytecode: "2,40 0 0 12,6 0 0", err: "line 1, column 13: expected 4 values for instruction 1, got 3"},
+		{bytecode: " 1,6 0 256 0", err: `line 1, column 4: invalid value "256" for instruction 0`},
+		{bytecode: "1,6 0 0 0x10", err: `line 1, column 3: invalid value "0x10" for instruction 0`},
+		{bytecode: "1,6 0 0 -1", err: `line 1, column 3: invalid value "-1" for instruction 0`},
+	}
+
+	for _, test := range cases {
+		_, err := UnmarshalBytecode(test.bytecode)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("UnmarshalBytecode(%q) got error: %v, expected: %s", test.bytecode, err, test.err)
+		}
+	}
+
+	tooLong := strconv.Itoa(MaxInstructions+1) + strings.Repeat(",6 0 0 0", MaxInstructions+1)
+	if _, err := UnmarshalBytecode(tooLong); err == nil {
+		t.Errorf("expected error for too many instructions")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	raw := []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x00000800},
+		{Op: 0x06, Jt: 0, Jf: 0, K: 0x0000ffff},
+	}
+	cases := []struct {
+		order  binary.ByteOrder
+		expect []byte
+	}{
+		{
+			order: binary.LittleEndian,
+			expect: []byte{
+				0x28, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00,
+				0x15, 0x00, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00,
+				0x06, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00,
+			},
+		},
+		{
+			order: binary.BigEndian,
+			expect: []byte{
+				0x00, 0x28, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+				0x00, 0x15, 0x00, 0x01, 0x00, 0x00, 0x08, 0x00,
+				0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff,
+			},
+		},
+	}
+
+	for _, test := range cases {
+		got := MarshalBinary(raw, test.order)
+		if !bytes.Equal(got, test.expect) {
+			t.Errorf("%s: MarshalBinary got % x, expected % x", test.order, got, test.expect)
+		}
+		gotRaw, err := UnmarshalBinary(got, test.order)
+		if err != nil {
+			t.Errorf("%s: UnmarshalBinary failed with error: %s", test.order, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(gotRaw, raw) {
+			t.Errorf("%s: UnmarshalBinary got %#v, expected %#v", test.order, gotRaw, raw)
+		}
+	}
+}
+
+func TestUnmarshalBinaryError(t *testing.T) {
+	cases := []struct {
+		description string
+		in          []byte
+	}{
+		{description: "empty"},
+		{description: "truncated instruction", in: make([]byte, 12)},
+		{description: "too many instructions", in: make([]byte, (MaxInstructions+1)*8)},
+	}
+
+	for _, test := range cases {
+		if _, err := UnmarshalBinary(test.in, binary.LittleEndian); err == nil {
+			t.Errorf("case '%s': expected error", test.description)
+		}
+	}
+}
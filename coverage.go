@@ -0,0 +1,107 @@
+package bpfutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/gopacket"
+
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils/internal/reloc"
+)
+
+// CoverageReport is the result of Coverage.
+type CoverageReport struct {
+	Program []bpf.Instruction
+	// Hits contains for every instruction the number of packets, for which it was executed.
+	Hits []int
+	// Taken and NotTaken contain for every conditional jump the number of packets, for which
+	// the condition was true respectively false. They are 0 for all other instructions.
+	Taken, NotTaken []int
+	// Packets is the number of packets read from the source, Accepted is the number of
+	// packets with a return value > 0.
+	Packets, Accepted int
+}
+
+// AcceptRatio returns the fraction of the packets, which were accepted, 0 if there were
+// no packets.
+func (r *CoverageReport) AcceptRatio() float64 {
+	if r.Packets == 0 {
+		return 0
+	}
+	return float64(r.Accepted) / float64(r.Packets)
+}
+
+// String returns a short summary of the coverage.
+func (r *CoverageReport) String() string {
+	return fmt.Sprintf("%d packets, %d accepted (%.1f%%)", r.Packets, r.Accepted, 100*r.AcceptRatio())
+}
+
+// AsmString returns the program in bpf_asm syntax like AsmString. Every instruction is
+// prefixed with its hit count and, for conditional jumps, the number of packets, for which
+// the condition was true and false. Instructions, which were never executed, are marked
+// with `-` instead of a hit count.
+func (r *CoverageReport) AsmString() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("; %s\n", r))
+	for i, instr := range r.Program {
+		hits := "-"
+		if r.Hits[i] > 0 {
+			hits = fmt.Sprint(r.Hits[i])
+		}
+		branches := ""
+		if reloc.IsConditionalJump(instr) {
+			branches = fmt.Sprintf("T:%d F:%d", r.Taken[i], r.NotTaken[i])
+		}
+		buffer.WriteString(fmt.Sprintf("%8s %-19s %s", hits, branches, asmString(instr, skipCount)))
+	}
+	return buffer.String()
+}
+
+// Coverage runs prog with Run for every packet read from source until io.EOF and records,
+// which instructions and which branches of the conditional jumps were executed. opts are
+// passed to Run, e.g. WithMetadata for programs with ancillary data loads.
+//
+// An error is returned, if a packet can not be read or if Run fails for a packet.
+func Coverage(prog []bpf.Instruction, source gopacket.PacketDataSource, opts ...RunOption) (*CoverageReport, error) {
+	r := &CoverageReport{
+		Program:  prog,
+		Hits:     make([]int, len(prog)),
+		Taken:    make([]int, len(prog)),
+		NotTaken: make([]int, len(prog)),
+	}
+	opts = append(opts[:len(opts):len(opts)], WithTrace())
+
+	for {
+		data, _, err := source.ReadPacketData()
+		if err == io.EOF {
+			return r, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %s", r.Packets, err.Error())
+		}
+
+		ret, trace, err := Run(prog, data, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %s", r.Packets, strings.TrimSpace(err.Error()))
+		}
+		r.Packets++
+		if ret > 0 {
+			r.Accepted++
+		}
+		for _, step := range trace {
+			r.Hits[step.PC]++
+			if !reloc.IsConditionalJump(step.Instruction) {
+				continue
+			}
+			if step.Taken {
+				r.Taken[step.PC]++
+			} else {
+				r.NotTaken[step.PC]++
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package bpfutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestCoverage(t *testing.T) {
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+		hits        []int
+		taken       []int
+		notTaken    []int
+		accepted    int
+	}{
+		{
+			description: "len > 500",
+			prog:        loopbackFilters["len > 500"],
+			hits:        []int{24, 24, 9, 15},
+			taken:       []int{0, 9, 0, 0},
+			notTaken:    []int{0, 15, 0, 0},
+			accepted:    9,
+		},
+		{
+			description: "ip6 and tcp",
+			prog:        loopbackFilters["ip6 and tcp"],
+			hits:        []int{24, 24, 24, 24, 24, 0},
+			taken:       []int{0, 0, 0, 24, 0, 0},
+			notTaken:    []int{0, 24, 0, 0, 0, 0},
+			accepted:    24,
+		},
+	}
+
+	for _, test := range cases {
+		handle, err := pcap.OpenOffline("pcap/test_loopback.pcap")
+		if err != nil {
+			t.Fatalf("failed to open pcap handle: %s", err.Error())
+		}
+		report, err := Coverage(test.prog, handle)
+		handle.Close()
+		if err != nil {
+			t.Errorf("case '%s': failed with error: %s", test.description, err.Error())
+			continue
+		}
+
+		if report.Packets != 24 || report.Accepted != test.accepted {
+			t.Errorf("case '%s': got %d of %d packets accepted, expected %d of 24", test.description, report.Accepted, report.Packets, test.accepted)
+		}
+		if !reflect.DeepEqual(report.Hits, test.hits) {
+			t.Errorf("case '%s': got hits %v, expected %v", test.description, report.Hits, test.hits)
+		}
+		if !reflect.DeepEqual(report.Taken, test.taken) || !reflect.DeepEqual(report.NotTaken, test.notTaken) {
+			t.Errorf("case '%s': got taken %v and not taken %v, expected %v and %v", test.description, report.Taken, report.NotTaken, test.taken, test.notTaken)
+		}
+		if lines := strings.Split(strings.TrimSpace(report.AsmString()), "\n"); len(lines) != len(test.prog)+1 {
+			t.Errorf("case '%s': got %d lines in the listing, expected %d:\n%s", test.description, len(lines), len(test.prog)+1, report.AsmString())
+		}
+	}
+}
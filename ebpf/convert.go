@@ -0,0 +1,381 @@
+package ebpf
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/net/bpf"
+)
+
+// Registers used for the state of the classic BPF machine, the same as in the kernel.
+const (
+	regA   = R0
+	regX   = R7
+	regTmp = R8
+	regCtx = R6
+	regFP  = R10
+)
+
+// Helper functions called for ancillary data loads, see enum bpf_func_id in linux/bpf.h.
+const (
+	funcGetPrandomU32     = 7
+	funcGetSMPProcessorID = 8
+)
+
+// M[] consists of 16 slots of 4 bytes.
+const (
+	scratchSlots       = 16
+	scratchSize  int16 = 4
+)
+
+// skBuffField is a field of struct __sk_buff, the context of an eBPF socket filter.
+type skBuffField struct {
+	off int16
+	// be16 is true, if the field contains a 16 bit value in network byte order.
+	be16 bool
+}
+
+// skBuffFields contains the fields of struct __sk_buff, which provide the values of the
+// classic BPF ancillary data loads.
+var skBuffFields = map[bpf.Extension]skBuffField{
+	bpf.ExtLen:            {off: 0},
+	bpf.ExtType:           {off: 4},
+	bpf.ExtMark:           {off: 8},
+	bpf.ExtQueue:          {off: 12},
+	bpf.ExtProto:          {off: 16, be16: true},
+	bpf.ExtVLANTagPresent: {off: 20},
+	bpf.ExtVLANTag:        {off: 24},
+	bpf.ExtVLANProto:      {off: 28, be16: true},
+	bpf.ExtInterfaceIndex: {off: 40},
+	bpf.ExtRXHash:         {off: 68},
+}
+
+var jumpConds = map[bpf.JumpTest]uint8{
+	bpf.JumpEqual:          jmpJEQ,
+	bpf.JumpNotEqual:       jmpJNE,
+	bpf.JumpGreaterThan:    jmpJGT,
+	bpf.JumpLessThan:       jmpJLT,
+	bpf.JumpGreaterOrEqual: jmpJGE,
+	bpf.JumpLessOrEqual:    jmpJLE,
+	bpf.JumpBitsSet:        jmpJSET,
+}
+
+var inverseJumps = map[uint8]uint8{
+	jmpJEQ: jmpJNE,
+	jmpJNE: jmpJEQ,
+	jmpJGT: jmpJLE,
+	jmpJLE: jmpJGT,
+	jmpJGE: jmpJLT,
+	jmpJLT: jmpJGE,
+}
+
+var aluOpCodes = map[bpf.ALUOp]uint8{
+	bpf.ALUOpAdd:        aluAdd,
+	bpf.ALUOpSub:        aluSub,
+	bpf.ALUOpMul:        aluMul,
+	bpf.ALUOpDiv:        aluDiv,
+	bpf.ALUOpOr:         aluOr,
+	bpf.ALUOpAnd:        aluAnd,
+	bpf.ALUOpShiftLeft:  aluLsh,
+	bpf.ALUOpShiftRight: aluRsh,
+	bpf.ALUOpMod:        aluMod,
+	bpf.ALUOpXor:        aluXor,
+}
+
+var loadSizes = map[int]uint8{
+	1: sizeB,
+	2: sizeH,
+	4: sizeW,
+}
+
+// Convert translates the classic BPF program prog to an eBPF socket filter in the same way
+// as bpf_convert_filter in the Linux kernel:
+//
+// * A is kept in R0, X in R7 and the context (struct __sk_buff) in R6, R8 is used as
+// temporary register.
+// * M[] is stored on the stack, the slots read by the program are initialized with 0.
+// * Packet loads use the legacy BPF_ABS and BPF_IND instructions, which return from the
+// program with 0, if the load is out of bounds.
+// * Ancillary data loads read the corresponding field of struct __sk_buff or call the
+// helper functions bpf_get_prandom_u32 and bpf_get_smp_processor_id.
+// * A division or modulo by X returns 0 from the program, if X is 0.
+//
+// An error is returned for instructions without an eBPF equivalent for socket filters, e.g.
+// the ancillary data loads #nla or #hatype, and for invalid programs.
+func Convert(prog []bpf.Instruction) ([]Instruction, error) {
+	c := converter{addrs: make([]int, len(prog)+1)}
+
+	// A and X are 0 at the beginning of a classic BPF program, the context is passed in R1
+	c.emit(Instruction{OpCode: classALU | aluXor | srcX, Dst: regA, Src: regA})
+	c.emit(Instruction{OpCode: classALU | aluXor | srcX, Dst: regX, Src: regX})
+	c.emit(Instruction{OpCode: classALU64 | aluMov | srcX, Dst: regCtx, Src: R1})
+
+	var read [scratchSlots]bool
+	for _, inst := range prog {
+		if load, ok := inst.(bpf.LoadScratch); ok && load.N >= 0 && load.N < scratchSlots {
+			read[load.N] = true
+		}
+	}
+	for n, ok := range read {
+		if ok {
+			c.emit(Instruction{OpCode: classST | modeMEM | sizeW, Dst: regFP, Off: scratchOffset(n)})
+		}
+	}
+
+	for i, inst := range prog {
+		c.addrs[i] = len(c.out)
+		if err := c.convert(i, inst); err != nil {
+			return nil, fmt.Errorf("instruction %d: %s", i, err.Error())
+		}
+	}
+	c.addrs[len(prog)] = len(c.out)
+
+	for _, f := range c.fixups {
+		if f.target >= len(prog) {
+			return nil, fmt.Errorf("instruction %d: jump beyond end of program", f.from)
+		}
+		off := c.addrs[f.target] - (f.pc + 1)
+		if off > math.MaxInt16 {
+			return nil, fmt.Errorf("instruction %d: jump offset %d is too large for eBPF", f.from, off)
+		}
+		c.out[f.pc].Off = int16(off)
+	}
+	if !c.ret {
+		return nil, fmt.Errorf("program does not end with a return")
+	}
+
+	return c.out, nil
+}
+
+// scratchOffset returns the offset of M[n] relative to the frame pointer.
+func scratchOffset(n int) int16 {
+	return -int16(scratchSlots-n) * scratchSize
+}
+
+type fixup struct {
+	// pc is the index of the eBPF jump instruction, from the index of the classic BPF
+	// instruction and target the index of the classic BPF jump target.
+	pc, from, target int
+}
+
+type converter struct {
+	out []Instruction
+	// addrs contains the index of the first eBPF instruction for every classic BPF instruction.
+	addrs  []int
+	fixups []fixup
+	// ret is true, if the last converted instruction is a return.
+	ret bool
+}
+
+func (c *converter) emit(inst ...Instruction) {
+	c.out = append(c.out, inst...)
+}
+
+// jump emits the jump instruction inst of the classic BPF instruction from, whose offset is
+// set to the classic BPF instruction target by Convert.
+func (c *converter) jump(inst Instruction, from, target int) {
+	c.fixups = append(c.fixups, fixup{pc: len(c.out), from: from, target: target})
+	c.emit(inst)
+}
+
+// retZero emits instructions, which return 0 from the program.
+func (c *converter) retZero() {
+	c.emit(
+		Instruction{OpCode: classALU | aluMov | srcK, Dst: R0},
+		Instruction{OpCode: classJMP | jmpExit},
+	)
+}
+
+func (c *converter) convert(i int, instr bpf.Instruction) error {
+	if raw, ok := instr.(bpf.RawInstruction); ok {
+		instr = raw.Disassemble()
+	}
+	c.ret = false
+
+	switch inst := instr.(type) {
+	case bpf.ALUOpConstant:
+		op, ok := aluOpCodes[inst.Op]
+		if !ok {
+			return fmt.Errorf("invalid ALU operation %d", inst.Op)
+		}
+		if (op == aluDiv || op == aluMod) && inst.Val == 0 {
+			return fmt.Errorf("division by constant zero")
+		}
+		if (op == aluLsh || op == aluRsh) && inst.Val >= 32 {
+			return fmt.Errorf("shift by %d bits, which is not less than 32", inst.Val)
+		}
+		c.emit(Instruction{OpCode: classALU | op | srcK, Dst: regA, Imm: int32(inst.Val)})
+
+	case bpf.ALUOpX:
+		op, ok := aluOpCodes[inst.Op]
+		if !ok {
+			return fmt.Errorf("invalid ALU operation %d", inst.Op)
+		}
+		if op == aluDiv || op == aluMod {
+			// if X == 0 return 0
+			c.emit(Instruction{OpCode: classJMP | jmpJNE | srcK, Dst: regX, Off: 2})
+			c.retZero()
+		}
+		c.emit(Instruction{OpCode: classALU | op | srcX, Dst: regA, Src: regX})
+
+	case bpf.NegateA:
+		c.emit(Instruction{OpCode: classALU | aluNeg, Dst: regA})
+
+	case bpf.Jump:
+		c.jump(Instruction{OpCode: classJMP | jmpJA}, i, i+1+int(inst.Skip))
+
+	case bpf.JumpIf:
+		return c.conditionalJump(i, inst.Cond, inst.SkipTrue, inst.SkipFalse, false, inst.Val)
+
+	case bpf.JumpIfX:
+		return c.conditionalJump(i, inst.Cond, inst.SkipTrue, inst.SkipFalse, true, 0)
+
+	case bpf.LoadAbsolute:
+		if inst.Size == 4 && inst.Off > 0xFFFFFFFF-0x1000 {
+			return c.loadExtension(bpf.Extension(inst.Off + 0x1000))
+		}
+		size, ok := loadSizes[inst.Size]
+		if !ok {
+			return fmt.Errorf("invalid load size %d", inst.Size)
+		}
+		c.emit(Instruction{OpCode: classLD | modeABS | size, Imm: int32(inst.Off)})
+
+	case bpf.LoadIndirect:
+		size, ok := loadSizes[inst.Size]
+		if !ok {
+			return fmt.Errorf("invalid load size %d", inst.Size)
+		}
+		c.emit(Instruction{OpCode: classLD | modeIND | size, Src: regX, Imm: int32(inst.Off)})
+
+	case bpf.LoadMemShift:
+		// tmp = A; A = P[k:1]; A &= 0xf; A <<= 2; X = A; A = tmp
+		c.emit(
+			Instruction{OpCode: classALU64 | aluMov | srcX, Dst: regTmp, Src: regA},
+			Instruction{OpCode: classLD | modeABS | sizeB, Imm: int32(inst.Off)},
+			Instruction{OpCode: classALU | aluAnd | srcK, Dst: regA, Imm: 0xf},
+			Instruction{OpCode: classALU | aluLsh | srcK, Dst: regA, Imm: 2},
+			Instruction{OpCode: classALU64 | aluMov | srcX, Dst: regX, Src: regA},
+			Instruction{OpCode: classALU64 | aluMov | srcX, Dst: regA, Src: regTmp},
+		)
+
+	case bpf.LoadConstant:
+		dst, err := register(inst.Dst)
+		if err != nil {
+			return err
+		}
+		c.emit(Instruction{OpCode: classALU | aluMov | srcK, Dst: dst, Imm: int32(inst.Val)})
+
+	case bpf.LoadExtension:
+		return c.loadExtension(inst.Num)
+
+	case bpf.LoadScratch:
+		if inst.N < 0 || inst.N >= scratchSlots {
+			return fmt.Errorf("invalid scratch slot %d", inst.N)
+		}
+		dst, err := register(inst.Dst)
+		if err != nil {
+			return err
+		}
+		c.emit(Instruction{OpCode: classLDX | modeMEM | sizeW, Dst: dst, Src: regFP, Off: scratchOffset(inst.N)})
+
+	case bpf.StoreScratch:
+		if inst.N < 0 || inst.N >= scratchSlots {
+			return fmt.Errorf("invalid scratch slot %d", inst.N)
+		}
+		src, err := register(inst.Src)
+		if err != nil {
+			return err
+		}
+		c.emit(Instruction{OpCode: classSTX | modeMEM | sizeW, Dst: regFP, Src: src, Off: scratchOffset(inst.N)})
+
+	case bpf.TAX:
+		c.emit(Instruction{OpCode: classALU64 | aluMov | srcX, Dst: regX, Src: regA})
+
+	case bpf.TXA:
+		c.emit(Instruction{OpCode: classALU64 | aluMov | srcX, Dst: regA, Src: regX})
+
+	case bpf.RetA:
+		c.emit(Instruction{OpCode: classJMP | jmpExit})
+		c.ret = true
+
+	case bpf.RetConstant:
+		c.emit(
+			Instruction{OpCode: classALU | aluMov | srcK, Dst: R0, Imm: int32(inst.Val)},
+			Instruction{OpCode: classJMP | jmpExit},
+		)
+		c.ret = true
+
+	default:
+		return fmt.Errorf("unsupported instruction: %#v", inst)
+	}
+
+	return nil
+}
+
+func register(reg bpf.Register) (Register, error) {
+	switch reg {
+	case bpf.RegA:
+		return regA, nil
+	case bpf.RegX:
+		return regX, nil
+	}
+	return 0, fmt.Errorf("invalid register %d", reg)
+}
+
+// conditionalJump emits a jump compared with X, if useX is true, and with val otherwise.
+// As in the kernel, a conditional jump, whose both targets are not the next instruction, is
+// split into a conditional jump and an unconditional jump.
+func (c *converter) conditionalJump(i int, cond bpf.JumpTest, skipTrue, skipFalse uint8, useX bool, val uint32) error {
+	if cond == bpf.JumpBitsNotSet {
+		cond = bpf.JumpBitsSet
+		skipTrue, skipFalse = skipFalse, skipTrue
+	}
+	op, ok := jumpConds[cond]
+	if !ok {
+		return fmt.Errorf("invalid jump condition %d", cond)
+	}
+
+	inst := Instruction{OpCode: classJMP | op | srcK, Dst: regA, Imm: int32(val)}
+	if useX {
+		inst.OpCode, inst.Src = classJMP|op|srcX, regX
+	} else if int32(val) < 0 {
+		// immediates are sign extended to 64 bit, the zero extended value is compared in tmp
+		c.emit(Instruction{OpCode: classALU | aluMov | srcK, Dst: regTmp, Imm: int32(val)})
+		inst.OpCode, inst.Src = classJMP|op|srcX, regTmp
+	}
+
+	jt, jf := i+1+int(skipTrue), i+1+int(skipFalse)
+	switch {
+	case jt == jf:
+		c.jump(Instruction{OpCode: classJMP | jmpJA}, i, jt)
+	case skipTrue == 0 && inverseJumps[op] != 0:
+		inst.OpCode = inst.OpCode&^0xf0 | inverseJumps[op]
+		c.jump(inst, i, jf)
+	case skipFalse == 0:
+		c.jump(inst, i, jt)
+	default:
+		c.jump(inst, i, jt)
+		c.jump(Instruction{OpCode: classJMP | jmpJA}, i, jf)
+	}
+	return nil
+}
+
+func (c *converter) loadExtension(ext bpf.Extension) error {
+	if field, ok := skBuffFields[ext]; ok {
+		c.emit(Instruction{OpCode: classLDX | modeMEM | sizeW, Dst: regA, Src: regCtx, Off: field.off})
+		if field.be16 {
+			c.emit(Instruction{OpCode: classALU | aluEnd | srcX, Dst: regA, Imm: 16})
+		}
+		return nil
+	}
+
+	switch ext {
+	case bpf.ExtRand:
+		c.emit(Instruction{OpCode: classJMP | jmpCall, Imm: funcGetPrandomU32})
+	case bpf.ExtCPUID:
+		c.emit(Instruction{OpCode: classJMP | jmpCall, Imm: funcGetSMPProcessorID})
+	default:
+		return fmt.Errorf("extension %d is not available for eBPF socket filters", ext)
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils"
+	"github.com/breml/bpfutils/pcapfilter"
+)
+
+// Values returned by the helper functions in the test interpreter.
+const (
+	testPrandom = 0x12345678
+	testCPU     = 3
+)
+
+// Base addresses of the memory regions of the test interpreter.
+const (
+	ctxBase   uint64 = 1 << 32
+	stackBase uint64 = 2 << 32
+	stackSize        = 512
+)
+
+// vm is a minimal interpreter for the eBPF instructions emitted by Convert.
+type vm struct {
+	regs  [11]uint64
+	ctx   []byte
+	stack [stackSize]byte
+	pkt   []byte
+}
+
+func (m *vm) mem(addr uint64, size int) ([]byte, error) {
+	switch {
+	case addr >= ctxBase && addr+uint64(size) <= ctxBase+uint64(len(m.ctx)):
+		return m.ctx[addr-ctxBase : addr-ctxBase+uint64(size)], nil
+	case addr >= stackBase && addr+uint64(size) <= stackBase+stackSize:
+		return m.stack[addr-stackBase : addr-stackBase+uint64(size)], nil
+	}
+	return nil, fmt.Errorf("invalid memory access at %#x", addr)
+}
+
+// clobber overwrites the caller saved registers R1 to R5 like a helper function call.
+func (m *vm) clobber() {
+	for r := R1; r <= R5; r++ {
+		m.regs[r] = 0xdeadbeefdeadbeef
+	}
+}
+
+func run(prog []Instruction, pkt, ctx []byte) (uint32, error) {
+	m := vm{ctx: ctx, pkt: pkt}
+	m.regs[R1] = ctxBase
+	m.regs[R10] = stackBase + stackSize
+
+	sizes := map[uint8]int{sizeB: 1, sizeH: 2, sizeW: 4}
+	for pc := 0; pc < len(prog); pc++ {
+		inst := prog[pc]
+		class, op, size := inst.OpCode&0x07, inst.OpCode&0xf0, sizes[inst.OpCode&0x18]
+		src := uint64(int64(inst.Imm))
+		if inst.OpCode&srcX != 0 {
+			src = m.regs[inst.Src]
+		}
+		dst := &m.regs[inst.Dst]
+
+		switch class {
+		case classALU, classALU64:
+			a, b := *dst, src
+			if class == classALU {
+				a, b = uint64(uint32(a)), uint64(uint32(b))
+			}
+			switch op {
+			case aluAdd:
+				a += b
+			case aluSub:
+				a -= b
+			case aluMul:
+				a *= b
+			case aluDiv:
+				if b == 0 {
+					return 0, fmt.Errorf("pc %d: division by zero", pc)
+				}
+				a /= b
+			case aluMod:
+				if b == 0 {
+					return 0, fmt.Errorf("pc %d: division by zero", pc)
+				}
+				a %= b
+			case aluOr:
+				a |= b
+			case aluAnd:
+				a &= b
+			case aluXor:
+				a ^= b
+			case aluLsh:
+				a <<= b
+			case aluRsh:
+				a >>= b
+			case aluNeg:
+				a = -a
+			case aluMov:
+				a = b
+			case aluEnd:
+				if inst.OpCode&srcX == 0 || inst.Imm != 16 {
+					return 0, fmt.Errorf("pc %d: unsupported byte swap", pc)
+				}
+				a = uint64(bits.ReverseBytes16(uint16(a)))
+			default:
+				return 0, fmt.Errorf("pc %d: unsupported ALU operation %#x", pc, op)
+			}
+			if class == classALU {
+				a = uint64(uint32(a))
+			}
+			*dst = a
+
+		case classJMP:
+			var taken bool
+			switch op {
+			case jmpJA:
+				taken = true
+			case jmpJEQ:
+				taken = *dst == src
+			case jmpJNE:
+				taken = *dst != src
+			case jmpJGT:
+				taken = *dst > src
+			case jmpJGE:
+				taken = *dst >= src
+			case jmpJLT:
+				taken = *dst < src
+			case jmpJLE:
+				taken = *dst <= src
+			case jmpJSET:
+				taken = *dst&src != 0
+			case jmpCall:
+				switch inst.Imm {
+				case funcGetPrandomU32:
+					m.regs[R0] = testPrandom
+				case funcGetSMPProcessorID:
+					m.regs[R0] = testCPU
+				default:
+					return 0, fmt.Errorf("pc %d: unknown helper function %d", pc, inst.Imm)
+				}
+				m.clobber()
+			case jmpExit:
+				return uint32(m.regs[R0]), nil
+			default:
+				return 0, fmt.Errorf("pc %d: unsupported jump operation %#x", pc, op)
+			}
+			if taken {
+				pc += int(inst.Off)
+			}
+
+		case classLD:
+			off := uint64(uint32(inst.Imm))
+			if inst.OpCode&0xe0 == modeIND {
+				off = uint64(uint32(m.regs[inst.Src]) + uint32(inst.Imm))
+			}
+			if off+uint64(size) > uint64(len(pkt)) {
+				return 0, nil
+			}
+			val := uint64(0)
+			for _, b := range pkt[off : off+uint64(size)] {
+				val = val<<8 | uint64(b)
+			}
+			m.clobber()
+			m.regs[R0] = val
+
+		case classLDX:
+			b, err := m.mem(m.regs[inst.Src]+uint64(int64(inst.Off)), size)
+			if err != nil {
+				return 0, fmt.Errorf("pc %d: %s", pc, err.Error())
+			}
+			val := uint64(0)
+			for i := len(b) - 1; i >= 0; i-- {
+				val = val<<8 | uint64(b[i])
+			}
+			*dst = val
+
+		case classST, classSTX:
+			b, err := m.mem(*dst+uint64(int64(inst.Off)), size)
+			if err != nil {
+				return 0, fmt.Errorf("pc %d: %s", pc, err.Error())
+			}
+			for i := range b {
+				b[i] = byte(src >> uint(8*i))
+			}
+
+		default:
+			return 0, fmt.Errorf("pc %d: unsupported instruction class %#x", pc, class)
+		}
+	}
+	return 0, fmt.Errorf("end of program reached")
+}
+
+// skBuff returns a struct __sk_buff for pkt with the values of md.
+func skBuff(pkt []byte, md bpfutils.StaticMetadata) []byte {
+	ctx := make([]byte, 192)
+	binary.LittleEndian.PutUint32(ctx, uint32(len(pkt)))
+	for ext, val := range md {
+		field, ok := skBuffFields[ext]
+		if !ok {
+			continue
+		}
+		if field.be16 {
+			val = uint32(bits.ReverseBytes16(uint16(val)))
+		}
+		binary.LittleEndian.PutUint32(ctx[field.off:], val)
+	}
+	return ctx
+}
+
+func readLoopback(t *testing.T) [][]byte {
+	f, err := os.Open("../pcap/test_loopback.pcap")
+	if err != nil {
+		t.Fatalf("failed to open pcap file with error: %s", err.Error())
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read pcap file with error: %s", err.Error())
+	}
+
+	var packets [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("failed to read packet with error: %s", err.Error())
+		}
+		packets = append(packets, data)
+	}
+}
+
+func TestConvertLoopback(t *testing.T) {
+	packets := readLoopback(t)
+
+	programs := map[string][]bpf.Instruction{}
+	for _, expr := range []string{"ip6 and tcp port 8080", "tcp portrange 58800-58810", "ip6[53] & tcp-push != 0", "greater 1000", "less 100", "ip6[4:2] > 1000"} {
+		prog, err := pcapfilter.Compile(expr, layers.LinkTypeRaw, 65535)
+		if err != nil {
+			t.Fatalf("failed to compile '%s' with error: %s", expr, err.Error())
+		}
+		// the loopback packets start with a 4 byte DLT_NULL header
+		prog, err = bpfutils.Rebase(prog, layers.LinkTypeRaw, layers.LinkTypeNull)
+		if err != nil {
+			t.Fatalf("failed to rebase '%s' with error: %s", expr, err.Error())
+		}
+		programs[expr] = prog
+	}
+
+	asm := map[string]string{
+		"scratch and X":  "ld [0]\nst M[3]\nldxb 4*([4]&0xf)\nstx M[1]\nld #len\nldx M[3]\nsub x\nldx M[1]\nadd x\nld M[7]\nadd #1\nret a",
+		"division by X":  "ld #len\nand #7\ntax\nld #len\ndiv x\nmod #7\nret a",
+		"modulo by X":    "ld #len\nand #0x0f\ntax\nld [8]\nmod x\nneg\nret a",
+		"large constant": "ld [48]\nadd #0x80000000\njgt #0x8a000000,1,2\nret #1\nret #2\nret #3",
+		"jump targets":   "ldh [8]\njset #0x8000,2,3\nret #1\nja 1\nret #2\nret #3",
+		"bits not set":   "ldb [57]\njset #0x08,1\nret #0\nret #1",
+		"indirect":       "ldx #40\nldh [x+4]\njeq #8080,2\nldh [x+6]\njne #8080,1,2\nret #0\nret #0xffff\nret a",
+		"compare with X": "ldxb 4*([4]&0xf)\nld #len\njge x,1\nret #0\nlsh #2\nrsh #1\nor #0x1\nxor x\nmul #3\nret a",
+	}
+	for name, text := range asm {
+		prog, err := bpfutils.ParseAsm(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("failed to parse '%s' with error: %s", name, err.Error())
+		}
+		programs[name] = prog
+	}
+
+	for name, prog := range programs {
+		converted, err := Convert(prog)
+		if err != nil {
+			t.Errorf("program '%s': failed to convert with error: %s", name, err.Error())
+			continue
+		}
+
+		accepted := 0
+		for i, packet := range packets {
+			expect, _, err := bpfutils.Run(prog, packet)
+			if err != nil {
+				t.Fatalf("program '%s': failed to run with error: %s", name, err.Error())
+			}
+			got, err := run(converted, packet, skBuff(packet, nil))
+			if err != nil {
+				t.Errorf("program '%s', packet %d: failed to run with error: %s\n%s", name, i, err.Error(), Disassemble(converted))
+				break
+			}
+			if got != expect {
+				t.Errorf("program '%s', packet %d: got %d, expected %d\n%s", name, i, got, expect, Disassemble(converted))
+				break
+			}
+			if expect > 0 {
+				accepted++
+			}
+		}
+		if accepted == 0 {
+			t.Errorf("program '%s': no packet accepted", name)
+		}
+	}
+}
+
+func TestConvertExtensions(t *testing.T) {
+	md := bpfutils.StaticMetadata{
+		bpf.ExtProto:          0x86dd,
+		bpf.ExtType:           4,
+		bpf.ExtMark:           0xabcd,
+		bpf.ExtQueue:          2,
+		bpf.ExtVLANTagPresent: 1,
+		bpf.ExtVLANTag:        0x123,
+		bpf.ExtVLANProto:      0x8100,
+		bpf.ExtInterfaceIndex: 7,
+		bpf.ExtRXHash:         0xcafe,
+		bpf.ExtRand:           testPrandom,
+		bpf.ExtCPUID:          testCPU,
+	}
+	pkt := make([]byte, 60)
+
+	for ext := range md {
+		prog := []bpf.Instruction{bpf.LoadExtension{Num: ext}, bpf.RetA{}}
+		converted, err := Convert(prog)
+		if err != nil {
+			t.Errorf("extension %d: failed to convert with error: %s", ext, err.Error())
+			continue
+		}
+		expect, _, err := bpfutils.Run(prog, pkt, bpfutils.WithMetadata(md))
+		if err != nil {
+			t.Fatalf("extension %d: failed to run with error: %s", ext, err.Error())
+		}
+		got, err := run(converted, pkt, skBuff(pkt, md))
+		if err != nil {
+			t.Errorf("extension %d: failed to run with error: %s\n%s", ext, err.Error(), Disassemble(converted))
+			continue
+		}
+		if got != expect {
+			t.Errorf("extension %d: got %#x, expected %#x\n%s", ext, got, expect, Disassemble(converted))
+		}
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+		expect      string
+	}{
+		{
+			description: "netlink attribute",
+			prog: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtNetlinkAttr},
+				bpf.RetA{},
+			},
+			expect: "instruction 0: extension 12 is not available for eBPF socket filters",
+		},
+		{
+			description: "division by zero",
+			prog: []bpf.Instruction{
+				bpf.ALUOpConstant{Op: bpf.ALUOpDiv, Val: 0},
+				bpf.RetA{},
+			},
+			expect: "instruction 0: division by constant zero",
+		},
+		{
+			description: "jump beyond end",
+			prog: []bpf.Instruction{
+				bpf.JumpIf{Cond: bpf.JumpEqual, SkipTrue: 2},
+				bpf.RetA{},
+			},
+			expect: "instruction 0: jump beyond end of program",
+		},
+		{
+			description: "no return",
+			prog: []bpf.Instruction{
+				bpf.RetA{},
+				bpf.TAX{},
+			},
+			expect: "program does not end with a return",
+		},
+		{
+			description: "invalid scratch slot",
+			prog: []bpf.Instruction{
+				bpf.LoadScratch{Dst: bpf.RegA, N: 16},
+				bpf.RetA{},
+			},
+			expect: "instruction 0: invalid scratch slot 16",
+		},
+	}
+
+	for _, test := range cases {
+		_, err := Convert(test.prog)
+		if err == nil {
+			t.Errorf("case '%s': expected error", test.description)
+			continue
+		}
+		if err.Error() != test.expect {
+			t.Errorf("case '%s': got error '%s', expected '%s'", test.description, err.Error(), test.expect)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Package ebpf translates classic BPF programs from golang.org/x/net/bpf to extended BPF
+// (eBPF) socket filter programs, encodes them in the 8 byte wire format of struct bpf_insn
+// and disassembles them to text.
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Register is an eBPF register.
+type Register uint8
+
+// eBPF registers
+const (
+	R0 Register = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+)
+
+// Instruction classes
+const (
+	classLD    = 0x00
+	classLDX   = 0x01
+	classST    = 0x02
+	classSTX   = 0x03
+	classALU   = 0x04
+	classJMP   = 0x05
+	classALU64 = 0x07
+)
+
+// Sizes of load and store instructions
+const (
+	sizeW = 0x00
+	sizeH = 0x08
+	sizeB = 0x10
+)
+
+// Modes of load and store instructions
+const (
+	modeABS = 0x20
+	modeIND = 0x40
+	modeMEM = 0x60
+)
+
+// Sources of ALU and jump instructions
+const (
+	srcK = 0x00
+	srcX = 0x08
+)
+
+// ALU operations
+const (
+	aluAdd = 0x00
+	aluSub = 0x10
+	aluMul = 0x20
+	aluDiv = 0x30
+	aluOr  = 0x40
+	aluAnd = 0x50
+	aluLsh = 0x60
+	aluRsh = 0x70
+	aluNeg = 0x80
+	aluMod = 0x90
+	aluXor = 0xa0
+	aluMov = 0xb0
+	aluEnd = 0xd0
+)
+
+// Jump operations
+const (
+	jmpJA   = 0x00
+	jmpJEQ  = 0x10
+	jmpJGT  = 0x20
+	jmpJGE  = 0x30
+	jmpJSET = 0x40
+	jmpJNE  = 0x50
+	jmpCall = 0x80
+	jmpExit = 0x90
+	jmpJLT  = 0xa0
+	jmpJLE  = 0xb0
+)
+
+// Instruction is a single eBPF instruction with the fields of struct bpf_insn.
+type Instruction struct {
+	OpCode uint8
+	Dst    Register
+	Src    Register
+	Off    int16
+	Imm    int32
+}
+
+var aluOps = map[uint8]string{
+	aluAdd: "+",
+	aluSub: "-",
+	aluMul: "*",
+	aluDiv: "/",
+	aluOr:  "|",
+	aluAnd: "&",
+	aluLsh: "<<",
+	aluRsh: ">>",
+	aluMod: "%",
+	aluXor: "^",
+	aluMov: "",
+}
+
+var jumpOps = map[uint8]string{
+	jmpJEQ:  "==",
+	jmpJGT:  ">",
+	jmpJGE:  ">=",
+	jmpJSET: "&",
+	jmpJNE:  "!=",
+	jmpJLT:  "<",
+	jmpJLE:  "<=",
+}
+
+var sizeNames = map[uint8]string{
+	sizeW: "u32",
+	sizeH: "u16",
+	sizeB: "u8",
+}
+
+// String returns the instruction in the syntax of the kernel verifier log, e.g.
+// `if r0 != 0x800 goto pc+5`.
+func (i Instruction) String() string {
+	class := i.OpCode & 0x07
+	switch class {
+	case classALU, classALU64:
+		reg := "r"
+		if class == classALU {
+			reg = "w"
+		}
+		op := i.OpCode & 0xf0
+		switch op {
+		case aluNeg:
+			return fmt.Sprintf("%s%d = -%s%d", reg, i.Dst, reg, i.Dst)
+		case aluEnd:
+			order := "le"
+			if i.OpCode&srcX != 0 {
+				order = "be"
+			}
+			return fmt.Sprintf("r%d = %s%d r%d", i.Dst, order, i.Imm, i.Dst)
+		}
+		sym, ok := aluOps[op]
+		if !ok {
+			break
+		}
+		if i.OpCode&srcX != 0 {
+			return fmt.Sprintf("%s%d %s= %s%d", reg, i.Dst, sym, reg, i.Src)
+		}
+		return fmt.Sprintf("%s%d %s= %d", reg, i.Dst, sym, i.Imm)
+
+	case classJMP:
+		op := i.OpCode & 0xf0
+		switch op {
+		case jmpJA:
+			return fmt.Sprintf("goto pc%+d", i.Off)
+		case jmpCall:
+			return fmt.Sprintf("call %d", i.Imm)
+		case jmpExit:
+			return "exit"
+		}
+		sym, ok := jumpOps[op]
+		if !ok {
+			break
+		}
+		if i.OpCode&srcX != 0 {
+			return fmt.Sprintf("if r%d %s r%d goto pc%+d", i.Dst, sym, i.Src, i.Off)
+		}
+		return fmt.Sprintf("if r%d %s %#x goto pc%+d", i.Dst, sym, i.Imm, i.Off)
+
+	case classLD, classLDX, classST, classSTX:
+		size, ok := sizeNames[i.OpCode&0x18]
+		if !ok {
+			break
+		}
+		switch mode := i.OpCode & 0xe0; {
+		case class == classLD && mode == modeABS:
+			return fmt.Sprintf("r0 = *(%s *)skb[%d]", size, i.Imm)
+		case class == classLD && mode == modeIND:
+			return fmt.Sprintf("r0 = *(%s *)skb[r%d + %d]", size, i.Src, i.Imm)
+		case class == classLDX && mode == modeMEM:
+			return fmt.Sprintf("r%d = *(%s *)(r%d %+d)", i.Dst, size, i.Src, i.Off)
+		case class == classSTX && mode == modeMEM:
+			return fmt.Sprintf("*(%s *)(r%d %+d) = r%d", size, i.Dst, i.Off, i.Src)
+		case class == classST && mode == modeMEM:
+			return fmt.Sprintf("*(%s *)(r%d %+d) = %d", size, i.Dst, i.Off, i.Imm)
+		}
+	}
+	return fmt.Sprintf("unknown instruction %#02x", i.OpCode)
+}
+
+// Disassemble returns the program with one instruction per line, prefixed with its index.
+func Disassemble(prog []Instruction) string {
+	var buffer bytes.Buffer
+	for i, inst := range prog {
+		buffer.WriteString(fmt.Sprintf("%4d: %s\n", i, inst))
+	}
+	return buffer.String()
+}
+
+// Encode returns the program in the 8 byte per instruction wire format of struct bpf_insn.
+// The kernel expects the byte order of the host, which is binary.LittleEndian on most
+// platforms. The order also defines, in which nibble of the second byte the destination
+// register is stored.
+func Encode(prog []Instruction, order binary.ByteOrder) []byte {
+	b := make([]byte, 8*len(prog))
+	for i, inst := range prog {
+		raw := b[8*i : 8*i+8]
+		raw[0] = inst.OpCode
+		if order == binary.BigEndian {
+			raw[1] = uint8(inst.Dst)<<4 | uint8(inst.Src)&0x0f
+		} else {
+			raw[1] = uint8(inst.Src)<<4 | uint8(inst.Dst)&0x0f
+		}
+		order.PutUint16(raw[2:], uint16(inst.Off))
+		order.PutUint32(raw[4:], uint32(inst.Imm))
+	}
+	return b
+}
+
+// Decode is the inverse of Encode. It returns an error, if the length of b is not a
+// multiple of 8.
+func Decode(b []byte, order binary.ByteOrder) ([]Instruction, error) {
+	if len(b)%8 != 0 {
+		return nil, fmt.Errorf("length %d is not a multiple of the instruction size 8", len(b))
+	}
+	prog := make([]Instruction, len(b)/8)
+	for i := range prog {
+		raw := b[8*i : 8*i+8]
+		prog[i] = Instruction{
+			OpCode: raw[0],
+			Dst:    Register(raw[1] & 0x0f),
+			Src:    Register(raw[1] >> 4),
+			Off:    int16(order.Uint16(raw[2:])),
+			Imm:    int32(order.Uint32(raw[4:])),
+		}
+		if order == binary.BigEndian {
+			prog[i].Dst, prog[i].Src = prog[i].Src, prog[i].Dst
+		}
+	}
+	return prog, nil
+}
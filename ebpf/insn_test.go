@@ -0,0 +1,102 @@
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestEncode(t *testing.T) {
+	prog := []Instruction{
+		{OpCode: classALU64 | aluMov | srcX, Dst: R6, Src: R1},
+		{OpCode: classLD | modeIND | sizeH, Src: R7, Imm: 14},
+		{OpCode: classJMP | jmpJNE | srcK, Dst: R0, Off: -2, Imm: 0x800},
+	}
+	cases := []struct {
+		order  binary.ByteOrder
+		expect []byte
+	}{
+		{
+			order: binary.LittleEndian,
+			expect: []byte{
+				0xbf, 0x16, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x48, 0x70, 0x00, 0x00, 0x0e, 0x00, 0x00, 0x00,
+				0x55, 0x00, 0xfe, 0xff, 0x00, 0x08, 0x00, 0x00,
+			},
+		},
+		{
+			order: binary.BigEndian,
+			expect: []byte{
+				0xbf, 0x61, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x48, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0e,
+				0x55, 0x00, 0xff, 0xfe, 0x00, 0x00, 0x08, 0x00,
+			},
+		},
+	}
+
+	for _, test := range cases {
+		got := Encode(prog, test.order)
+		if !bytes.Equal(got, test.expect) {
+			t.Errorf("%s: got % x, expected % x", test.order, got, test.expect)
+		}
+		decoded, err := Decode(got, test.order)
+		if err != nil {
+			t.Errorf("%s: failed to decode with error: %s", test.order, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(decoded, prog) {
+			t.Errorf("%s: got %v after decoding, expected %v", test.order, decoded, prog)
+		}
+	}
+
+	if _, err := Decode(make([]byte, 12), binary.LittleEndian); err == nil {
+		t.Errorf("expected error for a length, which is not a multiple of 8")
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	prog, err := Convert([]bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 6},
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Off: 16, Size: 2},
+		bpf.StoreScratch{Src: bpf.RegA, N: 1},
+		bpf.LoadExtension{Num: bpf.ExtProto},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.RetA{},
+		bpf.RetConstant{Val: 0},
+	})
+	if err != nil {
+		t.Fatalf("failed to convert with error: %s", err.Error())
+	}
+
+	expect := `   0: w0 ^= w0
+   1: w7 ^= w7
+   2: r6 = r1
+   3: r0 = *(u16 *)skb[12]
+   4: if r0 != 0x800 goto pc+15
+   5: r8 = r0
+   6: r0 = *(u8 *)skb[14]
+   7: w0 &= 15
+   8: w0 <<= 2
+   9: r7 = r0
+  10: r0 = r8
+  11: r0 = *(u16 *)skb[r7 + 16]
+  12: *(u32 *)(r10 -60) = r0
+  13: r0 = *(u32 *)(r6 +16)
+  14: r0 = be16 r0
+  15: if r7 != 0x0 goto pc+2
+  16: w0 = 0
+  17: exit
+  18: w0 /= w7
+  19: exit
+  20: w0 = 0
+  21: exit
+`
+	if got := Disassemble(prog); got != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expect)
+	}
+}
@@ -0,0 +1,430 @@
+package bpfutils
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils/internal/sat"
+)
+
+const (
+	// maxPacketLen is the maximum length of the packets considered by Equivalent.
+	maxPacketLen = 0xffff
+	// maxEquivalenceConflicts limits the search of the SAT solver used by Equivalent.
+	maxEquivalenceConflicts = 1 << 20
+	// offsetWidth is the number of bits of packet offsets, large enough for X plus a 32 bit
+	// offset plus the load size without overflow.
+	offsetWidth = 34
+)
+
+// Equivalent checks, if the programs a and b return the same value for every packet with a
+// length of up to 65535 bytes. If they differ, a packet is returned as counterexample, for
+// which a and b return different values, if run with Run.
+//
+// Both programs are translated into a boolean circuit over the bits of the packet, the packet
+// length and the ancillary data. The circuit computes the return values of both programs,
+// including the return of 0 for loads out of the bounds of the packet and for a division by
+// X == 0. A SAT solver searches for an assignment, for which the return values differ. As all
+// jumps are forward jumps, the translation is exact and the result is a proof in both
+// directions.
+//
+// Ancillary data loads other than `ld #len` are treated as arbitrary values, which are the
+// same for both programs. A counterexample may depend on them, they are not returned.
+//
+// An error is returned, if one of the programs is not valid according to Verify, if one of them
+// loads relative to the link layer or network layer header (SKF_LL_OFF, SKF_NET_OFF), if the
+// search exceeds its limit or if a counterexample can not be confirmed by Run.
+func Equivalent(a, b []bpf.Instruction) (equivalent bool, counterexample []byte, err error) {
+	if diags := Verify(a); diags != nil {
+		return false, nil, fmt.Errorf("invalid program a: %s", diags[0])
+	}
+	if diags := Verify(b); diags != nil {
+		return false, nil, fmt.Errorf("invalid program b: %s", diags[0])
+	}
+
+	e := newEquivalenceCircuit()
+	retA, err := e.program(a)
+	if err != nil {
+		return false, nil, fmt.Errorf("program a: %s", err.Error())
+	}
+	retB, err := e.program(b)
+	if err != nil {
+		return false, nil, fmt.Errorf("program b: %s", err.Error())
+	}
+	e.addConsistency()
+
+	differ := e.Eq(retA, retB).Not()
+	if differ == sat.False {
+		return true, nil, nil
+	}
+	e.AddClause(differ)
+
+	switch e.Solve(maxEquivalenceConflicts) {
+	case sat.Unsatisfiable:
+		return true, nil, nil
+	case sat.Unknown:
+		return false, nil, fmt.Errorf("search for a counterexample exceeded %d conflicts", maxEquivalenceConflicts)
+	}
+
+	pkt, md := e.packet()
+	// the counterexample is only returned, if it is confirmed by the interpreter
+	gotA, _, errA := Run(a, pkt, WithMetadata(md))
+	gotB, _, errB := Run(b, pkt, WithMetadata(md))
+	if errA == nil && errB == nil && gotA != gotB {
+		return false, pkt, nil
+	}
+	return false, nil, fmt.Errorf("counterexample %v not confirmed by Run", pkt)
+}
+
+// equivalenceCircuit is the circuit of the programs compared by Equivalent. The packet is
+// shared by all programs added with program.
+type equivalenceCircuit struct {
+	*sat.Circuit
+	length sat.BV
+	// bytes are the packet bytes at constant offsets.
+	bytes map[uint32]sat.BV
+	// reads are the packet bytes at offsets depending on X.
+	reads []byteRead
+	// readIndex finds the read of an offset circuit in reads.
+	readIndex map[string]int
+	ext       map[bpf.Extension]sat.BV
+}
+
+// byteRead is a read of the packet byte at the offset off, which is not constant.
+type byteRead struct {
+	off, val sat.BV
+}
+
+func newEquivalenceCircuit() *equivalenceCircuit {
+	c := sat.NewCircuit()
+	e := &equivalenceCircuit{
+		Circuit:   c,
+		length:    c.Input(16),
+		bytes:     map[uint32]sat.BV{},
+		readIndex: map[string]int{},
+		ext:       map[bpf.Extension]sat.BV{},
+	}
+	return e
+}
+
+// machineState are the registers and the scratch memory of the BPF machine.
+type machineState struct {
+	a, x sat.BV
+	m    [16]sat.BV
+}
+
+// stateEdge is the control flow to an instruction, taken if cond is true.
+type stateEdge struct {
+	cond  sat.Lit
+	state machineState
+}
+
+// program adds prog to the circuit and returns its return value. Packets, for which prog
+// drops the packet because of a load out of bounds or a division by zero, return 0.
+func (e *equivalenceCircuit) program(prog []bpf.Instruction) (sat.BV, error) {
+	zero := e.Const(0, 32)
+	start := machineState{a: zero, x: zero}
+	for i := range start.m {
+		start.m[i] = zero
+	}
+
+	incoming := make([][]stateEdge, len(prog)+1)
+	incoming[0] = []stateEdge{{cond: sat.True, state: start}}
+	ret := zero
+
+	for i, instr := range prog {
+		if len(incoming[i]) == 0 {
+			// unreachable
+			continue
+		}
+		reach, s := e.merge(incoming[i])
+		incoming[i] = nil
+
+		next := func(cond sat.Lit, s machineState) {
+			incoming[i+1] = append(incoming[i+1], stateEdge{cond: e.And(reach, cond), state: s})
+		}
+
+		if relativeLoad(instr) {
+			return nil, fmt.Errorf("instruction %d: loads relative to the link layer or network layer header are not supported", i)
+		}
+
+		switch inst := instr.(type) {
+		case bpf.ALUOpConstant:
+			s.a = e.alu(inst.Op, s.a, e.Const(uint64(inst.Val), 32))
+			next(sat.True, s)
+
+		case bpf.ALUOpX:
+			if inst.Op == bpf.ALUOpDiv || inst.Op == bpf.ALUOpMod {
+				// division by zero drops the packet
+				nonZero := e.NonZero(s.x)
+				s.a = e.alu(inst.Op, s.a, s.x)
+				next(nonZero, s)
+				break
+			}
+			s.a = e.alu(inst.Op, s.a, s.x)
+			next(sat.True, s)
+
+		case bpf.NegateA:
+			s.a = e.Sub(zero, s.a)
+			next(sat.True, s)
+
+		case bpf.Jump:
+			t := i + 1 + int(inst.Skip)
+			incoming[t] = append(incoming[t], stateEdge{cond: reach, state: s})
+
+		case bpf.JumpIf:
+			e.jump(incoming, i, reach, s, e.jumpTest(inst.Cond, s.a, e.Const(uint64(inst.Val), 32)), inst.SkipTrue, inst.SkipFalse)
+
+		case bpf.JumpIfX:
+			e.jump(incoming, i, reach, s, e.jumpTest(inst.Cond, s.a, s.x), inst.SkipTrue, inst.SkipFalse)
+
+		case bpf.LoadAbsolute:
+			if inst.Size == 4 && inst.Off > 0xFFFFFFFF-0x1000 {
+				s.a = e.extension(bpf.Extension(inst.Off + 0x1000))
+				next(sat.True, s)
+				break
+			}
+			val, inBounds := e.load(e.Const(uint64(inst.Off), offsetWidth), inst.Size)
+			s.a = val
+			next(inBounds, s)
+
+		case bpf.LoadIndirect:
+			off := e.Add(e.ZeroExt(s.x, offsetWidth), e.Const(uint64(inst.Off), offsetWidth))
+			val, inBounds := e.load(off, inst.Size)
+			s.a = val
+			next(inBounds, s)
+
+		case bpf.LoadMemShift:
+			val, inBounds := e.load(e.Const(uint64(inst.Off), offsetWidth), 1)
+			s.x = e.ShlConst(e.AndBV(val, e.Const(0xf, 32)), 2)
+			next(inBounds, s)
+
+		case bpf.LoadConstant:
+			if inst.Dst == bpf.RegX {
+				s.x = e.Const(uint64(inst.Val), 32)
+			} else {
+				s.a = e.Const(uint64(inst.Val), 32)
+			}
+			next(sat.True, s)
+
+		case bpf.LoadExtension:
+			s.a = e.extension(inst.Num)
+			next(sat.True, s)
+
+		case bpf.LoadScratch:
+			if inst.Dst == bpf.RegX {
+				s.x = s.m[inst.N]
+			} else {
+				s.a = s.m[inst.N]
+			}
+			next(sat.True, s)
+
+		case bpf.StoreScratch:
+			if inst.Src == bpf.RegX {
+				s.m[inst.N] = s.x
+			} else {
+				s.m[inst.N] = s.a
+			}
+			next(sat.True, s)
+
+		case bpf.TAX:
+			s.x = s.a
+			next(sat.True, s)
+
+		case bpf.TXA:
+			s.a = s.x
+			next(sat.True, s)
+
+		case bpf.RetA:
+			ret = e.MuxBV(reach, s.a, ret)
+
+		case bpf.RetConstant:
+			ret = e.MuxBV(reach, e.Const(uint64(inst.Val), 32), ret)
+
+		default:
+			return nil, fmt.Errorf("instruction %d: unsupported instruction %#v", i, inst)
+		}
+	}
+
+	return ret, nil
+}
+
+// merge returns the condition to reach an instruction and the machine state at the
+// instruction. The conditions of the edges are mutually exclusive.
+func (e *equivalenceCircuit) merge(edges []stateEdge) (sat.Lit, machineState) {
+	reach, s := edges[0].cond, edges[0].state
+	for _, edge := range edges[1:] {
+		reach = e.Or(reach, edge.cond)
+		s.a = e.MuxBV(edge.cond, edge.state.a, s.a)
+		s.x = e.MuxBV(edge.cond, edge.state.x, s.x)
+		for i := range s.m {
+			s.m[i] = e.MuxBV(edge.cond, edge.state.m[i], s.m[i])
+		}
+	}
+	return reach, s
+}
+
+// jump adds the edges of the conditional jump at index i, which jumps if taken is true.
+func (e *equivalenceCircuit) jump(incoming [][]stateEdge, i int, reach sat.Lit, s machineState, taken sat.Lit, skipTrue, skipFalse uint8) {
+	t, f := i+1+int(skipTrue), i+1+int(skipFalse)
+	incoming[t] = append(incoming[t], stateEdge{cond: e.And(reach, taken), state: s})
+	incoming[f] = append(incoming[f], stateEdge{cond: e.And(reach, taken.Not()), state: s})
+}
+
+func (e *equivalenceCircuit) alu(op bpf.ALUOp, a, val sat.BV) sat.BV {
+	switch op {
+	case bpf.ALUOpAdd:
+		return e.Add(a, val)
+	case bpf.ALUOpSub:
+		return e.Sub(a, val)
+	case bpf.ALUOpMul:
+		return e.Mul(a, val)
+	case bpf.ALUOpDiv:
+		q, _ := e.DivMod(a, val)
+		return q
+	case bpf.ALUOpMod:
+		_, r := e.DivMod(a, val)
+		return r
+	case bpf.ALUOpAnd:
+		return e.AndBV(a, val)
+	case bpf.ALUOpOr:
+		return e.OrBV(a, val)
+	case bpf.ALUOpXor:
+		return e.XorBV(a, val)
+	case bpf.ALUOpShiftLeft:
+		return e.Shl(a, val)
+	case bpf.ALUOpShiftRight:
+		return e.Shr(a, val)
+	}
+	// rejected by Verify
+	return e.Const(0, 32)
+}
+
+func (e *equivalenceCircuit) jumpTest(cond bpf.JumpTest, a, val sat.BV) sat.Lit {
+	switch cond {
+	case bpf.JumpEqual:
+		return e.Eq(a, val)
+	case bpf.JumpNotEqual:
+		return e.Eq(a, val).Not()
+	case bpf.JumpGreaterThan:
+		return e.Ult(val, a)
+	case bpf.JumpLessThan:
+		return e.Ult(a, val)
+	case bpf.JumpGreaterOrEqual:
+		return e.Ule(val, a)
+	case bpf.JumpLessOrEqual:
+		return e.Ule(a, val)
+	case bpf.JumpBitsSet:
+		return e.NonZero(e.AndBV(a, val))
+	case bpf.JumpBitsNotSet:
+		return e.NonZero(e.AndBV(a, val)).Not()
+	}
+	// rejected by Verify
+	return sat.False
+}
+
+// load returns size bytes in network byte order from offset off of the packet and a literal,
+// which is true if the load is within the bounds of the packet.
+func (e *equivalenceCircuit) load(off sat.BV, size int) (sat.BV, sat.Lit) {
+	end := e.Add(off, e.Const(uint64(size), offsetWidth))
+	inBounds := e.Ule(end, e.ZeroExt(e.length, offsetWidth))
+
+	val := e.Const(0, 32)
+	for i := 0; i < size; i++ {
+		b := e.byteAt(e.Add(off, e.Const(uint64(i), offsetWidth)))
+		val = e.OrBV(e.ShlConst(val, 8), e.ZeroExt(b, 32))
+	}
+	return val, inBounds
+}
+
+// byteAt returns the packet byte at offset off.
+func (e *equivalenceCircuit) byteAt(off sat.BV) sat.BV {
+	if val, ok := off.Constant(); ok {
+		if val > maxPacketLen {
+			// always out of bounds
+			return e.Const(0, 8)
+		}
+		b, ok := e.bytes[uint32(val)]
+		if !ok {
+			b = e.Input(8)
+			e.bytes[uint32(val)] = b
+		}
+		return b
+	}
+
+	key := fmt.Sprint(off)
+	if i, ok := e.readIndex[key]; ok {
+		return e.reads[i].val
+	}
+	r := byteRead{off: off, val: e.Input(8)}
+	e.readIndex[key] = len(e.reads)
+	e.reads = append(e.reads, r)
+	return r.val
+}
+
+// addConsistency adds the constraints, which ensure that reads of the same offset return the
+// same byte.
+func (e *equivalenceCircuit) addConsistency() {
+	for i, r := range e.reads {
+		for off, b := range e.bytes {
+			same := e.Eq(r.off, e.Const(uint64(off), offsetWidth))
+			e.AddClause(same.Not(), e.Eq(r.val, b))
+		}
+		for _, other := range e.reads[:i] {
+			same := e.Eq(r.off, other.off)
+			e.AddClause(same.Not(), e.Eq(r.val, other.val))
+		}
+	}
+}
+
+// extension returns the value of the ancillary data load of ext.
+func (e *equivalenceCircuit) extension(ext bpf.Extension) sat.BV {
+	if ext == bpf.ExtLen {
+		return e.ZeroExt(e.length, 32)
+	}
+	v, ok := e.ext[ext]
+	if !ok {
+		v = e.Input(32)
+		e.ext[ext] = v
+	}
+	return v
+}
+
+// packet returns the packet and the ancillary data of the model found by the solver.
+func (e *equivalenceCircuit) packet() ([]byte, StaticMetadata) {
+	pkt := make([]byte, e.Value(e.length))
+	for off, b := range e.bytes {
+		if int(off) < len(pkt) {
+			pkt[off] = byte(e.Value(b))
+		}
+	}
+	for _, r := range e.reads {
+		if off := e.Value(r.off); off < uint64(len(pkt)) {
+			pkt[off] = byte(e.Value(r.val))
+		}
+	}
+
+	md := StaticMetadata{}
+	for ext, v := range e.ext {
+		md[ext] = uint32(e.Value(v))
+	}
+	return pkt, md
+}
+
+// relativeLoad returns true, if instr loads from an offset relative to the link layer or the
+// network layer header.
+func relativeLoad(instr bpf.Instruction) bool {
+	var off uint32
+	switch inst := instr.(type) {
+	case bpf.LoadAbsolute:
+		off = inst.Off
+	case bpf.LoadIndirect:
+		off = inst.Off
+	case bpf.LoadMemShift:
+		off = inst.Off
+	default:
+		return false
+	}
+	return off >= skfLLOff && off < skfADOff
+}
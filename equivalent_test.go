@@ -0,0 +1,213 @@
+package bpfutils
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestEquivalent(t *testing.T) {
+	cases := []struct {
+		description string
+		a, b        string
+		equivalent  bool
+		// ancillary is true, if the counterexample depends on ancillary data, which is not
+		// returned by Equivalent
+		ancillary bool
+	}{
+		{
+			description: "identical",
+			a:           "ldh [12]\njeq #0x800,1\nret #0\nret #65535",
+			b:           "ldh [12]\njeq #0x800,1\nret #0\nret #65535",
+			equivalent:  true,
+		},
+		{
+			description: "reordered conditions",
+			a:           "ldh [12]\njeq #0x800,2\njeq #0x86dd,1\nret #0\nret #65535",
+			b:           "ldh [12]\njeq #0x86dd,2\njeq #0x800,1\nret #0\nret #65535",
+			equivalent:  true,
+		},
+		{
+			description: "different protocol",
+			a:           "ldh [12]\njeq #0x800,1\nret #0\nret #65535",
+			b:           "ldh [12]\njeq #0x86dd,1\nret #0\nret #65535",
+		},
+		{
+			description: "different snap length",
+			a:           "ldh [12]\njeq #0x800,1\nret #0\nret #65535",
+			b:           "ldh [12]\njeq #0x800,1\nret #0\nret #262144",
+		},
+		{
+			description: "inverted condition",
+			a:           "ld #len\njgt #500,1\nret #0\nret #1",
+			b:           "ld #len\njlt #501,1\nret #1\nret #0",
+			equivalent:  true,
+		},
+		{
+			description: "off by one",
+			a:           "ld #len\njgt #500,1\nret #0\nret #1",
+			b:           "ld #len\njge #500,1\nret #0\nret #1",
+		},
+		{
+			description: "mask and shift",
+			a:           "ldb [14]\nand #0xf0\njeq #0x40,1\nret #0\nret #1",
+			b:           "ldb [14]\nrsh #4\njeq #4,1\nret #0\nret #1",
+			equivalent:  true,
+		},
+		{
+			description: "jset and mask",
+			a:           "ldh [20]\njset #0x1fff,1\nret #1\nret #0",
+			b:           "ldh [20]\nand #0x1fff\njeq #0,1\nret #0\nret #1",
+			equivalent:  true,
+		},
+		{
+			description: "overlapping loads",
+			a:           "ldh [12]\njeq #0x86dd,1\nret #0\nret #1",
+			b:           "ldb [12]\njeq #0x86,1\nret #0\nldb [13]\njeq #0xdd,1\nret #0\nret #1",
+			equivalent:  true,
+		},
+		{
+			description: "load out of bounds",
+			a:           "ldb [100]\nret #1",
+			b:           "ret #1",
+		},
+		{
+			description: "load out of bounds drops",
+			a:           "ldb [100]\nret #0",
+			b:           "ret #0",
+			equivalent:  true,
+		},
+		{
+			description: "ret a",
+			a:           "ldh [6]\nret a",
+			b:           "ldh [6]\njeq #42,1\nret a\nret #42",
+			equivalent:  true,
+		},
+		{
+			description: "ret a with different value",
+			a:           "ldh [6]\nret a",
+			b:           "ldh [6]\njeq #42,1\nret a\nret #43",
+		},
+		{
+			description: "indirect load",
+			a:           "ldxb 4*([14]&0xf)\nldh [x+16]\njeq #80,1\nret #0\nret #1",
+			b:           "ldxb 4*([14]&0xf)\nldh [x+16]\njeq #81,1\nret #0\nret #1",
+		},
+		{
+			description: "scratch memory",
+			a:           "ldh [8]\nst M[1]\nld #0\nld M[1]\nret a",
+			b:           "ldh [8]\ntax\ntxa\nret a",
+			equivalent:  true,
+		},
+		{
+			description: "ancillary data",
+			a:           "ld #proto\njeq #0x86dd,1\nret #0\nret #1",
+			b:           "ldh [12]\njeq #0x86dd,1\nret #0\nret #1",
+			ancillary:   true,
+		},
+		{
+			description: "shift by more than 31 bits",
+			a:           "ldb [0]\ntax\nld #1\nlsh x\nret a",
+			b:           "ldb [0]\njgt #31,4\ntax\nld #1\nlsh x\nret a\nret #0",
+			equivalent:  true,
+		},
+		{
+			description: "indirect loads of the same byte",
+			a:           "ldxb 4*([0]&0xf)\nldb [x+0]\nret a",
+			b:           "ldb [0]\nand #0xf\nlsh #2\ntax\nldb [x+0]\nret a",
+			equivalent:  true,
+		},
+		{
+			description: "indirect load and constant offset",
+			a:           "ldxb 4*([0]&0xf)\nldb [x+0]\ntax\nldb [20]\nsub x\nret a",
+			b:           "ldxb 4*([0]&0xf)\ntxa\njeq #20,1\nret #1\nret #0",
+		},
+		{
+			description: "division by zero",
+			a:           "ldb [0]\ntax\nld #100\ndiv x\nret a",
+			b:           "ldb [0]\njeq #0,1\njmp 1\nret #1\ntax\nld #100\ndiv x\nret a",
+		},
+	}
+
+	for _, test := range cases {
+		a, err := ParseAsm(strings.NewReader(test.a))
+		if err != nil {
+			t.Fatalf("case '%s': failed to parse a with error: %s", test.description, err.Error())
+		}
+		b, err := ParseAsm(strings.NewReader(test.b))
+		if err != nil {
+			t.Fatalf("case '%s': failed to parse b with error: %s", test.description, err.Error())
+		}
+
+		equivalent, counterexample, err := Equivalent(a, b)
+		if err != nil {
+			t.Errorf("case '%s': failed with error: %s", test.description, err.Error())
+			continue
+		}
+		if equivalent != test.equivalent {
+			t.Errorf("case '%s': got %t, expected %t", test.description, equivalent, test.equivalent)
+			continue
+		}
+		if equivalent {
+			if counterexample != nil {
+				t.Errorf("case '%s': got counterexample %v for equivalent programs", test.description, counterexample)
+			}
+			continue
+		}
+		if test.ancillary {
+			continue
+		}
+
+		retA, _, errA := Run(a, counterexample)
+		retB, _, errB := Run(b, counterexample)
+		if errA != nil || errB != nil || retA == retB {
+			t.Errorf("case '%s': counterexample %v does not distinguish the programs, returned %d and %d", test.description, counterexample, retA, retB)
+		}
+	}
+}
+
+func TestEquivalentInvalid(t *testing.T) {
+	valid := []bpf.Instruction{bpf.RetConstant{Val: 0}}
+	invalid := []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegA, Val: 0}}
+
+	equivalent, counterexample, err := Equivalent(valid, invalid)
+	if err == nil {
+		t.Errorf("got %t and %v for invalid program, expected an error", equivalent, counterexample)
+	}
+
+	relative := []bpf.Instruction{bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1}, bpf.RetA{}}
+	equivalent, counterexample, err = Equivalent(valid, relative)
+	if err == nil {
+		t.Errorf("got %t and %v for load relative to the network layer header, expected an error", equivalent, counterexample)
+	}
+}
+
+func TestEquivalentOptimize(t *testing.T) {
+	for name, filter := range loopbackFilters {
+		if equivalent, counterexample, err := Equivalent(filter, Optimize(filter)); !equivalent || err != nil {
+			t.Errorf("'%s': optimized filter is not equivalent, counterexample: %v, error: %v", name, counterexample, err)
+		}
+	}
+}
+
+func TestChainFilterEquivalentCompileExpr(t *testing.T) {
+	for nameA, a := range loopbackFilters {
+		for nameB, b := range loopbackFilters {
+			cases := []struct {
+				ct   ChainType
+				expr FilterExpr
+			}{
+				{ct: AND, expr: And(Filter(a), Filter(b))},
+				{ct: OR, expr: Or(Filter(a), Filter(b))},
+			}
+
+			for _, test := range cases {
+				chained := ChainFilter(a, b, test.ct)
+				if equivalent, counterexample, err := Equivalent(chained, CompileExpr(test.expr)); !equivalent || err != nil {
+					t.Errorf("'%s' %s '%s': not equivalent to CompileExpr, counterexample: %v, error: %v", nameA, test.ct, nameB, counterexample, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package bpfutils
+
+import (
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils/internal/reloc"
+)
+
+// DefaultSnapLen is returned by a program compiled with CompileExpr, if a packet is accepted
+// without the decision being made by the `ret` instruction of a single filter (e.g. for Not).
+const DefaultSnapLen = 262144
+
+// FilterExpr is a boolean expression over BPF filters. A filter evaluates to true, if it
+// would return a value > 0 for a packet. Expressions are built with Filter, And, Or, Not and Xor
+// and compiled into a single BPF filter with CompileExpr.
+type FilterExpr interface {
+	compile(p *reloc.Program, onTrue, onFalse exprTarget) error
+}
+
+// exprTarget is the continuation of an expression for one of its outcomes.
+type exprTarget struct {
+	label int
+	// keep is true, if the `ret` instructions of a filter may be kept instead of jumping to
+	// label, because the outcome of the whole expression is decided.
+	keep bool
+}
+
+type filterExpr []bpf.Instruction
+
+// Filter returns a FilterExpr for a single BPF filter.
+//
+// Filters are evaluated one after the other in the compiled program, so every filter must
+// initialize the registers and the scratch memory it uses.
+func Filter(f []bpf.Instruction) FilterExpr {
+	return filterExpr(f)
+}
+
+func (f filterExpr) compile(p *reloc.Program, onTrue, onFalse exprTarget) error {
+	labels := p.NewLabels(len(f) + 1)
+	err := p.AppendRelocated(f, labels, func(i int, instr bpf.Instruction) bool {
+		switch inst := instr.(type) {
+		case bpf.RetConstant:
+			switch {
+			case inst.Val > 0 && !onTrue.keep:
+				p.Jump(onTrue.label)
+			case inst.Val == 0 && !onFalse.keep:
+				p.Jump(onFalse.label)
+			default:
+				return false
+			}
+			return true
+		case bpf.RetA:
+			switch {
+			case onTrue.keep && onFalse.keep:
+				return false
+			case onTrue.keep:
+				ret := p.NewLabel()
+				p.JumpIf(bpf.JumpEqual, 0, onFalse.label, ret)
+				p.Mark(ret)
+				p.Append(instr)
+			case onFalse.keep:
+				ret := p.NewLabel()
+				p.JumpIf(bpf.JumpNotEqual, 0, onTrue.label, ret)
+				p.Mark(ret)
+				p.Append(instr)
+			default:
+				p.JumpIf(bpf.JumpEqual, 0, onFalse.label, onTrue.label)
+			}
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	// Falling off the end of a filter drops the packet
+	if len(f) == 0 || !isReturn(f[len(f)-1]) {
+		p.Jump(onFalse.label)
+	}
+	return nil
+}
+
+func isReturn(inst bpf.Instruction) bool {
+	switch inst.(type) {
+	case bpf.RetA, bpf.RetConstant:
+		return true
+	}
+	return false
+}
+
+type andExpr []FilterExpr
+
+// And returns a FilterExpr, which is true if all exprs are true. The exprs are evaluated
+// from left to right, until one of them is false. And without exprs is always true.
+func And(exprs ...FilterExpr) FilterExpr {
+	return andExpr(exprs)
+}
+
+func (e andExpr) compile(p *reloc.Program, onTrue, onFalse exprTarget) error {
+	if len(e) == 0 {
+		p.Jump(onTrue.label)
+		return nil
+	}
+	for _, expr := range e[:len(e)-1] {
+		next := p.NewLabel()
+		if err := expr.compile(p, exprTarget{label: next}, onFalse); err != nil {
+			return err
+		}
+		p.Mark(next)
+	}
+	return e[len(e)-1].compile(p, onTrue, onFalse)
+}
+
+type orExpr []FilterExpr
+
+// Or returns a FilterExpr, which is true if at least one of exprs is true. The exprs are
+// evaluated from left to right, until one of them is true. Or without exprs is always false.
+func Or(exprs ...FilterExpr) FilterExpr {
+	return orExpr(exprs)
+}
+
+func (e orExpr) compile(p *reloc.Program, onTrue, onFalse exprTarget) error {
+	if len(e) == 0 {
+		p.Jump(onFalse.label)
+		return nil
+	}
+	for _, expr := range e[:len(e)-1] {
+		next := p.NewLabel()
+		if err := expr.compile(p, onTrue, exprTarget{label: next}); err != nil {
+			return err
+		}
+		p.Mark(next)
+	}
+	return e[len(e)-1].compile(p, onTrue, onFalse)
+}
+
+type notExpr struct {
+	expr FilterExpr
+}
+
+// Not returns a FilterExpr, which is true if expr is false.
+// If the whole expression is decided by Not, the compiled program returns DefaultSnapLen.
+func Not(expr FilterExpr) FilterExpr {
+	return notExpr{expr: expr}
+}
+
+func (e notExpr) compile(p *reloc.Program, onTrue, onFalse exprTarget) error {
+	return e.expr.compile(p, exprTarget{label: onFalse.label}, exprTarget{label: onTrue.label})
+}
+
+type xorExpr struct {
+	a, b FilterExpr
+}
+
+// Xor returns a FilterExpr, which is true if exactly one of a and b is true.
+// b is compiled twice, once for each outcome of a.
+// If the whole expression is decided by Xor, the compiled program returns DefaultSnapLen.
+func Xor(a, b FilterExpr) FilterExpr {
+	return xorExpr{a: a, b: b}
+}
+
+func (e xorExpr) compile(p *reloc.Program, onTrue, onFalse exprTarget) error {
+	aTrue, aFalse := p.NewLabel(), p.NewLabel()
+	if err := e.a.compile(p, exprTarget{label: aTrue}, exprTarget{label: aFalse}); err != nil {
+		return err
+	}
+	p.Mark(aTrue)
+	if err := e.b.compile(p, exprTarget{label: onFalse.label}, exprTarget{label: onTrue.label}); err != nil {
+		return err
+	}
+	p.Mark(aFalse)
+	return e.b.compile(p, onTrue, onFalse)
+}
+
+// CompileExpr compiles expr into a single BPF filter. The filters are evaluated with short
+// circuit semantics. If a filter decides the outcome of the whole expression, its own `ret`
+// instruction is kept, which preserves the returned snap length. If a jump of a filter has a
+// target beyond the end of the filter, nil is returned.
+func CompileExpr(expr FilterExpr) []bpf.Instruction {
+	p := &reloc.Program{}
+	accept, reject := p.NewLabel(), p.NewLabel()
+
+	if err := expr.compile(p, exprTarget{label: accept, keep: true}, exprTarget{label: reject, keep: true}); err != nil {
+		return nil
+	}
+
+	if p.Referenced(accept) {
+		p.Mark(accept)
+		p.Append(bpf.RetConstant{Val: DefaultSnapLen})
+	}
+	if p.Referenced(reject) {
+		p.Mark(reject)
+		p.Append(bpf.RetConstant{Val: 0})
+	}
+
+	return p.Instructions()
+}
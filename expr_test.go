@@ -0,0 +1,110 @@
+package bpfutils
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// evalExpr evaluates expr by running every filter on its own.
+func evalExpr(t *testing.T, expr FilterExpr, packet []byte) bool {
+	switch e := expr.(type) {
+	case filterExpr:
+		return runFilter(t, e, packet) > 0
+	case andExpr:
+		for _, sub := range e {
+			if !evalExpr(t, sub, packet) {
+				return false
+			}
+		}
+		return true
+	case orExpr:
+		for _, sub := range e {
+			if evalExpr(t, sub, packet) {
+				return true
+			}
+		}
+		return false
+	case notExpr:
+		return !evalExpr(t, e.expr, packet)
+	case xorExpr:
+		return evalExpr(t, e.a, packet) != evalExpr(t, e.b, packet)
+	}
+	t.Fatalf("unknown expression: %#v", expr)
+	return false
+}
+
+func TestCompileExpr(t *testing.T) {
+	tcp := Filter(loopbackFilters["ip6 and tcp"])
+	length := Filter(loopbackFilters["len > 500"])
+	flow := Filter(loopbackFilters["flow label or len"])
+	payload := Filter(loopbackFilters["ip6 payload < 100"])
+	long := Filter(loopbackFilters["long jumps"])
+
+	cases := []struct {
+		description string
+		expr        FilterExpr
+	}{
+		{description: "single filter", expr: tcp},
+		{description: "and", expr: And(tcp, length, flow, payload, long)},
+		{description: "or", expr: Or(tcp, length, flow, payload, long)},
+		{description: "not", expr: Not(length)},
+		{description: "not not", expr: Not(Not(flow))},
+		{description: "and not or", expr: And(length, Not(Or(flow, payload)))},
+		{description: "or not and", expr: Or(Not(And(tcp, length)), long)},
+		{description: "nested", expr: And(Or(payload, length, long), Not(flow), Or(Not(long), tcp))},
+		{description: "xor", expr: Xor(tcp, length)},
+		{description: "xor nested", expr: Or(Xor(Not(flow), And(payload, long)), Xor(length, Or()))},
+		{description: "empty and", expr: And()},
+		{description: "empty or", expr: Or()},
+		{description: "not empty and", expr: Not(And())},
+	}
+
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	for _, test := range cases {
+		got := CompileExpr(test.expr)
+		if _, err := bpf.Assemble(got); err != nil {
+			t.Errorf("case '%s': failed to assemble with error: %s\n%s", test.description, err.Error(), AsmString(got))
+			continue
+		}
+
+		for i, packet := range packets {
+			expect := evalExpr(t, test.expr, packet)
+			if accepted := runFilter(t, got, packet) > 0; accepted != expect {
+				t.Errorf("case '%s': packet %d accepted: %t, expected: %t\n%s", test.description, i, accepted, expect, AsmString(got))
+			}
+		}
+	}
+}
+
+func TestCompileExprChainFilter(t *testing.T) {
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	for nameA, a := range loopbackFilters {
+		for nameB, b := range loopbackFilters {
+			and := CompileExpr(And(Filter(a), Filter(b)))
+			or := CompileExpr(Or(Filter(a), Filter(b)))
+
+			for i, packet := range packets {
+				if got, expect := runFilter(t, and, packet), runFilter(t, ChainFilter(a, b, AND), packet); got != expect {
+					t.Errorf("packet %d: '%s' and '%s' returned %d, expected %d\n%s", i, nameA, nameB, got, expect, AsmString(and))
+				}
+				if got, expect := runFilter(t, or, packet), runFilter(t, ChainFilter(a, b, OR), packet); got != expect {
+					t.Errorf("packet %d: '%s' or '%s' returned %d, expected %d\n%s", i, nameA, nameB, got, expect, AsmString(or))
+				}
+			}
+		}
+	}
+}
+
+func TestCompileExprFallOff(t *testing.T) {
+	// A filter falling off its end drops the packet
+	filter := CompileExpr(Or(Filter([]bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}), Filter(loopbackFilters["len > 500"])))
+
+	for i, packet := range readPackets(t, "pcap/test_loopback.pcap") {
+		if got, expect := runFilter(t, filter, packet), runFilter(t, loopbackFilters["len > 500"], packet); got != expect {
+			t.Errorf("packet %d: returned %d, expected %d\n%s", i, got, expect, AsmString(filter))
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Package reloc builds BPF programs with labels as jump targets, which are resolved to skip
+// counts only at the end.
+package reloc
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// Program is a BPF program under construction. The targets of jumps are kept as labels
+// and only resolved to skip counts by Instructions. This allows to insert, replace or
+// remove instructions without breaking the jumps crossing them.
+type Program struct {
+	insts  []relocInstruction
+	labels []int // index in insts for every label, -1 if the label is not yet placed
+}
+
+// relocInstruction is an instruction with the labels of its jump targets.
+// For bpf.Jump only jt is used, for bpf.JumpIf and bpf.JumpIfX jt and jf are the labels of the
+// true and false branch. For all other instructions, the labels are ignored.
+type relocInstruction struct {
+	inst   bpf.Instruction
+	jt, jf int
+}
+
+// NewLabel returns a new label, which is not yet placed.
+func (p *Program) NewLabel() int {
+	p.labels = append(p.labels, -1)
+	return len(p.labels) - 1
+}
+
+// NewLabels returns n new labels.
+func (p *Program) NewLabels(n int) []int {
+	labels := make([]int, n)
+	for i := range labels {
+		labels[i] = p.NewLabel()
+	}
+	return labels
+}
+
+// Mark places label in front of the next instruction, which is appended.
+func (p *Program) Mark(label int) {
+	p.labels[label] = len(p.insts)
+}
+
+// Append adds an instruction without jump targets.
+func (p *Program) Append(inst bpf.Instruction) {
+	p.insts = append(p.insts, relocInstruction{inst: inst})
+}
+
+// Jump adds an unconditional jump to label target.
+func (p *Program) Jump(target int) {
+	p.insts = append(p.insts, relocInstruction{inst: bpf.Jump{}, jt: target})
+}
+
+// JumpIf adds a conditional jump to label jt if the condition is true or to label jf otherwise.
+func (p *Program) JumpIf(cond bpf.JumpTest, val uint32, jt, jf int) {
+	p.insts = append(p.insts, relocInstruction{inst: bpf.JumpIf{Cond: cond, Val: val}, jt: jt, jf: jf})
+}
+
+// JumpIfX adds a conditional jump comparing A with X to label jt if the condition is true or
+// to label jf otherwise.
+func (p *Program) JumpIfX(cond bpf.JumpTest, jt, jf int) {
+	p.insts = append(p.insts, relocInstruction{inst: bpf.JumpIfX{Cond: cond}, jt: jt, jf: jf})
+}
+
+// Referenced returns true, if label is the target of any jump.
+func (p *Program) Referenced(label int) bool {
+	for _, ri := range p.insts {
+		switch ri.inst.(type) {
+		case bpf.Jump:
+			if ri.jt == label {
+				return true
+			}
+		case bpf.JumpIf, bpf.JumpIfX:
+			if ri.jt == label || ri.jf == label {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AppendRelocated adds the instructions of prog and converts the skip counts of its jumps to
+// labels. labels must contain len(prog)+1 labels, labels[i] is placed in front of prog[i] and
+// labels[len(prog)] is placed after the last instruction of prog.
+//
+// If replace is not nil, it is called for every instruction of prog. If it returns true, the
+// instruction is considered as replaced by the instructions replace has added to p in the
+// meantime, otherwise the instruction is added unchanged.
+//
+// An error is returned, if a jump of prog has a target beyond the last instruction of prog.
+// In this case, p is left incomplete and must not be used any more.
+func (p *Program) AppendRelocated(prog []bpf.Instruction, labels []int, replace func(i int, inst bpf.Instruction) bool) error {
+	var err error
+	target := func(i int, skip uint32) int {
+		if uint64(i)+1+uint64(skip) >= uint64(len(prog)) {
+			if err == nil {
+				err = fmt.Errorf("instruction %d: jump target %d is out of range for a program with %d instructions", i, uint64(i)+1+uint64(skip), len(prog))
+			}
+			return labels[len(prog)]
+		}
+		return labels[i+1+int(skip)]
+	}
+
+	for i, instr := range prog {
+		p.Mark(labels[i])
+		if replace != nil && replace(i, instr) {
+			continue
+		}
+		switch inst := instr.(type) {
+		case bpf.Jump:
+			p.Jump(target(i, inst.Skip))
+		case bpf.JumpIf:
+			p.JumpIf(inst.Cond, inst.Val, target(i, uint32(inst.SkipTrue)), target(i, uint32(inst.SkipFalse)))
+		case bpf.JumpIfX:
+			p.JumpIfX(inst.Cond, target(i, uint32(inst.SkipTrue)), target(i, uint32(inst.SkipFalse)))
+		default:
+			p.Append(instr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	p.Mark(labels[len(prog)])
+	return nil
+}
+
+// Instructions resolves the labels and returns the resulting program. Unconditional jumps
+// to the directly following instruction are removed. Conditional jumps, which are out of range
+// of the 8 bit skip counts, are redirected to unconditional jumps with a 32 bit skip count.
+func (p *Program) Instructions() []bpf.Instruction {
+	pos, removed := p.layout()
+	for p.insertTrampolines(pos, removed) {
+		pos, removed = p.layout()
+	}
+
+	skip := func(i, label int) int {
+		return pos[p.labels[label]] - pos[i] - 1
+	}
+
+	insts := make([]bpf.Instruction, 0, len(p.insts))
+	for i, ri := range p.insts {
+		if removed[i] {
+			continue
+		}
+		switch inst := ri.inst.(type) {
+		case bpf.Jump:
+			inst.Skip = uint32(skip(i, ri.jt))
+			insts = append(insts, inst)
+		case bpf.JumpIf:
+			inst.SkipTrue = uint8(skip(i, ri.jt))
+			inst.SkipFalse = uint8(skip(i, ri.jf))
+			insts = append(insts, inst)
+		case bpf.JumpIfX:
+			inst.SkipTrue = uint8(skip(i, ri.jt))
+			inst.SkipFalse = uint8(skip(i, ri.jf))
+			insts = append(insts, inst)
+		default:
+			insts = append(insts, ri.inst)
+		}
+	}
+	return insts
+}
+
+// layout returns the position of every instruction in the resulting program, with the
+// position of the end of the program at pos[len(p.insts)]. Unconditional jumps to the
+// directly following instruction are marked as removed.
+func (p *Program) layout() (pos []int, removed []bool) {
+	removed = make([]bool, len(p.insts))
+	pos = make([]int, len(p.insts)+1)
+
+	for changed := true; changed; {
+		changed = false
+
+		n := 0
+		for i := range p.insts {
+			pos[i] = n
+			if !removed[i] {
+				n++
+			}
+		}
+		pos[len(p.insts)] = n
+
+		for i, ri := range p.insts {
+			if _, ok := ri.inst.(bpf.Jump); ok && !removed[i] && pos[p.labels[ri.jt]] == pos[i]+1 {
+				removed[i] = true
+				changed = true
+			}
+		}
+	}
+	return pos, removed
+}
+
+// insertTrampolines redirects every branch of a conditional jump, which is out of range for the
+// 8 bit skip count, to an unconditional jump placed directly after the conditional jump.
+// It returns false, if no trampoline was needed.
+func (p *Program) insertTrampolines(pos []int, removed []bool) bool {
+	type trampoline struct {
+		label, index int
+	}
+	var trampolines []trampoline
+
+	insts := make([]relocInstruction, 0, len(p.insts))
+	index := make([]int, len(p.insts)+1)
+	labels := len(p.labels)
+
+	for i, ri := range p.insts {
+		index[i] = len(insts)
+		insts = append(insts, ri)
+		if !IsConditionalJump(ri.inst) || removed[i] {
+			continue
+		}
+
+		jump := len(insts) - 1
+		for _, target := range []*int{&ri.jt, &ri.jf} {
+			if pos[p.labels[*target]]-pos[i]-1 <= 0xff {
+				continue
+			}
+			label := p.NewLabel()
+			trampolines = append(trampolines, trampoline{label: label, index: len(insts)})
+			insts = append(insts, relocInstruction{inst: bpf.Jump{}, jt: *target})
+			*target = label
+		}
+		insts[jump] = ri
+	}
+	index[len(p.insts)] = len(insts)
+
+	if len(trampolines) == 0 {
+		return false
+	}
+
+	for l := 0; l < labels; l++ {
+		if p.labels[l] >= 0 {
+			p.labels[l] = index[p.labels[l]]
+		}
+	}
+	for _, t := range trampolines {
+		p.labels[t.label] = t.index
+	}
+	p.insts = insts
+	return true
+}
+
+// IsConditionalJump returns true, if inst is a bpf.JumpIf or a bpf.JumpIfX.
+func IsConditionalJump(inst bpf.Instruction) bool {
+	switch inst.(type) {
+	case bpf.JumpIf, bpf.JumpIfX:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package sat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Circuit builds boolean expressions as and-inverter graph, whose gates are encoded as
+// clauses of the underlying Solver. Structurally equal gates are shared and constants are
+// folded, so equal expressions result in the same literal.
+type Circuit struct {
+	*Solver
+	ands  map[[2]Lit]Lit
+	cache map[string][]BV
+}
+
+// NewCircuit returns an empty circuit.
+func NewCircuit() *Circuit {
+	return &Circuit{Solver: NewSolver(), ands: map[[2]Lit]Lit{}, cache: map[string][]BV{}}
+}
+
+// And returns the conjunction of a and b.
+func (c *Circuit) And(a, b Lit) Lit {
+	if a > b {
+		a, b = b, a
+	}
+	switch {
+	case a == False || a == b.Not():
+		return False
+	case a == True || a == b:
+		return b
+	}
+	key := [2]Lit{a, b}
+	if g, ok := c.ands[key]; ok {
+		return g
+	}
+	g := c.NewVar()
+	c.AddClause(g.Not(), a)
+	c.AddClause(g.Not(), b)
+	c.AddClause(g, a.Not(), b.Not())
+	c.ands[key] = g
+	return g
+}
+
+// Or returns the disjunction of a and b.
+func (c *Circuit) Or(a, b Lit) Lit {
+	return c.And(a.Not(), b.Not()).Not()
+}
+
+// Xor returns the exclusive disjunction of a and b.
+func (c *Circuit) Xor(a, b Lit) Lit {
+	return c.Or(c.And(a, b.Not()), c.And(a.Not(), b))
+}
+
+// Mux returns t if sel is true and f otherwise.
+func (c *Circuit) Mux(sel, t, f Lit) Lit {
+	if t == f {
+		return t
+	}
+	return c.Or(c.And(sel, t), c.And(sel.Not(), f))
+}
+
+// BV is a bit vector, the least significant bit first.
+type BV []Lit
+
+// Const returns the constant bit vector val with width bits.
+func (c *Circuit) Const(val uint64, width int) BV {
+	v := make(BV, width)
+	for i := range v {
+		v[i] = False
+		if val>>uint(i)&1 == 1 {
+			v[i] = True
+		}
+	}
+	return v
+}
+
+// Input returns a bit vector of new variables with width bits.
+func (c *Circuit) Input(width int) BV {
+	v := make(BV, width)
+	for i := range v {
+		v[i] = c.NewVar()
+	}
+	return v
+}
+
+// Constant returns the value of v, if all of its bits are constant.
+func (v BV) Constant() (uint64, bool) {
+	var val uint64
+	for i, l := range v {
+		switch l {
+		case True:
+			val |= 1 << uint(i)
+		case False:
+		default:
+			return 0, false
+		}
+	}
+	return val, true
+}
+
+// key identifies v for the cache of Circuit.
+func (v BV) key() string {
+	var b strings.Builder
+	for _, l := range v {
+		fmt.Fprintf(&b, "%d,", l)
+	}
+	return b.String()
+}
+
+// Value returns the value of v in the model found by Solve.
+func (c *Circuit) Value(v BV) uint64 {
+	var val uint64
+	for i, l := range v {
+		if c.Solver.Value(l) {
+			val |= 1 << uint(i)
+		}
+	}
+	return val
+}
+
+// ZeroExt returns v extended or truncated to width bits.
+func (c *Circuit) ZeroExt(v BV, width int) BV {
+	r := make(BV, width)
+	for i := range r {
+		r[i] = False
+		if i < len(v) {
+			r[i] = v[i]
+		}
+	}
+	return r
+}
+
+// Concat returns the bit vector with the bits of high above the bits of low.
+func (c *Circuit) Concat(high, low BV) BV {
+	return append(append(BV{}, low...), high...)
+}
+
+func (c *Circuit) bitwise(a, b BV, op func(x, y Lit) Lit) BV {
+	r := make(BV, len(a))
+	for i := range r {
+		r[i] = op(a[i], b[i])
+	}
+	return r
+}
+
+// AndBV returns the bitwise conjunction of a and b.
+func (c *Circuit) AndBV(a, b BV) BV {
+	return c.bitwise(a, b, c.And)
+}
+
+// OrBV returns the bitwise disjunction of a and b.
+func (c *Circuit) OrBV(a, b BV) BV {
+	return c.bitwise(a, b, c.Or)
+}
+
+// XorBV returns the bitwise exclusive disjunction of a and b.
+func (c *Circuit) XorBV(a, b BV) BV {
+	return c.bitwise(a, b, c.Xor)
+}
+
+// NotBV returns the bitwise negation of a.
+func (c *Circuit) NotBV(a BV) BV {
+	r := make(BV, len(a))
+	for i := range r {
+		r[i] = a[i].Not()
+	}
+	return r
+}
+
+// MuxBV returns t if sel is true and f otherwise.
+func (c *Circuit) MuxBV(sel Lit, t, f BV) BV {
+	r := make(BV, len(t))
+	for i := range r {
+		r[i] = c.Mux(sel, t[i], f[i])
+	}
+	return r
+}
+
+// adder returns a + b + carry and the carry out of the most significant bit.
+func (c *Circuit) adder(a, b BV, carry Lit) (BV, Lit) {
+	r := make(BV, len(a))
+	for i := range r {
+		x := c.Xor(a[i], b[i])
+		r[i] = c.Xor(x, carry)
+		carry = c.Or(c.And(a[i], b[i]), c.And(x, carry))
+	}
+	return r, carry
+}
+
+// Add returns a + b modulo 2^len(a).
+func (c *Circuit) Add(a, b BV) BV {
+	r, _ := c.adder(a, b, False)
+	return r
+}
+
+// Sub returns a - b modulo 2^len(a).
+func (c *Circuit) Sub(a, b BV) BV {
+	r, _ := c.adder(a, c.NotBV(b), True)
+	return r
+}
+
+// Mul returns a * b modulo 2^len(a).
+func (c *Circuit) Mul(a, b BV) BV {
+	r := c.Const(0, len(a))
+	for i, bit := range b {
+		if bit == False {
+			continue
+		}
+		partial := c.Const(0, len(a))
+		for j := i; j < len(a); j++ {
+			partial[j] = c.And(a[j-i], bit)
+		}
+		r = c.Add(r, partial)
+	}
+	return r
+}
+
+// ShlConst returns a shifted left by n bits.
+func (c *Circuit) ShlConst(a BV, n uint64) BV {
+	r := c.Const(0, len(a))
+	for i := range r {
+		if uint64(i) >= n {
+			r[i] = a[uint64(i)-n]
+		}
+	}
+	return r
+}
+
+// ShrConst returns a shifted right by n bits.
+func (c *Circuit) ShrConst(a BV, n uint64) BV {
+	r := c.Const(0, len(a))
+	for i := range r {
+		if uint64(i)+n < uint64(len(a)) {
+			r[i] = a[uint64(i)+n]
+		}
+	}
+	return r
+}
+
+// shift returns a shifted by n bits with shiftConst, the result is 0 if n >= len(a).
+func (c *Circuit) shift(a, n BV, shiftConst func(BV, uint64) BV) BV {
+	if val, ok := n.Constant(); ok {
+		return shiftConst(a, val)
+	}
+	r := a
+	tooLarge := False
+	for i, bit := range n {
+		if 1<<uint(i) >= len(a) {
+			tooLarge = c.Or(tooLarge, bit)
+			continue
+		}
+		r = c.MuxBV(bit, shiftConst(r, 1<<uint(i)), r)
+	}
+	return c.MuxBV(tooLarge, c.Const(0, len(a)), r)
+}
+
+// Shl returns a shifted left by n bits, 0 if n >= len(a).
+func (c *Circuit) Shl(a, n BV) BV {
+	return c.shift(a, n, c.ShlConst)
+}
+
+// Shr returns a shifted right by n bits, 0 if n >= len(a).
+func (c *Circuit) Shr(a, n BV) BV {
+	return c.shift(a, n, c.ShrConst)
+}
+
+// DivMod returns the quotient and the remainder of the unsigned division a / d. Both are
+// unconstrained, if d is zero.
+func (c *Circuit) DivMod(a, d BV) (q, r BV) {
+	if val, ok := d.Constant(); ok && val != 0 && val&(val-1) == 0 {
+		shift := uint64(0)
+		for val>>shift != 1 {
+			shift++
+		}
+		return c.ShrConst(a, shift), c.AndBV(a, c.Const(val-1, len(a)))
+	}
+
+	key := a.key() + "/" + d.key()
+	if qr, ok := c.cache[key]; ok {
+		return qr[0], qr[1]
+	}
+
+	// a == q * d + r with r < d, calculated with twice the width to prevent overflows
+	width := len(a)
+	q, r = c.Input(width), c.Input(width)
+	product := c.Mul(c.ZeroExt(q, 2*width), c.ZeroExt(d, 2*width))
+	sum := c.Add(product, c.ZeroExt(r, 2*width))
+	nonZero := c.NonZero(d)
+	c.AddClause(nonZero.Not(), c.Eq(sum, c.ZeroExt(a, 2*width)))
+	c.AddClause(nonZero.Not(), c.Ult(r, d))
+
+	c.cache[key] = []BV{q, r}
+	return q, r
+}
+
+// NonZero returns a literal, which is true if any bit of a is set.
+func (c *Circuit) NonZero(a BV) Lit {
+	r := False
+	for _, bit := range a {
+		r = c.Or(r, bit)
+	}
+	return r
+}
+
+// Eq returns a literal, which is true if a equals b.
+func (c *Circuit) Eq(a, b BV) Lit {
+	return c.NonZero(c.XorBV(a, b)).Not()
+}
+
+// Ult returns a literal, which is true if a is less than b.
+func (c *Circuit) Ult(a, b BV) Lit {
+	// a < b, if a - b borrows, which is the carry of a + ^b + 1
+	carry := True
+	for i := range a {
+		nb := b[i].Not()
+		carry = c.Or(c.And(a[i], nb), c.And(carry, c.Or(a[i], nb)))
+	}
+	return carry.Not()
+}
+
+// Ule returns a literal, which is true if a is less than or equal to b.
+func (c *Circuit) Ule(a, b BV) Lit {
+	return c.Ult(b, a).Not()
+}
@@ -0,0 +1,427 @@
+// Package sat provides a CDCL SAT solver and a builder for boolean and bit vector circuits on
+// top of it. It is used to decide the equivalence of BPF programs.
+package sat
+
+// Lit is a literal, the variable Lit/2 or its negation, if Lit is odd.
+type Lit int32
+
+// The literals of the constant variable 0, which is always true.
+const (
+	True  Lit = 0
+	False Lit = 1
+)
+
+// Not returns the negation of l.
+func (l Lit) Not() Lit {
+	return l ^ 1
+}
+
+func (l Lit) variable() int {
+	return int(l >> 1)
+}
+
+func (l Lit) negated() bool {
+	return l&1 == 1
+}
+
+// Result is the result of Solve.
+type Result int
+
+// Possible Result values
+const (
+	Unknown Result = iota
+	Satisfiable
+	Unsatisfiable
+)
+
+// Solver is a conflict driven clause learning SAT solver with two watched literals,
+// activity based branching, phase saving and restarts.
+type Solver struct {
+	clauses [][]Lit
+	// watches contains for every literal the clauses, which watch it.
+	watches [][]int
+
+	assigns  []int8 // per variable: 0 unassigned, 1 true, -1 false
+	level    []int
+	reason   []int // index of the clause, which implied the variable, -1 for decisions
+	polarity []bool
+	activity []float64
+	seen     []bool
+	order    varHeap
+
+	trail    []Lit
+	trailLim []int
+	qhead    int
+
+	varInc float64
+	unsat  bool
+}
+
+// NewSolver returns a solver, which only knows the constant variable 0.
+func NewSolver() *Solver {
+	s := &Solver{varInc: 1}
+	s.order.activity = &s.activity
+	s.NewVar()
+	s.AddClause(True)
+	return s
+}
+
+// NewVar adds a new variable and returns its positive literal.
+func (s *Solver) NewVar() Lit {
+	v := len(s.assigns)
+	s.assigns = append(s.assigns, 0)
+	s.level = append(s.level, 0)
+	s.reason = append(s.reason, -1)
+	s.polarity = append(s.polarity, false)
+	s.activity = append(s.activity, 0)
+	s.seen = append(s.seen, false)
+	s.watches = append(s.watches, nil, nil)
+	s.order.insert(v)
+	return Lit(2 * v)
+}
+
+// value returns 1 if l is true, -1 if l is false and 0 if l is unassigned.
+func (s *Solver) value(l Lit) int8 {
+	val := s.assigns[l.variable()]
+	if l.negated() {
+		return -val
+	}
+	return val
+}
+
+// Value returns the value of l in the model found by Solve.
+func (s *Solver) Value(l Lit) bool {
+	return s.value(l) > 0
+}
+
+// AddClause adds the disjunction of lits. Clauses must be added before Solve is called.
+func (s *Solver) AddClause(lits ...Lit) {
+	if s.unsat {
+		return
+	}
+
+	var clause []Lit
+	for _, l := range lits {
+		switch s.value(l) {
+		case 1:
+			// the clause is already satisfied
+			return
+		case -1:
+			continue
+		}
+		duplicate := false
+		for _, other := range clause {
+			if other == l.Not() {
+				return
+			}
+			duplicate = duplicate || other == l
+		}
+		if !duplicate {
+			clause = append(clause, l)
+		}
+	}
+
+	switch len(clause) {
+	case 0:
+		s.unsat = true
+	case 1:
+		s.enqueue(clause[0], -1)
+		if s.propagate() >= 0 {
+			s.unsat = true
+		}
+	default:
+		s.attach(clause)
+	}
+}
+
+func (s *Solver) attach(clause []Lit) int {
+	ci := len(s.clauses)
+	s.clauses = append(s.clauses, clause)
+	s.watches[clause[0]] = append(s.watches[clause[0]], ci)
+	s.watches[clause[1]] = append(s.watches[clause[1]], ci)
+	return ci
+}
+
+func (s *Solver) enqueue(l Lit, reason int) {
+	v := l.variable()
+	s.assigns[v] = 1
+	if l.negated() {
+		s.assigns[v] = -1
+	}
+	s.level[v] = len(s.trailLim)
+	s.reason[v] = reason
+	s.trail = append(s.trail, l)
+}
+
+// propagate assigns all literals implied by unit clauses. It returns the index of a
+// conflicting clause or -1.
+func (s *Solver) propagate() int {
+	for s.qhead < len(s.trail) {
+		falseLit := s.trail[s.qhead].Not()
+		s.qhead++
+
+		ws := s.watches[falseLit]
+		j := 0
+		for i := 0; i < len(ws); i++ {
+			ci := ws[i]
+			c := s.clauses[ci]
+			if c[0] == falseLit {
+				c[0], c[1] = c[1], c[0]
+			}
+			if s.value(c[0]) == 1 {
+				ws[j] = ci
+				j++
+				continue
+			}
+
+			moved := false
+			for k := 2; k < len(c); k++ {
+				if s.value(c[k]) != -1 {
+					c[1], c[k] = c[k], c[1]
+					s.watches[c[1]] = append(s.watches[c[1]], ci)
+					moved = true
+					break
+				}
+			}
+			if moved {
+				continue
+			}
+
+			ws[j] = ci
+			j++
+			if s.value(c[0]) == -1 {
+				j += copy(ws[j:], ws[i+1:])
+				s.watches[falseLit] = ws[:j]
+				return ci
+			}
+			s.enqueue(c[0], ci)
+		}
+		s.watches[falseLit] = ws[:j]
+	}
+	return -1
+}
+
+// analyze derives the learnt clause from the conflicting clause confl by resolution up to the
+// first unique implication point. The asserting literal is the first of the learnt clause.
+func (s *Solver) analyze(confl int) (learnt []Lit, backtrack int) {
+	learnt = []Lit{0}
+	pending := 0
+	p := Lit(-1)
+	index := len(s.trail) - 1
+
+	for {
+		c := s.clauses[confl]
+		start := 0
+		if p != -1 {
+			// c[0] is p, which is implied by this clause
+			start = 1
+		}
+		for _, q := range c[start:] {
+			v := q.variable()
+			if s.seen[v] || s.level[v] == 0 {
+				continue
+			}
+			s.bump(v)
+			s.seen[v] = true
+			if s.level[v] == len(s.trailLim) {
+				pending++
+			} else {
+				learnt = append(learnt, q)
+			}
+		}
+
+		for !s.seen[s.trail[index].variable()] {
+			index--
+		}
+		p = s.trail[index]
+		index--
+		s.seen[p.variable()] = false
+		pending--
+		if pending == 0 {
+			break
+		}
+		confl = s.reason[p.variable()]
+	}
+	learnt[0] = p.Not()
+
+	for i := 1; i < len(learnt); i++ {
+		s.seen[learnt[i].variable()] = false
+		if s.level[learnt[i].variable()] > backtrack {
+			backtrack = s.level[learnt[i].variable()]
+			learnt[1], learnt[i] = learnt[i], learnt[1]
+		}
+	}
+	return learnt, backtrack
+}
+
+func (s *Solver) bump(v int) {
+	s.activity[v] += s.varInc
+	if s.activity[v] > 1e100 {
+		for i := range s.activity {
+			s.activity[i] *= 1e-100
+		}
+		s.varInc *= 1e-100
+	}
+	s.order.update(v)
+}
+
+// cancelUntil undoes all assignments above level.
+func (s *Solver) cancelUntil(level int) {
+	if len(s.trailLim) <= level {
+		return
+	}
+	for i := len(s.trail) - 1; i >= s.trailLim[level]; i-- {
+		v := s.trail[i].variable()
+		s.polarity[v] = s.assigns[v] > 0
+		s.assigns[v] = 0
+		s.order.insert(v)
+	}
+	s.trail = s.trail[:s.trailLim[level]]
+	s.trailLim = s.trailLim[:level]
+	s.qhead = len(s.trail)
+}
+
+// Solve searches a model for the added clauses. It gives up with Unknown after maxConflicts
+// conflicts, if maxConflicts is greater than 0.
+func (s *Solver) Solve(maxConflicts int) Result {
+	if s.unsat {
+		return Unsatisfiable
+	}
+
+	conflicts, restart := 0, 0
+	for {
+		limit := 100 * luby(restart)
+		for n := 0; n < limit; {
+			confl := s.propagate()
+			if confl >= 0 {
+				conflicts++
+				n++
+				if len(s.trailLim) == 0 {
+					s.unsat = true
+					return Unsatisfiable
+				}
+				learnt, backtrack := s.analyze(confl)
+				s.cancelUntil(backtrack)
+				if len(learnt) == 1 {
+					s.enqueue(learnt[0], -1)
+				} else {
+					s.enqueue(learnt[0], s.attach(learnt))
+				}
+				s.varInc *= 1 / 0.95
+				if maxConflicts > 0 && conflicts >= maxConflicts {
+					s.cancelUntil(0)
+					return Unknown
+				}
+				continue
+			}
+
+			v := s.order.removeMax(s.assigns)
+			if v < 0 {
+				return Satisfiable
+			}
+			s.trailLim = append(s.trailLim, len(s.trail))
+			l := Lit(2*v + 1)
+			if s.polarity[v] {
+				l = Lit(2 * v)
+			}
+			s.enqueue(l, -1)
+		}
+		s.cancelUntil(0)
+		restart++
+	}
+}
+
+// luby returns the i-th element of the Luby sequence 1, 1, 2, 1, 1, 2, 4, ...
+func luby(i int) int {
+	size, seq := 1, 0
+	for size < i+1 {
+		seq++
+		size = 2*size + 1
+	}
+	for size-1 != i {
+		size = (size - 1) / 2
+		seq--
+		i = i % size
+	}
+	return 1 << uint(seq)
+}
+
+// varHeap is a max heap of variables ordered by activity.
+type varHeap struct {
+	activity *[]float64
+	heap     []int
+	index    []int // position of every variable in heap, -1 if it is not contained
+}
+
+func (h *varHeap) less(i, j int) bool {
+	return (*h.activity)[h.heap[i]] > (*h.activity)[h.heap[j]]
+}
+
+func (h *varHeap) swap(i, j int) {
+	h.heap[i], h.heap[j] = h.heap[j], h.heap[i]
+	h.index[h.heap[i]] = i
+	h.index[h.heap[j]] = j
+}
+
+func (h *varHeap) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !h.less(i, parent) {
+			return
+		}
+		h.swap(i, parent)
+		i = parent
+	}
+}
+
+func (h *varHeap) down(i int) {
+	for {
+		child := 2*i + 1
+		if child >= len(h.heap) {
+			return
+		}
+		if child+1 < len(h.heap) && h.less(child+1, child) {
+			child++
+		}
+		if !h.less(child, i) {
+			return
+		}
+		h.swap(i, child)
+		i = child
+	}
+}
+
+func (h *varHeap) insert(v int) {
+	for len(h.index) <= v {
+		h.index = append(h.index, -1)
+	}
+	if h.index[v] >= 0 {
+		return
+	}
+	h.heap = append(h.heap, v)
+	h.index[v] = len(h.heap) - 1
+	h.up(len(h.heap) - 1)
+}
+
+func (h *varHeap) update(v int) {
+	if v < len(h.index) && h.index[v] >= 0 {
+		h.up(h.index[v])
+	}
+}
+
+// removeMax removes and returns the unassigned variable with the highest activity, -1 if all
+// variables are assigned.
+func (h *varHeap) removeMax(assigns []int8) int {
+	for len(h.heap) > 0 {
+		v := h.heap[0]
+		last := len(h.heap) - 1
+		h.swap(0, last)
+		h.heap = h.heap[:last]
+		h.index[v] = -1
+		h.down(0)
+		if assigns[v] == 0 {
+			return v
+		}
+	}
+	return -1
+}
@@ -0,0 +1,216 @@
+package sat
+
+import (
+	"testing"
+)
+
+func TestSolve(t *testing.T) {
+	cases := []struct {
+		description string
+		clauses     [][]int
+		expect      Result
+	}{
+		{
+			description: "empty",
+			expect:      Satisfiable,
+		},
+		{
+			description: "contradicting units",
+			clauses:     [][]int{{1}, {-1}},
+			expect:      Unsatisfiable,
+		},
+		{
+			description: "implication chain",
+			clauses:     [][]int{{1}, {-1, 2}, {-2, 3}, {-3, 4}},
+			expect:      Satisfiable,
+		},
+		{
+			description: "all assignments of two variables excluded",
+			clauses:     [][]int{{1, 2}, {1, -2}, {-1, 2}, {-1, -2}},
+			expect:      Unsatisfiable,
+		},
+		{
+			// 4 pigeons do not fit into 3 holes
+			description: "pigeon hole",
+			clauses:     pigeonHole(4, 3),
+			expect:      Unsatisfiable,
+		},
+		{
+			description: "pigeon hole with enough holes",
+			clauses:     pigeonHole(4, 4),
+			expect:      Satisfiable,
+		},
+	}
+
+	for _, test := range cases {
+		s := NewSolver()
+		vars := map[int]Lit{}
+		lit := func(n int) Lit {
+			v := n
+			if v < 0 {
+				v = -v
+			}
+			if _, ok := vars[v]; !ok {
+				vars[v] = s.NewVar()
+			}
+			if n < 0 {
+				return vars[v].Not()
+			}
+			return vars[v]
+		}
+		var clauses [][]Lit
+		for _, clause := range test.clauses {
+			var lits []Lit
+			for _, n := range clause {
+				lits = append(lits, lit(n))
+			}
+			clauses = append(clauses, lits)
+			s.AddClause(lits...)
+		}
+
+		got := s.Solve(0)
+		if got != test.expect {
+			t.Errorf("case '%s': got %d, expected %d", test.description, got, test.expect)
+			continue
+		}
+		if got != Satisfiable {
+			continue
+		}
+		for _, clause := range clauses {
+			satisfied := false
+			for _, l := range clause {
+				satisfied = satisfied || s.Value(l)
+			}
+			if !satisfied {
+				t.Errorf("case '%s': model does not satisfy clause %v", test.description, clause)
+			}
+		}
+	}
+}
+
+// pigeonHole returns the clauses for placing pigeons into holes with at most one pigeon per hole.
+func pigeonHole(pigeons, holes int) [][]int {
+	v := func(p, h int) int {
+		return p*holes + h + 1
+	}
+	var clauses [][]int
+	for p := 0; p < pigeons; p++ {
+		var clause []int
+		for h := 0; h < holes; h++ {
+			clause = append(clause, v(p, h))
+		}
+		clauses = append(clauses, clause)
+	}
+	for h := 0; h < holes; h++ {
+		for p := 0; p < pigeons; p++ {
+			for q := p + 1; q < pigeons; q++ {
+				clauses = append(clauses, []int{-v(p, h), -v(q, h)})
+			}
+		}
+	}
+	return clauses
+}
+
+func TestCircuit(t *testing.T) {
+	ops := []struct {
+		description string
+		build       func(c *Circuit, a, b BV) BV
+		eval        func(a, b uint32) uint32
+	}{
+		{
+			description: "add",
+			build:       (*Circuit).Add,
+			eval:        func(a, b uint32) uint32 { return a + b },
+		},
+		{
+			description: "sub",
+			build:       (*Circuit).Sub,
+			eval:        func(a, b uint32) uint32 { return a - b },
+		},
+		{
+			description: "mul",
+			build:       (*Circuit).Mul,
+			eval:        func(a, b uint32) uint32 { return a * b },
+		},
+		{
+			description: "div",
+			build: func(c *Circuit, a, b BV) BV {
+				q, _ := c.DivMod(a, b)
+				return q
+			},
+			eval: func(a, b uint32) uint32 { return a / b },
+		},
+		{
+			description: "mod",
+			build: func(c *Circuit, a, b BV) BV {
+				_, r := c.DivMod(a, b)
+				return r
+			},
+			eval: func(a, b uint32) uint32 { return a % b },
+		},
+		{
+			description: "shl",
+			build:       (*Circuit).Shl,
+			eval:        func(a, b uint32) uint32 { return a << b },
+		},
+		{
+			description: "shr",
+			build:       (*Circuit).Shr,
+			eval:        func(a, b uint32) uint32 { return a >> b },
+		},
+	}
+	values := [][2]uint32{{0, 1}, {1, 1}, {7, 3}, {0xffffffff, 2}, {0x12345678, 31}, {0x80000000, 32}, {100, 0x10}, {5, 0xffffffff}}
+
+	for _, op := range ops {
+		for _, val := range values {
+			// the operands are inputs fixed by unit clauses, so the result is derived by the solver
+			c := NewCircuit()
+			a, b := c.Input(32), c.Input(32)
+			c.AddClause(c.Eq(a, c.Const(uint64(val[0]), 32)))
+			c.AddClause(c.Eq(b, c.Const(uint64(val[1]), 32)))
+			r := op.build(c, a, b)
+			if got := c.Solve(0); got != Satisfiable {
+				t.Errorf("%s %#x %#x: got %d, expected satisfiable", op.description, val[0], val[1], got)
+				continue
+			}
+			if got, expect := uint32(c.Value(r)), op.eval(val[0], val[1]); got != expect {
+				t.Errorf("%s %#x %#x: got %#x, expected %#x", op.description, val[0], val[1], got, expect)
+			}
+		}
+	}
+}
+
+func TestCircuitCompare(t *testing.T) {
+	c := NewCircuit()
+	a := c.Input(8)
+
+	// a < 10 and a > 9 is not satisfiable
+	c.AddClause(c.Ult(a, c.Const(10, 8)))
+	c.AddClause(c.Ult(c.Const(9, 8), a))
+	if got := c.Solve(0); got != Unsatisfiable {
+		t.Errorf("got %d, expected unsatisfiable", got)
+	}
+
+	c = NewCircuit()
+	a = c.Input(8)
+	c.AddClause(c.Ule(c.Const(200, 8), a))
+	c.AddClause(c.Eq(c.AndBV(a, c.Const(0x0f, 8)), c.Const(0x0e, 8)))
+	if got := c.Solve(0); got != Satisfiable {
+		t.Fatalf("got %d, expected satisfiable", got)
+	}
+	if val := c.Value(a); val < 200 || val&0x0f != 0x0e {
+		t.Errorf("got %d, expected a value >= 200 with the low nibble 0xe", val)
+	}
+}
+
+func TestCircuitStructuralHashing(t *testing.T) {
+	c := NewCircuit()
+	a, b := c.Input(16), c.Input(16)
+
+	if c.Eq(c.Add(a, b), c.Add(a, b)) != True {
+		t.Errorf("equal expressions are not folded")
+	}
+	if l := c.And(a[0], a[0].Not()); l != False {
+		t.Errorf("got %d for a contradiction, expected false", l)
+	}
+}
@@ -0,0 +1,101 @@
+package bpfutils
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/gopacket/pcap"
+
+	"golang.org/x/net/bpf"
+)
+
+// FilterManager replaces the BPF filter of a live pcap handle or socket at runtime.
+//
+// Every Update compiles and verifies the new filter before it is handed to the kernel with a
+// single call, which replaces the attached filter atomically, so there is no window without a
+// filter or with a partially applied filter. The previously applied filter is kept for Rollback.
+//
+// The methods of FilterManager are safe for concurrent use.
+type FilterManager struct {
+	mu       sync.Mutex
+	set      func(raw []bpf.RawInstruction) error
+	current  []bpf.Instruction
+	previous []bpf.Instruction
+}
+
+// NewPcapFilterManager returns a FilterManager for handle.
+//
+// On Linux, libpcap replaces the filter of a live capture with SO_ATTACH_FILTER. Packets
+// already queued in the capture buffer at the time of the Update may have been matched by
+// the previous filter.
+func NewPcapFilterManager(handle *pcap.Handle) *FilterManager {
+	return &FilterManager{
+		set: func(raw []bpf.RawInstruction) error {
+			if err := handle.SetBPFInstructionFilter(ToPcapBPFInstructions(raw)); err != nil {
+				return fmt.Errorf("failed to set filter: %s", err.Error())
+			}
+			return nil
+		},
+	}
+}
+
+// Update compiles expr with CompileExpr, verifies the resulting program with Verify and
+// replaces the current filter with it. If an error is returned, the current filter is
+// left in place.
+func (m *FilterManager) Update(expr FilterExpr) error {
+	prog := CompileExpr(expr)
+	if prog == nil {
+		return fmt.Errorf("failed to compile filter expression")
+	}
+	if diags := Verify(prog); diags != nil {
+		return fmt.Errorf("invalid filter: %s", diags[0])
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.apply(prog); err != nil {
+		return err
+	}
+	m.previous, m.current = m.current, prog
+	return nil
+}
+
+// Rollback restores the filter, which was in place before the last Update or Rollback.
+// Calling Rollback twice restores the current filter again.
+func (m *FilterManager) Rollback() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.previous == nil {
+		return fmt.Errorf("no previous filter")
+	}
+	if err := m.apply(m.previous); err != nil {
+		return err
+	}
+	m.previous, m.current = m.current, m.previous
+	return nil
+}
+
+// Current returns the filter applied by the last Update or Rollback, nil if there is none.
+func (m *FilterManager) Current() []bpf.Instruction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+// Previous returns the filter, which is restored by Rollback, nil if there is none.
+func (m *FilterManager) Previous() []bpf.Instruction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.previous
+}
+
+// apply hands prog to the kernel, the caller must hold m.mu.
+func (m *FilterManager) apply(prog []bpf.Instruction) error {
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return fmt.Errorf("failed to assemble filter: %s", err.Error())
+	}
+	return m.set(raw)
+}
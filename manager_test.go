@@ -0,0 +1,66 @@
+package bpfutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestFilterManager(t *testing.T) {
+	handle, err := pcap.OpenOffline("pcap/test_loopback.pcap")
+	if err != nil {
+		t.Fatalf("failed to open pcap handle: %s", err.Error())
+	}
+	defer handle.Close()
+
+	long := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 500, SkipFalse: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	}
+	short := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 100, SkipFalse: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	}
+
+	m := NewPcapFilterManager(handle)
+	if err := m.Rollback(); err == nil {
+		t.Errorf("expected error for rollback without previous filter")
+	}
+
+	if err := m.Update(Filter(long)); err != nil {
+		t.Fatalf("failed to update with error: %s", err.Error())
+	}
+	if err := m.Update(Or(Filter(long), Filter(short))); err != nil {
+		t.Fatalf("failed to update with error: %s", err.Error())
+	}
+	if got, expect := m.Previous(), CompileExpr(Filter(long)); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got previous filter:\n%s\nexpected:\n%s", AsmString(got), AsmString(expect))
+	}
+
+	// an invalid filter leaves the current filter in place
+	current := m.Current()
+	invalid := []bpf.Instruction{bpf.ALUOpConstant{Op: bpf.ALUOpDiv, Val: 0}, bpf.RetA{}}
+	if err := m.Update(Filter(invalid)); err == nil {
+		t.Errorf("expected error for invalid filter")
+	}
+	if got := m.Current(); !reflect.DeepEqual(got, current) {
+		t.Errorf("got current filter after failed update:\n%s\nexpected:\n%s", AsmString(got), AsmString(current))
+	}
+
+	if err := m.Rollback(); err != nil {
+		t.Fatalf("failed to roll back with error: %s", err.Error())
+	}
+	if got, expect := m.Current(), CompileExpr(Filter(long)); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got current filter after rollback:\n%s\nexpected:\n%s", AsmString(got), AsmString(expect))
+	}
+	if got := m.Previous(); !reflect.DeepEqual(got, current) {
+		t.Errorf("got previous filter after rollback:\n%s\nexpected:\n%s", AsmString(got), AsmString(current))
+	}
+}
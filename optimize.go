@@ -0,0 +1,470 @@
+package bpfutils
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils/internal/reloc"
+)
+
+// sockFilterSize is the size of a single instruction in the kernel (struct sock_filter).
+const sockFilterSize = 8
+
+// maxOptimizeRounds limits the number of times the optimization passes are repeated.
+const maxOptimizeRounds = 16
+
+// OptimizeReport summarizes the result of Optimize.
+type OptimizeReport struct {
+	// Before and After are the number of instructions of the program.
+	Before, After int
+}
+
+// BytesSaved returns the number of bytes saved in the kernel representation of the program.
+func (r OptimizeReport) BytesSaved() int {
+	return (r.Before - r.After) * sockFilterSize
+}
+
+// String returns a short summary of the optimization.
+func (r OptimizeReport) String() string {
+	return fmt.Sprintf("%d -> %d instructions, %d bytes saved", r.Before, r.After, r.BytesSaved())
+}
+
+// Optimize returns a semantically equivalent, but shorter version of prog.
+// For details see OptimizeWithReport.
+func Optimize(prog []bpf.Instruction) []bpf.Instruction {
+	optimized, _ := OptimizeWithReport(prog)
+	return optimized
+}
+
+// OptimizeWithReport optimizes prog and returns the optimized program together with a report.
+// The following passes are repeated until the program does not change anymore:
+// * jump threading, jumps to unconditional jumps or to a `ret` are shortcut
+// * constant propagation over A, X and M[], jumps with a known outcome become unconditional
+// * dead code elimination of instructions without side effects, whose results are never read
+// * merging of identical return blocks, sequences of instructions without jumps ending with a `ret`
+// * removal of unreachable instructions and of jumps to the following instruction
+//
+// Programs, which do not pass Verify, are returned unchanged.
+func OptimizeWithReport(prog []bpf.Instruction) ([]bpf.Instruction, OptimizeReport) {
+	optimized := append([]bpf.Instruction(nil), prog...)
+	if Verify(prog) != nil {
+		return optimized, OptimizeReport{Before: len(prog), After: len(prog)}
+	}
+
+	for round := 0; round < maxOptimizeRounds; round++ {
+		nodes := decodeNodes(optimized)
+		threadJumps(nodes)
+		propagateConstants(nodes)
+		eliminateDeadCode(nodes)
+		mergeTails(nodes)
+		removeUnreachable(nodes)
+		next := encodeNodes(nodes)
+
+		// The scratch memory check of the kernel is less precise than the analysis of the
+		// optimizer, never return a program, which would be rejected.
+		if len(next) > len(optimized) || Verify(next) != nil || reflect.DeepEqual(next, optimized) {
+			break
+		}
+		optimized = next
+	}
+
+	return optimized, OptimizeReport{Before: len(prog), After: len(optimized)}
+}
+
+// optNode is an instruction with the absolute indexes of its jump targets.
+type optNode struct {
+	inst    bpf.Instruction
+	jt, jf  int
+	removed bool
+}
+
+func decodeNodes(prog []bpf.Instruction) []optNode {
+	nodes := make([]optNode, len(prog))
+	for i, instr := range prog {
+		nodes[i].inst = instr
+		switch inst := instr.(type) {
+		case bpf.Jump:
+			nodes[i].jt = i + 1 + int(inst.Skip)
+		case bpf.JumpIf:
+			nodes[i].jt = i + 1 + int(inst.SkipTrue)
+			nodes[i].jf = i + 1 + int(inst.SkipFalse)
+		case bpf.JumpIfX:
+			nodes[i].jt = i + 1 + int(inst.SkipTrue)
+			nodes[i].jf = i + 1 + int(inst.SkipFalse)
+		}
+	}
+	return nodes
+}
+
+// encodeNodes converts nodes back into a program. A removed node is transparent,
+// jumps to a removed node continue with the following node.
+func encodeNodes(nodes []optNode) []bpf.Instruction {
+	p := &reloc.Program{}
+	labels := p.NewLabels(len(nodes) + 1)
+	for i, n := range nodes {
+		p.Mark(labels[i])
+		if n.removed {
+			continue
+		}
+		switch inst := n.inst.(type) {
+		case bpf.Jump:
+			p.Jump(labels[n.jt])
+		case bpf.JumpIf:
+			p.JumpIf(inst.Cond, inst.Val, labels[n.jt], labels[n.jf])
+		case bpf.JumpIfX:
+			p.JumpIfX(inst.Cond, labels[n.jt], labels[n.jf])
+		default:
+			p.Append(n.inst)
+		}
+	}
+	p.Mark(labels[len(nodes)])
+	return p.Instructions()
+}
+
+func isJump(inst bpf.Instruction) bool {
+	_, ok := inst.(bpf.Jump)
+	return ok || reloc.IsConditionalJump(inst)
+}
+
+// successors returns the indexes of the nodes, which may be executed after node i.
+func successors(nodes []optNode, i int) []int {
+	switch nodes[i].inst.(type) {
+	case bpf.Jump:
+		return []int{nodes[i].jt}
+	case bpf.JumpIf, bpf.JumpIfX:
+		return []int{nodes[i].jt, nodes[i].jf}
+	case bpf.RetA, bpf.RetConstant:
+		return nil
+	}
+	return []int{i + 1}
+}
+
+// resolve returns the first node, which is not removed, starting at node i.
+func resolve(nodes []optNode, i int) int {
+	for i < len(nodes) && nodes[i].removed {
+		i++
+	}
+	return i
+}
+
+func threadJumps(nodes []optNode) {
+	final := func(t int) int {
+		for t = resolve(nodes, t); t < len(nodes); t = resolve(nodes, nodes[t].jt) {
+			if _, ok := nodes[t].inst.(bpf.Jump); !ok {
+				break
+			}
+		}
+		return t
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		if n.removed || !isJump(n.inst) {
+			continue
+		}
+		n.jt = final(n.jt)
+		if _, ok := n.inst.(bpf.Jump); ok {
+			if n.jt < len(nodes) && isReturn(nodes[n.jt].inst) {
+				n.inst = nodes[n.jt].inst
+			}
+			continue
+		}
+		n.jf = final(n.jf)
+		if n.jt == n.jf {
+			n.inst = bpf.Jump{}
+		}
+	}
+}
+
+// constState is the knowledge about the registers and the scratch memory at an instruction.
+type constState struct {
+	known uint32 // bit 0: A, bit 1: X, bit 2+n: M[n]
+	vals  [18]uint32
+}
+
+const (
+	regA = 0
+	regX = 1
+)
+
+func (s *constState) get(reg int) (uint32, bool) {
+	return s.vals[reg], s.known&(1<<uint(reg)) != 0
+}
+
+func (s *constState) set(reg int, val uint32) {
+	s.known |= 1 << uint(reg)
+	s.vals[reg] = val
+}
+
+func (s *constState) unset(reg int) {
+	s.known &^= 1 << uint(reg)
+}
+
+func (s *constState) copy(dst, src int) {
+	if val, ok := s.get(src); ok {
+		s.set(dst, val)
+	} else {
+		s.unset(dst)
+	}
+}
+
+// meet combines the knowledge of two paths, only values known and identical on both
+// paths are kept.
+func (s *constState) meet(o *constState) {
+	for reg := range s.vals {
+		if a, ok := s.get(reg); ok {
+			if b, ok := o.get(reg); !ok || a != b {
+				s.unset(reg)
+			}
+		}
+	}
+}
+
+func register(r bpf.Register) int {
+	if r == bpf.RegX {
+		return regX
+	}
+	return regA
+}
+
+func propagateConstants(nodes []optNode) {
+	in := make([]*constState, len(nodes)+1)
+	in[0] = &constState{}
+
+	flow := func(t int, s constState) {
+		if in[t] == nil {
+			in[t] = &s
+			return
+		}
+		in[t].meet(&s)
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		if in[i] == nil {
+			// unreachable
+			continue
+		}
+		s := *in[i]
+		if n.removed {
+			flow(i+1, s)
+			continue
+		}
+
+		a, aKnown := s.get(regA)
+		x, xKnown := s.get(regX)
+
+		switch inst := n.inst.(type) {
+		case bpf.ALUOpConstant:
+			if aKnown {
+				if val, err := alu(inst.Op, a, inst.Val); err == nil {
+					s.set(regA, val)
+					break
+				}
+			}
+			s.unset(regA)
+		case bpf.ALUOpX:
+			if xKnown {
+				if x == 0 && (inst.Op == bpf.ALUOpDiv || inst.Op == bpf.ALUOpMod) {
+					n.inst = bpf.RetConstant{Val: 0}
+					continue
+				}
+				// The kernel rejects constant shifts by 32 or more
+				if (inst.Op != bpf.ALUOpShiftLeft && inst.Op != bpf.ALUOpShiftRight) || x < 32 {
+					n.inst = bpf.ALUOpConstant{Op: inst.Op, Val: x}
+				}
+			}
+			if aKnown && xKnown {
+				if val, err := alu(inst.Op, a, x); err == nil {
+					s.set(regA, val)
+					break
+				}
+			}
+			s.unset(regA)
+		case bpf.NegateA:
+			if aKnown {
+				s.set(regA, -a)
+			}
+		case bpf.JumpIf:
+			if aKnown {
+				if taken, err := jumpTest(inst.Cond, a, inst.Val); err == nil {
+					n.inst = bpf.Jump{}
+					if !taken {
+						n.jt = n.jf
+					}
+				}
+			}
+		case bpf.JumpIfX:
+			if xKnown {
+				n.inst = bpf.JumpIf{Cond: inst.Cond, Val: x}
+				if aKnown {
+					if taken, err := jumpTest(inst.Cond, a, x); err == nil {
+						n.inst = bpf.Jump{}
+						if !taken {
+							n.jt = n.jf
+						}
+					}
+				}
+			}
+		case bpf.LoadAbsolute, bpf.LoadIndirect, bpf.LoadExtension:
+			s.unset(regA)
+		case bpf.LoadMemShift:
+			s.unset(regX)
+		case bpf.LoadConstant:
+			s.set(register(inst.Dst), inst.Val)
+		case bpf.LoadScratch:
+			s.copy(register(inst.Dst), 2+inst.N)
+		case bpf.StoreScratch:
+			s.copy(2+inst.N, register(inst.Src))
+		case bpf.TAX:
+			s.copy(regX, regA)
+		case bpf.TXA:
+			s.copy(regA, regX)
+		case bpf.RetA:
+			if aKnown {
+				n.inst = bpf.RetConstant{Val: a}
+			}
+		}
+
+		for _, t := range successors(nodes, i) {
+			flow(t, s)
+		}
+	}
+}
+
+// uses returns the registers (as bit set, see constState) read by inst and defs the
+// registers written by inst. pure is true, if inst has no side effect besides writing defs.
+func uses(inst bpf.Instruction) (use, def uint32, pure bool) {
+	const a, x = 1 << regA, 1 << regX
+	switch inst := inst.(type) {
+	case bpf.ALUOpConstant:
+		return a, a, true
+	case bpf.ALUOpX:
+		return a | x, a, inst.Op != bpf.ALUOpDiv && inst.Op != bpf.ALUOpMod
+	case bpf.NegateA:
+		return a, a, true
+	case bpf.JumpIf, bpf.RetA:
+		return a, 0, false
+	case bpf.JumpIfX:
+		return a | x, 0, false
+	case bpf.LoadAbsolute:
+		return 0, a, false
+	case bpf.LoadIndirect:
+		return x, a, false
+	case bpf.LoadMemShift:
+		return 0, x, false
+	case bpf.LoadExtension:
+		return 0, a, true
+	case bpf.LoadConstant:
+		return 0, 1 << uint(register(inst.Dst)), true
+	case bpf.LoadScratch:
+		return 1 << uint(2+inst.N), 1 << uint(register(inst.Dst)), true
+	case bpf.StoreScratch:
+		return 1 << uint(register(inst.Src)), 1 << uint(2+inst.N), true
+	case bpf.TAX:
+		return a, x, true
+	case bpf.TXA:
+		return x, a, true
+	}
+	return 0, 0, false
+}
+
+// eliminateDeadCode removes instructions without side effects, whose results are never used.
+func eliminateDeadCode(nodes []optNode) {
+	liveIn := make([]uint32, len(nodes)+1)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := &nodes[i]
+		if n.removed {
+			liveIn[i] = liveIn[i+1]
+			continue
+		}
+
+		var liveOut uint32
+		for _, t := range successors(nodes, i) {
+			liveOut |= liveIn[t]
+		}
+
+		use, def, pure := uses(n.inst)
+		if pure && def&liveOut == 0 {
+			n.removed = true
+			liveIn[i] = liveOut
+			continue
+		}
+		liveIn[i] = liveOut&^def | use
+	}
+}
+
+// mergeTails redirects jumps to a return block to the last identical return block of the
+// program. A return block is a sequence of instructions without jumps ending with a `ret`.
+func mergeTails(nodes []optNode) {
+	type tailKey struct {
+		inst bpf.Instruction
+		// next is the canonical index of the rest of the block, -1 for the final `ret`
+		next int
+	}
+	canonical := make(map[tailKey]int)
+
+	// tail is the canonical index of the return block starting at node i, -1 if there is none
+	tail := make([]int, len(nodes)+1)
+	tail[len(nodes)] = -1
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		switch {
+		case n.removed:
+			tail[i] = tail[i+1]
+			continue
+		case isReturn(n.inst):
+			key := tailKey{inst: n.inst, next: -1}
+			if _, ok := canonical[key]; !ok {
+				canonical[key] = i
+			}
+			tail[i] = canonical[key]
+		case !isJump(n.inst) && tail[i+1] >= 0:
+			key := tailKey{inst: n.inst, next: tail[i+1]}
+			if _, ok := canonical[key]; !ok {
+				canonical[key] = i
+			}
+			tail[i] = canonical[key]
+		default:
+			tail[i] = -1
+		}
+	}
+
+	redirect := func(t int) int {
+		if tail[t] >= 0 {
+			return tail[t]
+		}
+		return t
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		if n.removed || !isJump(n.inst) {
+			continue
+		}
+		n.jt = redirect(n.jt)
+		if reloc.IsConditionalJump(n.inst) {
+			n.jf = redirect(n.jf)
+		}
+	}
+}
+
+func removeUnreachable(nodes []optNode) {
+	reachable := make([]bool, len(nodes)+1)
+	reachable[0] = true
+	for i := range nodes {
+		if !reachable[i] {
+			nodes[i].removed = true
+			continue
+		}
+		if nodes[i].removed {
+			reachable[i+1] = true
+			continue
+		}
+		for _, t := range successors(nodes, i) {
+			reachable[t] = true
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package bpfutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestOptimize(t *testing.T) {
+	cases := []struct {
+		description string
+		prog        string
+		expected    string
+	}{
+		{
+			description: "unreachable code",
+			prog: `
+				ret #0
+				ld #1
+				ret a`,
+			expected: `
+				ret #0`,
+		},
+		{
+			description: "jump threading",
+			prog: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l1:	ja l3
+			l2:	ret #0
+			l3:	ja l4
+				ret #1
+			l4:	ret #2`,
+			expected: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l2:	ret #0
+			l1:	ret #2`,
+		},
+		{
+			description: "identical branches",
+			prog: `
+				ldh [12]
+				jeq #0x800, l1, l1
+			l1:	ret #1`,
+			expected: `
+				ldh [12]
+				ret #1`,
+		},
+		{
+			description: "constant jump",
+			prog: `
+				ld #5
+				jeq #5, l1, l2
+			l1:	ret #1
+			l2:	ret #0`,
+			expected: `
+				ret #1`,
+		},
+		{
+			description: "constant ret a",
+			prog: `
+				ldh [12]
+				ld #42
+				add #8
+				ret a`,
+			expected: `
+				ldh [12]
+				ret #50`,
+		},
+		{
+			description: "constant scratch memory and x",
+			prog: `
+				ld #0x800
+				st M[3]
+				ldh [12]
+				ldx M[3]
+				txa
+				jgt #0x700, l1, l2
+			l1:	ret #1
+			l2:	ret #0`,
+			expected: `
+				ldh [12]
+				ret #1`,
+		},
+		{
+			description: "constant division by x zero",
+			prog: `
+				ldh [12]
+				ldx #0
+				div x
+				ret a`,
+			expected: `
+				ldh [12]
+				ret #0`,
+		},
+		{
+			description: "ret a on every path",
+			prog: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l1:	ld #1
+				ja l3
+			l2:	ld #2
+			l3:	ret a`,
+			expected: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l1:	ret #1
+			l2:	ret #2`,
+		},
+		{
+			description: "unknown after merge",
+			prog: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l1:	ld #1
+				ja l3
+			l2:	ld #2
+			l3:	tax
+				ldh [14]
+				add x
+				ret a`,
+			expected: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l1:	ld #1
+				ja l3
+			l2:	ld #2
+			l3:	tax
+				ldh [14]
+				add x
+				ret a`,
+		},
+		{
+			description: "loads are kept",
+			prog: `
+				ldh [12]
+				ldx 4*([14]&0xf)
+				ld [x+16]
+				ret #1`,
+			expected: `
+				ldh [12]
+				ldx 4*([14]&0xf)
+				ld [x+16]
+				ret #1`,
+		},
+		{
+			description: "merge returns",
+			prog: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l1:	ret #0
+			l2:	jeq #0x86dd, l3, l4
+			l3:	ret #65535
+			l4:	ret #0`,
+			expected: `
+				ldh [12]
+				jeq #0x800, l4, l2
+			l2:	jeq #0x86dd, l3, l4
+			l3:	ret #65535
+			l4:	ret #0`,
+		},
+		{
+			description: "merge return blocks",
+			prog: `
+				ldh [12]
+				jeq #0x800, l1, l2
+			l1:	ldh [16]
+				ret a
+			l2:	jeq #0x86dd, l3, l4
+			l3:	ldh [18]
+				ret a
+			l4:	ldh [16]
+				ret a`,
+			expected: `
+				ldh [12]
+				jeq #0x800, l4, l2
+			l2:	jeq #0x86dd, l3, l4
+			l3:	ldh [18]
+				ret a
+			l4:	ldh [16]
+				ret a`,
+		},
+	}
+
+	for _, test := range cases {
+		prog, err := ParseAsm(strings.NewReader(test.prog))
+		if err != nil {
+			t.Fatalf("case '%s': failed to parse program: %s", test.description, err.Error())
+		}
+		expected, err := ParseAsm(strings.NewReader(test.expected))
+		if err != nil {
+			t.Fatalf("case '%s': failed to parse expected program: %s", test.description, err.Error())
+		}
+
+		got, report := OptimizeWithReport(prog)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("case '%s': got:\n%s\nexpected:\n%s", test.description, AsmString(got), AsmString(expected))
+		}
+		if report.Before != len(prog) || report.After != len(got) {
+			t.Errorf("case '%s': report %s, expected %d -> %d instructions", test.description, report, len(prog), len(got))
+		}
+	}
+}
+
+func TestOptimizeJumpIfX(t *testing.T) {
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.LoadConstant{Dst: bpf.RegX, Val: 0x800},
+		bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+	expected := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	if got := Optimize(prog); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got:\n%#v\nexpected:\n%#v", got, expected)
+	}
+}
+
+func TestOptimizeInvalid(t *testing.T) {
+	prog := []bpf.Instruction{
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 1},
+		bpf.Jump{Skip: 10},
+		bpf.RetA{},
+	}
+
+	got, report := OptimizeWithReport(prog)
+	if !reflect.DeepEqual(got, prog) {
+		t.Errorf("got:\n%s\nexpected unchanged program", AsmString(got))
+	}
+	if report.BytesSaved() != 0 {
+		t.Errorf("got %d bytes saved, expected 0", report.BytesSaved())
+	}
+}
+
+func TestOptimizeReport(t *testing.T) {
+	report := OptimizeReport{Before: 12, After: 9}
+	if got, expected := report.BytesSaved(), 24; got != expected {
+		t.Errorf("got %d bytes saved, expected %d", got, expected)
+	}
+	if got, expected := report.String(), "12 -> 9 instructions, 24 bytes saved"; got != expected {
+		t.Errorf("got '%s', expected '%s'", got, expected)
+	}
+}
+
+func TestOptimizeSemantics(t *testing.T) {
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	progs := map[string][]bpf.Instruction{}
+	for nameA, a := range loopbackFilters {
+		progs[nameA] = a
+		for nameB, b := range loopbackFilters {
+			progs[nameA+" AND "+nameB] = ChainFilter(a, b, AND)
+			progs[nameA+" OR "+nameB] = ChainFilter(a, b, OR)
+			progs[nameA+" XOR "+nameB] = ChainFilter(a, b, XOR)
+		}
+	}
+
+	var saved int
+	for name, prog := range progs {
+		got, report := OptimizeWithReport(prog)
+		saved += report.BytesSaved()
+
+		if report.After > report.Before {
+			t.Errorf("'%s': optimized program is longer: %s", name, report)
+		}
+		if diags := Verify(got); diags != nil {
+			t.Errorf("'%s': optimized program does not verify: %v\n%s", name, diags, AsmString(got))
+			continue
+		}
+		for i, packet := range packets {
+			if got, expect := runFilter(t, got, packet), runFilter(t, prog, packet); got != expect {
+				t.Errorf("'%s': packet %d returned %d, expected %d", name, i, got, expect)
+			}
+		}
+	}
+
+	if saved == 0 {
+		t.Errorf("no bytes saved for chained filters")
+	}
+}
@@ -0,0 +1,293 @@
+// Package pcapfilter compiles filter expressions in the syntax of pcap-filter(7), as used by
+// tcpdump, into classic BPF programs. In contrast to pcap.CompileBPFFilter it is written in
+// pure Go and does neither need libpcap nor cgo.
+//
+// The following subset of the syntax is supported:
+//
+// * the protocols ether, ip, ip6, arp, rarp, tcp, udp, sctp, icmp and icmp6
+// * host, net (with prefix length, mask or abbreviated), port and portrange with the directions src and dst
+// * ether host, ether proto, ip proto, ip6 proto and proto
+// * vlan with optional VLAN ID, greater and less
+// * relations like `ip[9] == 6` or `tcp[13] & 2 != 0`, with arithmetic operators and `len`
+// * and, or, not (&&, ||, !) and parentheses, and and or have the same precedence
+// * qualifier inheritance, e.g. `port 80 or 443`
+//
+// Host names and service names are not resolved, only addresses and numbers are allowed.
+package pcapfilter
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils/internal/reloc"
+)
+
+// Compile compiles expr into a BPF program for packets with linkType, which is either
+// layers.LinkTypeEthernet or layers.LinkTypeRaw (IPv4 or IPv6 without link layer header).
+// Matching packets are accepted with snaplen, like pcap.CompileBPFFilter does. An empty
+// expression accepts all packets.
+func Compile(expr string, linkType layers.LinkType, snaplen int) ([]bpf.Instruction, error) {
+	if linkType != layers.LinkTypeEthernet && linkType != layers.LinkTypeRaw {
+		return nil, fmt.Errorf("unsupported link type %s", linkType)
+	}
+
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	var n node = constNode(true)
+	if len(tokens) > 0 {
+		p := &parser{tokens: tokens, end: len(expr), linkType: linkType}
+		if n, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.tokens) {
+			return nil, p.errorf(p.peek(), "unexpected %s", describe(p.peek()))
+		}
+	}
+
+	c := &compiler{p: &reloc.Program{}}
+	accept, reject := c.p.NewLabel(), c.p.NewLabel()
+	n.compile(c, accept, reject)
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if c.p.Referenced(accept) {
+		c.p.Mark(accept)
+		c.p.Append(bpf.RetConstant{Val: uint32(snaplen)})
+	}
+	if c.p.Referenced(reject) {
+		c.p.Mark(reject)
+		c.p.Append(bpf.RetConstant{Val: 0})
+	}
+	return c.p.Instructions(), nil
+}
+
+type compiler struct {
+	p *reloc.Program
+	// scratch is the number of scratch memory slots in use
+	scratch int
+	err     error
+}
+
+// alloc returns a free scratch memory slot, which must be released with free.
+func (c *compiler) alloc() int {
+	if c.scratch == 16 && c.err == nil {
+		c.err = fmt.Errorf("expression too complex, out of scratch memory")
+	}
+	c.scratch++
+	return (c.scratch - 1) % 16
+}
+
+func (c *compiler) free() {
+	c.scratch--
+}
+
+// node is a boolean expression, which is compiled into jumps to the label onTrue or onFalse.
+type node interface {
+	compile(c *compiler, onTrue, onFalse int)
+}
+
+type constNode bool
+
+func (n constNode) compile(c *compiler, onTrue, onFalse int) {
+	if n {
+		c.p.Jump(onTrue)
+		return
+	}
+	c.p.Jump(onFalse)
+}
+
+type andNode []node
+
+// and returns a node, which is true if all nodes are true. Constant nodes are folded.
+func and(nodes ...node) node {
+	var n andNode
+	for _, node := range nodes {
+		switch node := node.(type) {
+		case constNode:
+			if !node {
+				return node
+			}
+		case andNode:
+			n = append(n, node...)
+		default:
+			n = append(n, node)
+		}
+	}
+	if len(n) == 0 {
+		return constNode(true)
+	}
+	if len(n) == 1 {
+		return n[0]
+	}
+	return n
+}
+
+func (n andNode) compile(c *compiler, onTrue, onFalse int) {
+	for _, node := range n[:len(n)-1] {
+		next := c.p.NewLabel()
+		node.compile(c, next, onFalse)
+		c.p.Mark(next)
+	}
+	n[len(n)-1].compile(c, onTrue, onFalse)
+}
+
+type orNode []node
+
+// or returns a node, which is true if at least one of nodes is true. Constant nodes are folded.
+func or(nodes ...node) node {
+	var n orNode
+	for _, node := range nodes {
+		switch node := node.(type) {
+		case constNode:
+			if node {
+				return node
+			}
+		case orNode:
+			n = append(n, node...)
+		default:
+			n = append(n, node)
+		}
+	}
+	if len(n) == 0 {
+		return constNode(false)
+	}
+	if len(n) == 1 {
+		return n[0]
+	}
+	return n
+}
+
+func (n orNode) compile(c *compiler, onTrue, onFalse int) {
+	for _, node := range n[:len(n)-1] {
+		next := c.p.NewLabel()
+		node.compile(c, onTrue, next)
+		c.p.Mark(next)
+	}
+	n[len(n)-1].compile(c, onTrue, onFalse)
+}
+
+type notNode struct {
+	n node
+}
+
+func not(n node) node {
+	if n, ok := n.(constNode); ok {
+		return !n
+	}
+	return notNode{n: n}
+}
+
+func (n notNode) compile(c *compiler, onTrue, onFalse int) {
+	n.n.compile(c, onFalse, onTrue)
+}
+
+// cmpNode executes the instructions in load and compares the resulting A with val.
+type cmpNode struct {
+	load []bpf.Instruction
+	cond bpf.JumpTest
+	val  uint32
+}
+
+func (n cmpNode) compile(c *compiler, onTrue, onFalse int) {
+	for _, inst := range n.load {
+		c.p.Append(inst)
+	}
+	c.p.JumpIf(n.cond, n.val, onTrue, onFalse)
+}
+
+// relNode is a relation like `ip[9] == 6`.
+type relNode struct {
+	left, right arith
+	cond        bpf.JumpTest
+}
+
+func (n relNode) compile(c *compiler, onTrue, onFalse int) {
+	if k, ok := n.right.(numArith); ok {
+		n.left.compile(c)
+		c.p.JumpIf(n.cond, uint32(k), onTrue, onFalse)
+		return
+	}
+	c.binary(n.left, n.right)
+	c.p.JumpIfX(n.cond, onTrue, onFalse)
+}
+
+// arith is an arithmetic expression, which is compiled into instructions leaving the result in A.
+type arith interface {
+	compile(c *compiler)
+}
+
+type numArith uint32
+
+func (a numArith) compile(c *compiler) {
+	c.p.Append(bpf.LoadConstant{Dst: bpf.RegA, Val: uint32(a)})
+}
+
+type lenArith struct{}
+
+func (a lenArith) compile(c *compiler) {
+	c.p.Append(bpf.LoadExtension{Num: bpf.ExtLen})
+}
+
+// loadArith loads size bytes at base+index. If transport is true, the IPv4 header length is
+// added to the offset as well.
+type loadArith struct {
+	base      uint32
+	transport bool
+	index     arith
+	size      int
+}
+
+func (a loadArith) compile(c *compiler) {
+	if k, ok := a.index.(numArith); ok {
+		if a.transport {
+			c.p.Append(bpf.LoadMemShift{Off: a.base})
+			c.p.Append(bpf.LoadIndirect{Off: a.base + uint32(k), Size: a.size})
+			return
+		}
+		c.p.Append(bpf.LoadAbsolute{Off: a.base + uint32(k), Size: a.size})
+		return
+	}
+
+	a.index.compile(c)
+	if a.transport {
+		slot := c.alloc()
+		c.p.Append(bpf.StoreScratch{Src: bpf.RegA, N: slot})
+		c.p.Append(bpf.LoadMemShift{Off: a.base})
+		c.p.Append(bpf.LoadScratch{Dst: bpf.RegA, N: slot})
+		c.p.Append(bpf.ALUOpX{Op: bpf.ALUOpAdd})
+		c.free()
+	}
+	c.p.Append(bpf.TAX{})
+	c.p.Append(bpf.LoadIndirect{Off: a.base, Size: a.size})
+}
+
+type binArith struct {
+	op          bpf.ALUOp
+	left, right arith
+}
+
+func (a binArith) compile(c *compiler) {
+	if k, ok := a.right.(numArith); ok {
+		a.left.compile(c)
+		c.p.Append(bpf.ALUOpConstant{Op: a.op, Val: uint32(k)})
+		return
+	}
+	c.binary(a.left, a.right)
+	c.p.Append(bpf.ALUOpX{Op: a.op})
+}
+
+// binary leaves the result of left in A and the result of right in X. The result of right is
+// kept in scratch memory while left is computed.
+func (c *compiler) binary(left, right arith) {
+	right.compile(c)
+	slot := c.alloc()
+	c.p.Append(bpf.StoreScratch{Src: bpf.RegA, N: slot})
+	left.compile(c)
+	c.p.Append(bpf.LoadScratch{Dst: bpf.RegX, N: slot})
+	c.free()
+}
@@ -0,0 +1,62 @@
+//go:build cgo
+// +build cgo
+
+package pcapfilter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// TestCompileLibpcap compares the packets accepted by the programs of Compile with the
+// programs compiled by libpcap. It is skipped, if libpcap is not able to compile filters.
+func TestCompileLibpcap(t *testing.T) {
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, "ip"); err != nil {
+		t.Skipf("libpcap is not available: %s", err.Error())
+	}
+
+	exprs := []string{
+		"ip", "ip6", "arp", "tcp", "udp", "icmp", "icmp6", "not ip and not ip6",
+		"ip6 or ip and tcp", "tcp and ip or icmp", "not tcp and ip or arp",
+		"host 10.0.0.1", "src host 10.0.0.1", "dst host 10.0.0.2", "ip host 10.0.0.2",
+		"host 2001:db8::1", "net 192.168.0.0/16", "dst net 192.168", "net 10.0.0.0 mask 255.255.255.0",
+		"port 80", "port 53", "src port 53 and dst port 5353", "tcp and (port 80 or 443)",
+		"portrange 5000-6000", "ip proto 1", "ip6 proto 17", "ether proto 0x806", "greater 100",
+		"less 60", "ip[9] == 6", "tcp[13] & 2 != 0", "udp[0:2] = 53", "(len - 14) > 100",
+		"ether dst ff:ff:ff:ff:ff:ff", "vlan", "vlan 100 and tcp port 22",
+	}
+
+	packets := testPackets(t)
+	for _, linkType := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeRaw} {
+		for _, expr := range exprs {
+			libpcap, err := pcap.CompileBPFFilter(linkType, 65535, expr)
+			if err != nil {
+				continue
+			}
+			raw := make([]bpf.RawInstruction, len(libpcap))
+			for i, inst := range libpcap {
+				raw[i] = bpf.RawInstruction{Op: inst.Code, Jt: inst.Jt, Jf: inst.Jf, K: inst.K}
+			}
+			expectedProg, ok := bpf.Disassemble(raw)
+			if !ok {
+				t.Fatalf("expr '%s': failed to disassemble libpcap program", expr)
+			}
+
+			prog, err := Compile(expr, linkType, 65535)
+			if err != nil {
+				t.Errorf("expr '%s' on %s: failed to compile with error: %s", expr, linkType, err.Error())
+				continue
+			}
+
+			isRaw := linkType == layers.LinkTypeRaw
+			got, expected := matches(t, prog, packets, isRaw), matches(t, expectedProg, packets, isRaw)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("expr '%s' on %s: got matches %v, libpcap matches %v", expr, linkType, got, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package pcapfilter
+
+import (
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+type testPacket struct {
+	name string
+	// ethernet is the packet with Ethernet header, raw the packet without link layer
+	// header or nil, if it is not an IP packet.
+	ethernet, raw []byte
+}
+
+var (
+	srcMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	dstMAC = net.HardwareAddr{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb}
+)
+
+func serialize(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, l...); err != nil {
+		t.Fatalf("failed to serialize packet with error: %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+func ip4(src, dst string, proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+}
+
+func ip6(src, dst string, next layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: next, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+// testPackets returns IPv4 and IPv6 packets with TCP, UDP and ICMP, fragments, an ARP request
+// and a VLAN tagged packet.
+func testPackets(t *testing.T) []testPacket {
+	ipPackets := []struct {
+		name   string
+		layers []gopacket.SerializableLayer
+	}{
+		{
+			name:   "tcp4",
+			layers: []gopacket.SerializableLayer{ip4("10.0.0.1", "192.168.1.2", layers.IPProtocolTCP), &layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true, DataOffset: 5}},
+		},
+		{
+			name: "udp4",
+			layers: []gopacket.SerializableLayer{
+				&layers.IPv4{
+					Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 2}, DstIP: net.IP{10, 0, 0, 1},
+					Options: []layers.IPv4Option{{OptionType: 1}, {OptionType: 1}, {OptionType: 1}, {OptionType: 1}},
+				},
+				&layers.UDP{SrcPort: 53, DstPort: 5353},
+				gopacket.Payload(make([]byte, 100)),
+			},
+		},
+		{
+			name:   "icmp4",
+			layers: []gopacket.SerializableLayer{ip4("10.0.0.1", "8.8.8.8", layers.IPProtocolICMPv4), &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(8, 0)}},
+		},
+		{
+			// second fragment, the payload looks like ports 80 to 80
+			name: "frag4",
+			layers: []gopacket.SerializableLayer{
+				&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{192, 168, 1, 2}, FragOffset: 100},
+				gopacket.Payload{0, 80, 0, 80, 0, 0, 0, 0},
+			},
+		},
+		{
+			name:   "tcp6",
+			layers: []gopacket.SerializableLayer{ip6("2001:db8::1", "fe80::1", layers.IPProtocolTCP), &layers.TCP{SrcPort: 443, DstPort: 50000, ACK: true, DataOffset: 5}},
+		},
+		{
+			// fragment header followed by UDP from port 53 to port 53
+			name: "frag6",
+			layers: []gopacket.SerializableLayer{
+				ip6("2001:db8::2", "2001:db8::1", layers.IPProtocolIPv6Fragment),
+				gopacket.Payload{17, 0, 0, 1, 0, 0, 0, 42, 0, 53, 0, 53, 0, 8, 0, 0},
+			},
+		},
+		{
+			name:   "icmp6",
+			layers: []gopacket.SerializableLayer{ip6("fe80::1", "ff02::1", layers.IPProtocolICMPv6), gopacket.Payload{128, 0, 0, 0, 0, 1, 0, 1}},
+		},
+	}
+
+	var packets []testPacket
+	for _, p := range ipPackets {
+		etherType := layers.EthernetTypeIPv4
+		if p.layers[0].LayerType() == layers.LayerTypeIPv6 {
+			etherType = layers.EthernetTypeIPv6
+		}
+		ether := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: etherType}
+		packets = append(packets, testPacket{
+			name:     p.name,
+			ethernet: serialize(t, append([]gopacket.SerializableLayer{ether}, p.layers...)...),
+			raw:      serialize(t, p.layers...),
+		})
+	}
+
+	packets = append(packets, testPacket{
+		name: "arp",
+		ethernet: serialize(t,
+			&layers.Ethernet{SrcMAC: srcMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP},
+			&layers.ARP{
+				AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+				Operation: layers.ARPRequest, SourceHwAddress: srcMAC, SourceProtAddress: []byte{10, 0, 0, 1},
+				DstHwAddress: make([]byte, 6), DstProtAddress: []byte{10, 0, 0, 2},
+			},
+		),
+	}, testPacket{
+		name: "vlan",
+		ethernet: serialize(t,
+			&layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeDot1Q},
+			&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+			ip4("10.0.0.3", "10.0.0.1", layers.IPProtocolTCP),
+			&layers.TCP{SrcPort: 22, DstPort: 2222, ACK: true, DataOffset: 5},
+		),
+	})
+
+	return packets
+}
+
+// matches returns the names of the packets accepted by prog.
+func matches(t *testing.T, prog []bpf.Instruction, packets []testPacket, raw bool) []string {
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("failed to load program with error: %s\n%v", err.Error(), prog)
+	}
+
+	var names []string
+	for _, p := range packets {
+		data := p.ethernet
+		if raw {
+			if data = p.raw; data == nil {
+				continue
+			}
+		}
+		n, err := vm.Run(data)
+		if err != nil {
+			t.Fatalf("failed to run program on packet %s with error: %s", p.name, err.Error())
+		}
+		if n > 0 {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+func TestCompile(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected []string
+		// raw are the expected matches for raw IP, if they differ from the expected IP packets
+		raw          []string
+		ethernetOnly bool
+	}{
+		{expr: "", expected: []string{"tcp4", "udp4", "icmp4", "frag4", "tcp6", "frag6", "icmp6", "arp", "vlan"}},
+		{expr: "ip", expected: []string{"tcp4", "udp4", "icmp4", "frag4"}},
+		{expr: "ip6", expected: []string{"tcp6", "frag6", "icmp6"}},
+		{expr: "arp", expected: []string{"arp"}},
+		{expr: "rarp", expected: nil},
+		{expr: "tcp", expected: []string{"tcp4", "tcp6"}},
+		{expr: "udp", expected: []string{"udp4", "frag4", "frag6"}},
+		{expr: "icmp", expected: []string{"icmp4"}},
+		{expr: "icmp6", expected: []string{"icmp6"}},
+		{expr: "not ip and not ip6", expected: []string{"arp", "vlan"}},
+		{expr: "!tcp && (udp || icmp)", expected: []string{"udp4", "icmp4", "frag4", "frag6"}},
+		{expr: "ip6 or ip and tcp", expected: []string{"tcp4", "tcp6"}},
+		{expr: "tcp and ip or icmp", expected: []string{"tcp4", "icmp4"}},
+		{expr: "udp || tcp && ip6", expected: []string{"tcp6", "frag6"}},
+		{expr: "not tcp and ip or arp", expected: []string{"udp4", "icmp4", "frag4", "arp"}},
+		{expr: "host 10.0.0.1", expected: []string{"tcp4", "udp4", "icmp4", "frag4", "arp"}},
+		{expr: "src host 10.0.0.1", expected: []string{"tcp4", "icmp4", "frag4", "arp"}},
+		{expr: "dst host 10.0.0.2", expected: []string{"arp"}},
+		{expr: "ip host 10.0.0.2", expected: []string{"udp4"}},
+		{expr: "src and dst host 10.0.0.1", expected: nil},
+		{expr: "host 10.0.0.2 or 8.8.8.8", expected: []string{"udp4", "icmp4", "arp"}},
+		{expr: "host 2001:db8::1", expected: []string{"tcp6", "frag6"}},
+		{expr: "ip6 src host fe80::1", expected: []string{"icmp6"}},
+		{expr: "net 192.168.0.0/16", expected: []string{"tcp4", "frag4"}},
+		{expr: "dst net 192.168", expected: []string{"tcp4", "frag4"}},
+		{expr: "net 10.0.0.0 mask 255.255.255.0", expected: []string{"tcp4", "udp4", "icmp4", "frag4", "arp"}},
+		{expr: "src net 2001:db8::/32", expected: []string{"tcp6", "frag6"}},
+		{expr: "port 80", expected: []string{"tcp4"}},
+		{expr: "port 53", expected: []string{"udp4"}},
+		{expr: "tcp port 53", expected: nil},
+		{expr: "src port 53 and dst port 5353", expected: []string{"udp4"}},
+		{expr: "src or dst port 1234", expected: []string{"tcp4"}},
+		{expr: "tcp and (port 80 or 443)", expected: []string{"tcp4", "tcp6"}},
+		{expr: "portrange 5000-6000", expected: []string{"udp4"}},
+		{expr: "dst portrange 50000-60000", expected: []string{"tcp6"}},
+		{expr: "ip proto 1", expected: []string{"icmp4"}},
+		{expr: "ip6 proto 17", expected: []string{"frag6"}},
+		{expr: `proto \tcp`, expected: []string{"tcp4", "tcp6"}},
+		{expr: "ether proto 0x806", expected: []string{"arp"}},
+		{expr: "ether proto ip6", expected: []string{"tcp6", "frag6", "icmp6"}},
+		{expr: "greater 100", expected: []string{"udp4"}},
+		{expr: "less 60", expected: []string{"tcp4", "icmp4", "frag4", "arp", "vlan"}, raw: []string{"tcp4", "icmp4", "frag4", "tcp6", "frag6", "icmp6"}},
+		{expr: "ip[9] == 6", expected: []string{"tcp4"}},
+		{expr: "ip[6:2] & 0x1fff != 0", expected: []string{"frag4"}},
+		{expr: "ip6[53] & 0x10 != 0", expected: []string{"tcp6"}},
+		{expr: "tcp[13] & 2 != 0", expected: []string{"tcp4"}},
+		{expr: "tcp[tcpflags] & tcp-syn != 0", expected: []string{"tcp4"}},
+		{expr: "icmp[icmptype] == icmp-echo", expected: []string{"icmp4"}},
+		{expr: "icmp6[icmp6type] == 128", expected: []string{"icmp6"}},
+		{expr: "udp[0:2] = 53", expected: []string{"udp4"}},
+		{expr: "udp[ip[0] - 0x46] == 0", expected: []string{"udp4"}},
+		{expr: "ip[2:2] - (ip[0] & 0xf) * 4 == 8 + 100", expected: []string{"udp4"}},
+		{expr: "(len - 14) > 100", expected: []string{"udp4"}},
+		{expr: "len >= 0x20 && arp[7] == 1", expected: []string{"arp"}},
+		{expr: "ether host 00:11:22:33:44:55", expected: []string{"tcp4", "udp4", "icmp4", "frag4", "tcp6", "frag6", "icmp6", "arp", "vlan"}, ethernetOnly: true},
+		{expr: "ether dst ff:ff:ff:ff:ff:ff", expected: []string{"arp"}, ethernetOnly: true},
+		{expr: "ether[12:2] = 0x8100", expected: []string{"vlan"}, ethernetOnly: true},
+		{expr: "vlan", expected: []string{"vlan"}, ethernetOnly: true},
+		{expr: "vlan 100 and tcp port 22", expected: []string{"vlan"}, ethernetOnly: true},
+		{expr: "vlan 200", expected: nil, ethernetOnly: true},
+	}
+
+	packets := testPackets(t)
+	ipPackets := map[string]bool{}
+	for _, p := range packets {
+		ipPackets[p.name] = p.raw != nil
+	}
+
+	for _, test := range cases {
+		prog, err := Compile(test.expr, layers.LinkTypeEthernet, 65535)
+		if err != nil {
+			t.Errorf("expr '%s': failed to compile with error: %s", test.expr, err.Error())
+			continue
+		}
+		if got := matches(t, prog, packets, false); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expr '%s' on Ethernet: got matches %v, expected %v", test.expr, got, test.expected)
+		}
+
+		prog, err = Compile(test.expr, layers.LinkTypeRaw, 65535)
+		if test.ethernetOnly {
+			if err == nil {
+				t.Errorf("expr '%s': expected error for raw IP", test.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expr '%s': failed to compile for raw IP with error: %s", test.expr, err.Error())
+			continue
+		}
+		expected := test.raw
+		if expected == nil {
+			for _, name := range test.expected {
+				if ipPackets[name] {
+					expected = append(expected, name)
+				}
+			}
+		}
+		if got := matches(t, prog, packets, true); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expr '%s' on raw IP: got matches %v, expected %v", test.expr, got, expected)
+		}
+	}
+}
+
+func TestCompileICMP6Fragment(t *testing.T) {
+	// fragment header followed by an ICMPv6 echo request
+	fragment := testPacket{
+		name: "frag icmp6",
+		ethernet: serialize(t,
+			&layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv6},
+			ip6("fe80::1", "ff02::1", layers.IPProtocolIPv6Fragment),
+			gopacket.Payload{58, 0, 0, 1, 0, 0, 0, 42, 128, 0, 0, 0, 0, 1, 0, 1},
+		),
+	}
+
+	cases := []struct {
+		expr     string
+		expected []string
+	}{
+		{expr: "icmp6", expected: []string{"frag icmp6"}},
+		// the fixed offset of icmp6[] does not apply to packets with extension headers
+		{expr: "icmp6[0] == 58"},
+		{expr: "icmp6[icmp6type] == 128"},
+	}
+
+	for _, test := range cases {
+		prog, err := Compile(test.expr, layers.LinkTypeEthernet, 65535)
+		if err != nil {
+			t.Fatalf("expr '%s': failed to compile with error: %s", test.expr, err.Error())
+		}
+		if got := matches(t, prog, []testPacket{fragment}, false); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expr '%s': got matches %v, expected %v", test.expr, got, test.expected)
+		}
+	}
+}
+
+func TestCompileInstructions(t *testing.T) {
+	cases := []struct {
+		expr     string
+		linkType layers.LinkType
+		expected []bpf.Instruction
+	}{
+		{
+			// same as `tcpdump -d ip`
+			expr:     "ip",
+			linkType: layers.LinkTypeEthernet,
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 12, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+				bpf.RetConstant{Val: 262144},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			expr:     "ip6",
+			linkType: layers.LinkTypeRaw,
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 0, Size: 1},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x60, SkipFalse: 1},
+				bpf.RetConstant{Val: 262144},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			expr:     "",
+			linkType: layers.LinkTypeEthernet,
+			expected: []bpf.Instruction{
+				bpf.RetConstant{Val: 262144},
+			},
+		},
+		{
+			expr:     "arp",
+			linkType: layers.LinkTypeRaw,
+			expected: []bpf.Instruction{
+				bpf.RetConstant{Val: 0},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		got, err := Compile(test.expr, test.linkType, 262144)
+		if err != nil {
+			t.Errorf("expr '%s': failed to compile with error: %s", test.expr, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expr '%s': got %v, expected %v", test.expr, got, test.expected)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	cases := []struct {
+		expr     string
+		linkType layers.LinkType
+		err      string
+	}{
+		{expr: "tcp", linkType: layers.LinkTypeLinuxSLL, err: "unsupported link type Linux SLL"},
+		{expr: "tcp $ udp", err: `column 5: unexpected character '$'`},
+		{expr: "host", err: "column 5: expected ID, got end of expression"},
+		{expr: "example.com", err: `column 1: invalid host "example.com", host names are not supported`},
+		{expr: "tcp port http", err: `column 10: invalid port "http", service names are not supported`},
+		{expr: "portrange 80", err: `column 11: invalid port range "80"`},
+		{expr: "tcp host 10.0.0.1", err: `column 10: invalid qualifier "tcp" for IPv4 address`},
+		{expr: "ip host ::1", err: `column 9: invalid qualifier "ip" for IPv6 address`},
+		{expr: "ip port 80", err: `column 9: invalid qualifier "ip" for port`},
+		{expr: "net 10.0.0.1/8", err: `column 5: non-network bits set in "10.0.0.1/8"`},
+		{expr: "net 10.0.0.0/40", err: `column 5: invalid prefix length in "10.0.0.0/40"`},
+		{expr: "ether host 10.0.0.1", err: `column 12: invalid MAC address "10.0.0.1"`},
+		{expr: "ether", err: "column 1: ether requires a qualifier"},
+		{expr: "port 80 and", err: "column 12: expected primitive, got end of expression"},
+		{expr: "(tcp", err: `column 5: expected ")", got end of expression`},
+		{expr: "tcp )", err: `column 5: unexpected ")"`},
+		{expr: "ip[9] ==", err: "column 9: expected arithmetic expression, got end of expression"},
+		{expr: "ip[9:3] == 6", err: `column 6: invalid size "3", expected 1, 2 or 4`},
+		{expr: "ip[1] / 0 == 1", err: "column 7: division by zero"},
+		{expr: "ip[1] << 32 == 1", err: "column 7: shift by 32"},
+		{expr: "vlan", linkType: layers.LinkTypeRaw, err: "column 1: vlan is not supported for link type Raw"},
+		{expr: "ether[0] == 1", linkType: layers.LinkTypeRaw, err: "column 1: ether is not supported for link type Raw"},
+		{expr: "(((((((((((((((((len + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) + len) > 0", err: "expression too complex, out of scratch memory"},
+	}
+
+	for _, test := range cases {
+		linkType := test.linkType
+		if linkType == 0 {
+			linkType = layers.LinkTypeEthernet
+		}
+		_, err := Compile(test.expr, linkType, 65535)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("expr '%s': got error %v, expected %s", test.expr, err, test.err)
+		}
+	}
+}
+
+func TestCompileLoopback(t *testing.T) {
+	f, err := os.Open("../pcap/test_loopback.pcap")
+	if err != nil {
+		t.Fatalf("failed to open pcap file with error: %s", err.Error())
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read pcap file with error: %s", err.Error())
+	}
+
+	// test_loopback.pcap contains IPv6 packets on the loopback interface (DLT_NULL), they
+	// are converted to Ethernet and raw IP.
+	var packets []testPacket
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read packet with error: %s", err.Error())
+		}
+		ether := append(make([]byte, 12), 0x86, 0xdd)
+		packets = append(packets, testPacket{name: strings.Repeat("x", len(packets)), ethernet: append(ether, data[4:]...), raw: data[4:]})
+	}
+	if len(packets) != 24 {
+		t.Fatalf("got %d packets, expected 24", len(packets))
+	}
+
+	cases := []struct {
+		expr     string
+		expected int
+	}{
+		{expr: "ip6 and tcp port 8080", expected: 24},
+		{expr: "ip", expected: 0},
+		{expr: "host ::1", expected: 24},
+		{expr: "tcp port 58806", expected: 4},
+		{expr: "src port 8080", expected: 13},
+		{expr: "ip6[53] & tcp-syn != 0", expected: 2},
+		{expr: "not ip6[53] & tcp-ack != 0", expected: 1},
+		{expr: "tcp[13] & tcp-ack != 0", expected: 0},
+		{expr: "ip6[4:2] > 1000", expected: 4},
+		{expr: "tcp", expected: 24},
+		{expr: "ip6 proto 6", expected: 24},
+		{expr: "udp or icmp6", expected: 0},
+		{expr: "dst port 8080", expected: 11},
+		{expr: "tcp port 58799", expected: 20},
+		{expr: "tcp portrange 58800-58810", expected: 4},
+		{expr: "dst host ::1 and src port 58806", expected: 2},
+		{expr: "ip6[40:2] == 8080", expected: 13},
+		{expr: "ip6[53] & tcp-push != 0", expected: 8},
+		{expr: "greater 1000", expected: 5},
+		{expr: "less 100", expected: 13},
+	}
+
+	for _, test := range cases {
+		for _, linkType := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeRaw} {
+			prog, err := Compile(test.expr, linkType, 65535)
+			if err != nil {
+				t.Errorf("expr '%s': failed to compile with error: %s", test.expr, err.Error())
+				continue
+			}
+			if got := matches(t, prog, packets, linkType == layers.LinkTypeRaw); len(got) != test.expected {
+				t.Errorf("expr '%s' on %s: got %d matches, expected %d", test.expr, linkType, len(got), test.expected)
+			}
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tokens, err := tokenize(`tcp[13]&0x2!=0 or \udp`)
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+	var got []string
+	for _, token := range tokens {
+		got = append(got, token.text)
+	}
+	expected := []string{"tcp", "[", "13", "]", "&", "0x2", "!=", "0", "or", `\udp`}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
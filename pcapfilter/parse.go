@@ -0,0 +1,877 @@
+package pcapfilter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// ParseError is returned by Compile if the filter expression is not valid or not supported.
+// Column is 1-based and points to the offending token.
+type ParseError struct {
+	Column int
+	Msg    string
+}
+
+// Error returns the error message including the position of the error.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+type token struct {
+	text     string
+	pos, end int
+}
+
+func (t token) isWord() bool {
+	return t.text != "" && (isWordChar(t.text[0]) || t.text[0] == '\\')
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+var operators = []string{"==", "!=", ">=", "<=", "<<", ">>", "&&", "||", "=", ">", "<", "!", "&", "|", "^", "+", "-", "*", "/", "%", "(", ")", "[", "]", ":"}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isWordChar(c) || c == '\\' && i+1 < len(expr) && isWordChar(expr[i+1]):
+			start := i
+			for i++; i < len(expr) && isWordChar(expr[i]); i++ {
+			}
+			tokens = append(tokens, token{text: expr[start:i], pos: start, end: i})
+			continue
+		}
+		found := false
+		for _, op := range operators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, token{text: op, pos: i, end: i + len(op)})
+				i += len(op)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &ParseError{Column: i + 1, Msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return tokens, nil
+}
+
+// keywords can not be used as bare ID with inherited qualifiers
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true, "host": true, "net": true, "mask": true, "port": true,
+	"portrange": true, "src": true, "dst": true, "proto": true, "ether": true, "ip": true, "ip6": true,
+	"arp": true, "rarp": true, "tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true,
+	"vlan": true, "len": true, "greater": true, "less": true,
+}
+
+// qualifiers of a primitive, e.g. `tcp dst port` in `tcp dst port 80`
+type qualifiers struct {
+	proto string
+	dir   string
+	typ   string
+}
+
+type parser struct {
+	tokens   []token
+	pos      int
+	end      int
+	linkType layers.LinkType
+	// vlans is the number of `vlan` primitives parsed so far, every one of them moves the
+	// link layer payload by 4 bytes for the following primitives, like in libpcap.
+	vlans int
+	// last are the qualifiers of the last primitive, which are used for a bare ID
+	last qualifiers
+	// implied are the protocol checks implied by the loads of a relation
+	implied []node
+}
+
+func (p *parser) peek() token {
+	return p.peekN(0)
+}
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n < len(p.tokens) {
+		return p.tokens[p.pos+n]
+	}
+	return token{pos: p.end, end: p.end}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(texts ...string) bool {
+	for _, text := range texts {
+		if p.peek().text == text {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf(p.peek(), "expected %q, got %s", text, describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &ParseError{Column: t.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func describe(t token) string {
+	if t.text == "" {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// id returns the concatenation of the adjacent tokens at the current position, which are
+// words or one of the operators in glue (e.g. `:` for IPv6 and MAC addresses).
+func (p *parser) id(glue string) (string, token, error) {
+	first := p.peek()
+	if !first.isWord() && (first.text == "" || !strings.Contains(glue, first.text)) {
+		return "", first, p.errorf(first, "expected ID, got %s", describe(first))
+	}
+	id := p.next().text
+	for t := p.peek(); t.pos == p.tokens[p.pos-1].end && (t.isWord() || t.text != "" && strings.Contains(glue, t.text)); t = p.peek() {
+		id += p.next().text
+	}
+	return strings.TrimPrefix(id, "\\"), first, nil
+}
+
+// parseExpr parses a sequence of unary expressions joined by `and` and `or`. Both have the
+// same precedence and associate left to right, as defined by pcap-filter(7).
+func (p *parser) parseExpr() (node, error) {
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		combine := and
+		switch {
+		case p.accept("and", "&&"):
+		case p.accept("or", "||"):
+			combine = or
+		default:
+			return n, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		n = combine(n, right)
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("not", "!") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not(n), nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses a relation, a primitive or an expression in parentheses. As both, a
+// relation and an expression, may start with a parenthesis, a relation is tried first.
+func (p *parser) parsePrimary() (node, error) {
+	if !p.startsArith() {
+		return p.parsePrimitive()
+	}
+
+	start, last, vlans := p.pos, p.last, p.vlans
+	n, relErr := p.parseRelation()
+	if relErr == nil {
+		return n, nil
+	}
+
+	// the error of the relation is kept, if it got further than the primitive
+	p.pos, p.last, p.vlans = start, last, vlans
+	n, err := p.parsePrimitive()
+	if err == nil {
+		if column(relErr) > p.peek().pos+1 {
+			return nil, relErr
+		}
+		return n, nil
+	}
+	if column(relErr) > column(err) || column(relErr) == column(err) && loadBase[p.tokens[start].text] != "" {
+		return nil, relErr
+	}
+	return nil, err
+}
+
+func column(err error) int {
+	if err, ok := err.(*ParseError); ok {
+		return err.Column
+	}
+	return 0
+}
+
+func (p *parser) startsArith() bool {
+	t := p.peek()
+	switch {
+	case t.text == "(" || t.text == "len":
+		return true
+	case t.text != "" && isDigit(t.text[0]):
+		return true
+	case loadBase[t.text] != "" && p.peekN(1).text == "[":
+		return true
+	}
+	_, ok := arithConstants[t.text]
+	return ok
+}
+
+var relations = map[string]bpf.JumpTest{
+	"==": bpf.JumpEqual,
+	"=":  bpf.JumpEqual,
+	"!=": bpf.JumpNotEqual,
+	">":  bpf.JumpGreaterThan,
+	">=": bpf.JumpGreaterOrEqual,
+	"<":  bpf.JumpLessThan,
+	"<=": bpf.JumpLessOrEqual,
+}
+
+func (p *parser) parseRelation() (node, error) {
+	p.implied = nil
+	left, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	cond, ok := relations[op.text]
+	if !ok {
+		return nil, p.errorf(op, "expected relational operator, got %s", describe(op))
+	}
+	p.next()
+	right, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+	return and(append(p.implied, relNode{left: left, right: right, cond: cond})...), nil
+}
+
+// arithLevels are the binary operators ordered by increasing precedence
+var arithLevels = []map[string]bpf.ALUOp{
+	{"|": bpf.ALUOpOr},
+	{"^": bpf.ALUOpXor},
+	{"&": bpf.ALUOpAnd},
+	{"<<": bpf.ALUOpShiftLeft, ">>": bpf.ALUOpShiftRight},
+	{"+": bpf.ALUOpAdd, "-": bpf.ALUOpSub},
+	{"*": bpf.ALUOpMul, "/": bpf.ALUOpDiv, "%": bpf.ALUOpMod},
+}
+
+func (p *parser) parseArith(level int) (arith, error) {
+	if level == len(arithLevels) {
+		return p.parseArithPrimary()
+	}
+	left, err := p.parseArith(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op, ok := arithLevels[level][t.text]
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseArith(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := right.(numArith); ok && k == 0 && (op == bpf.ALUOpDiv || op == bpf.ALUOpMod) {
+			return nil, p.errorf(t, "division by zero")
+		}
+		if k, ok := right.(numArith); ok && k >= 32 && (op == bpf.ALUOpShiftLeft || op == bpf.ALUOpShiftRight) {
+			return nil, p.errorf(t, "shift by %d", k)
+		}
+		left = binArith{op: op, left: left, right: right}
+	}
+}
+
+// loadBase is the base of the loads of a protocol, `link`, `net` or `transport` for loads
+// relative to the link layer header, the network layer header or the IPv4 payload.
+var loadBase = map[string]string{
+	"ether": "link",
+	"ip":    "net",
+	"ip6":   "net",
+	"arp":   "net",
+	"rarp":  "net",
+	"tcp":   "transport",
+	"udp":   "transport",
+	"sctp":  "transport",
+	"icmp":  "transport",
+	"icmp6": "net",
+}
+
+// arithConstants are the named offsets and values of pcap-filter(7)
+var arithConstants = map[string]uint32{
+	"icmptype": 0, "icmpcode": 1, "icmp6type": 0, "icmp6code": 1, "tcpflags": 13,
+	"icmp-echoreply": 0, "icmp-unreach": 3, "icmp-sourcequench": 4, "icmp-redirect": 5,
+	"icmp-echo": 8, "icmp-routeradvert": 9, "icmp-routersolicit": 10, "icmp-timxceed": 11,
+	"icmp-paramprob": 12, "icmp-tstamp": 13, "icmp-tstampreply": 14, "icmp-ireq": 15,
+	"icmp-ireqreply": 16, "icmp-maskreq": 17, "icmp-maskreply": 18,
+	"tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08, "tcp-ack": 0x10,
+	"tcp-urg": 0x20, "tcp-ece": 0x40, "tcp-cwr": 0x80,
+}
+
+func (p *parser) parseArithPrimary() (arith, error) {
+	// named constants, like tcp-syn, are split into multiple tokens
+	if p.peek().isWord() {
+		start := p.pos
+		if name, _, err := p.id("-"); err == nil {
+			if val, ok := arithConstants[name]; ok {
+				return numArith(val), nil
+			}
+		}
+		p.pos = start
+	}
+
+	t := p.next()
+	switch {
+	case t.text == "(":
+		a, err := p.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+		return a, p.expect(")")
+	case t.text == "len":
+		return lenArith{}, nil
+	case t.text != "" && isDigit(t.text[0]):
+		val, err := strconv.ParseUint(t.text, 0, 32)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %q", t.text)
+		}
+		return numArith(val), nil
+	case loadBase[t.text] != "":
+		return p.parseLoad(t)
+	}
+	if val, ok := arithConstants[t.text]; ok {
+		return numArith(val), nil
+	}
+	return nil, p.errorf(t, "expected arithmetic expression, got %s", describe(t))
+}
+
+// parseLoad parses `proto[index]` or `proto[index:size]`.
+func (p *parser) parseLoad(proto token) (arith, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	index, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+	size := 1
+	if p.accept(":") {
+		t := p.next()
+		if size, err = strconv.Atoi(t.text); err != nil || size != 1 && size != 2 && size != 4 {
+			return nil, p.errorf(t, "invalid size %s, expected 1, 2 or 4", describe(t))
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	load := loadArith{index: index, size: size}
+	switch loadBase[proto.text] {
+	case "link":
+		if p.linkType != layers.LinkTypeEthernet {
+			return nil, p.errorf(proto, "%s is not supported for link type %s", proto.text, p.linkType)
+		}
+	case "net":
+		load.base = p.netOff()
+		if proto.text == "icmp6" {
+			// the ICMPv6 header must directly follow the IPv6 header, as the offset is fixed
+			p.implied = append(p.implied, and(p.linkProto(etherTypes["ip6"]), p.cmpLoad(bpf.LoadAbsolute{Off: load.base + 6, Size: 1}, 58)))
+			load.base += 40
+		} else {
+			p.implied = append(p.implied, p.protocol(proto.text))
+		}
+	case "transport":
+		load.base = p.netOff()
+		load.transport = true
+		p.implied = append(p.implied, p.ipProto(ipProtocols[proto.text]), p.notFragment())
+	}
+	return load, nil
+}
+
+var ipProtocols = map[string]uint8{
+	"icmp":  1,
+	"igmp":  2,
+	"tcp":   6,
+	"udp":   17,
+	"icmp6": 58,
+	"sctp":  132,
+}
+
+var etherTypes = map[string]uint16{
+	"ip":   0x0800,
+	"ip6":  0x86dd,
+	"arp":  0x0806,
+	"rarp": 0x8035,
+}
+
+var protoQualifiers = map[string]bool{
+	"ether": true, "ip": true, "ip6": true, "arp": true, "rarp": true, "tcp": true, "udp": true,
+	"sctp": true, "icmp": true, "icmp6": true,
+}
+
+var typeQualifiers = map[string]bool{
+	"host": true, "net": true, "port": true, "portrange": true, "proto": true,
+}
+
+func (p *parser) parsePrimitive() (node, error) {
+	t := p.peek()
+	switch t.text {
+	case "(":
+		p.next()
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case "vlan":
+		p.next()
+		return p.parseVLAN(t)
+	case "greater", "less":
+		p.next()
+		val, err := p.number(32)
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "greater" {
+			return cmpNode{load: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, cond: bpf.JumpGreaterOrEqual, val: val}, nil
+		}
+		return cmpNode{load: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, cond: bpf.JumpLessOrEqual, val: val}, nil
+	}
+
+	var q qualifiers
+	qualified := false
+	if protoQualifiers[t.text] {
+		q.proto = p.next().text
+		qualified = true
+	}
+	if d := p.peek().text; d == "src" || d == "dst" {
+		p.next()
+		q.dir = d
+		other := map[string]string{"src": "dst", "dst": "src"}[d]
+		if c := p.peek().text; (c == "or" || c == "and") && p.peekN(1).text == other {
+			p.pos += 2
+			q.dir = "src " + c + " dst"
+		}
+		qualified = true
+	}
+	if typeQualifiers[p.peek().text] {
+		q.typ = p.next().text
+		qualified = true
+	}
+
+	switch {
+	case q.proto != "" && q.dir == "" && q.typ == "":
+		// protocol only, e.g. `tcp`
+		if q.proto == "ether" {
+			return nil, p.errorf(t, "ether requires a qualifier")
+		}
+		return p.protocol(q.proto), nil
+	case !qualified:
+		if !p.peek().isWord() && p.peek().text != ":" || keywords[p.peek().text] {
+			return nil, p.errorf(p.peek(), "expected primitive, got %s", describe(p.peek()))
+		}
+		q = p.last
+	}
+	if q.typ == "" {
+		q.typ = "host"
+	}
+	p.last = q
+
+	switch q.typ {
+	case "host":
+		return p.parseHost(q)
+	case "net":
+		return p.parseNet(q)
+	case "port", "portrange":
+		return p.parsePort(q)
+	case "proto":
+		return p.parseProto(q)
+	}
+	return nil, p.errorf(t, "unknown qualifier %q", q.typ)
+}
+
+func (p *parser) number(bits int) (uint32, error) {
+	t := p.next()
+	val, err := strconv.ParseUint(t.text, 0, bits)
+	if err != nil {
+		return 0, p.errorf(t, "invalid number %s", describe(t))
+	}
+	return uint32(val), nil
+}
+
+func (p *parser) parseVLAN(t token) (node, error) {
+	if p.linkType != layers.LinkTypeEthernet {
+		return nil, p.errorf(t, "vlan is not supported for link type %s", p.linkType)
+	}
+	typeOff := p.netOff() - 2
+	n := or(p.cmpLoad(bpf.LoadAbsolute{Off: typeOff, Size: 2}, 0x8100),
+		p.cmpLoad(bpf.LoadAbsolute{Off: typeOff, Size: 2}, 0x88a8),
+		p.cmpLoad(bpf.LoadAbsolute{Off: typeOff, Size: 2}, 0x9100))
+	if next := p.peek(); next.text != "" && isDigit(next.text[0]) {
+		id, err := p.number(12)
+		if err != nil {
+			return nil, err
+		}
+		n = and(n, cmpNode{
+			load: []bpf.Instruction{bpf.LoadAbsolute{Off: typeOff + 2, Size: 2}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfff}},
+			cond: bpf.JumpEqual,
+			val:  id,
+		})
+	}
+	p.vlans++
+	return n, nil
+}
+
+func (p *parser) parseHost(q qualifiers) (node, error) {
+	id, t, err := p.id(":")
+	if err != nil {
+		return nil, err
+	}
+
+	if q.proto == "ether" {
+		mac, err := net.ParseMAC(id)
+		if err != nil || len(mac) != 6 {
+			return nil, p.errorf(t, "invalid MAC address %q", id)
+		}
+		if p.linkType != layers.LinkTypeEthernet {
+			return nil, p.errorf(t, "ether host is not supported for link type %s", p.linkType)
+		}
+		return p.direction(q.dir, p.etherHost(6, mac), p.etherHost(0, mac)), nil
+	}
+
+	ip := net.ParseIP(id)
+	if ip == nil {
+		return nil, p.errorf(t, "invalid host %q, host names are not supported", id)
+	}
+	bits := len(ip) * 8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return p.hostOrNet(q, t, ip, net.CIDRMask(bits, bits))
+}
+
+func (p *parser) parseNet(q qualifiers) (node, error) {
+	id, t, err := p.id(":/")
+	if err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	var mask net.IPMask
+	addr, prefix := id, -1
+	if i := strings.Index(id, "/"); i >= 0 {
+		addr = id[:i]
+		if prefix, err = strconv.Atoi(id[i+1:]); err != nil {
+			return nil, p.errorf(t, "invalid prefix length in %q", id)
+		}
+	}
+
+	if strings.Contains(addr, ":") {
+		if ip = net.ParseIP(addr); ip == nil {
+			return nil, p.errorf(t, "invalid network %q", id)
+		}
+		if prefix < 0 {
+			prefix = 128
+		}
+		mask = net.CIDRMask(prefix, 128)
+	} else {
+		// IPv4 networks may be abbreviated, e.g. `10.1` for 10.1.0.0/16
+		parts := strings.Split(addr, ".")
+		ip = make(net.IP, 4)
+		for i, part := range parts {
+			val, err := strconv.ParseUint(part, 10, 8)
+			if err != nil || i >= 4 {
+				return nil, p.errorf(t, "invalid network %q", id)
+			}
+			ip[i] = byte(val)
+		}
+		if prefix < 0 {
+			prefix = 8 * len(parts)
+		}
+		mask = net.CIDRMask(prefix, 32)
+		if p.accept("mask") {
+			if strings.Contains(id, "/") {
+				return nil, p.errorf(t, "mask is not allowed with prefix length")
+			}
+			m, mt, err := p.id("")
+			if err != nil {
+				return nil, err
+			}
+			if mask = net.IPMask(net.ParseIP(m).To4()); mask == nil {
+				return nil, p.errorf(mt, "invalid mask %q", m)
+			}
+		}
+	}
+	if mask == nil {
+		return nil, p.errorf(t, "invalid prefix length in %q", id)
+	}
+	if !ip.Mask(mask).Equal(ip) {
+		return nil, p.errorf(t, "non-network bits set in %q", id)
+	}
+
+	return p.hostOrNet(q, t, ip, mask)
+}
+
+// hostOrNet returns the node for `host` and `net` primitives. For IPv4 without protocol
+// qualifier, ARP and RARP packets are matched as well.
+func (p *parser) hostOrNet(q qualifiers, t token, ip net.IP, mask net.IPMask) (node, error) {
+	if len(ip) == 4 {
+		var nodes []node
+		if q.proto == "" || q.proto == "ip" {
+			nodes = append(nodes, and(p.protocol("ip"), p.direction(q.dir, p.addr(12, ip, mask), p.addr(16, ip, mask))))
+		}
+		for _, proto := range []string{"arp", "rarp"} {
+			if q.proto == "" || q.proto == proto {
+				nodes = append(nodes, and(p.protocol(proto), p.direction(q.dir, p.addr(14, ip, mask), p.addr(24, ip, mask))))
+			}
+		}
+		if len(nodes) == 0 {
+			return nil, p.errorf(t, "invalid qualifier %q for IPv4 address", q.proto)
+		}
+		return or(nodes...), nil
+	}
+
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, p.errorf(t, "invalid qualifier %q for IPv6 address", q.proto)
+	}
+	return and(p.protocol("ip6"), p.direction(q.dir, p.addr(8, ip, mask), p.addr(24, ip, mask))), nil
+}
+
+func (p *parser) parsePort(q qualifiers) (node, error) {
+	var protos []uint8
+	switch q.proto {
+	case "":
+		protos = []uint8{6, 17, 132}
+	case "tcp", "udp", "sctp":
+		protos = []uint8{ipProtocols[q.proto]}
+	default:
+		return nil, p.errorf(p.peek(), "invalid qualifier %q for %s", q.proto, q.typ)
+	}
+
+	glue := ""
+	if q.typ == "portrange" {
+		glue = "-"
+	}
+	id, t, err := p.id(glue)
+	if err != nil {
+		return nil, err
+	}
+
+	lowText, highText := id, id
+	if q.typ == "portrange" {
+		i := strings.Index(id, "-")
+		if i < 0 {
+			return nil, p.errorf(t, "invalid port range %q", id)
+		}
+		lowText, highText = id[:i], id[i+1:]
+	}
+	low, errLow := strconv.ParseUint(lowText, 10, 16)
+	high, errHigh := strconv.ParseUint(highText, 10, 16)
+	if errLow != nil || errHigh != nil {
+		return nil, p.errorf(t, "invalid port %q, service names are not supported", id)
+	}
+	if low > high {
+		low, high = high, low
+	}
+
+	nl := p.netOff()
+	port := func(load ...bpf.Instruction) node {
+		if low == high {
+			return cmpNode{load: load, cond: bpf.JumpEqual, val: uint32(low)}
+		}
+		return and(cmpNode{load: load, cond: bpf.JumpGreaterOrEqual, val: uint32(low)},
+			cmpNode{load: load, cond: bpf.JumpLessOrEqual, val: uint32(high)})
+	}
+
+	var ip4Protos, ip6Protos []node
+	for _, proto := range protos {
+		ip4Protos = append(ip4Protos, p.cmpLoad(bpf.LoadAbsolute{Off: nl + 9, Size: 1}, uint32(proto)))
+		ip6Protos = append(ip6Protos, p.cmpLoad(bpf.LoadAbsolute{Off: nl + 6, Size: 1}, uint32(proto)))
+	}
+
+	return or(
+		and(p.protocol("ip"), or(ip4Protos...), p.notFragment(), p.direction(q.dir,
+			port(bpf.LoadMemShift{Off: nl}, bpf.LoadIndirect{Off: nl, Size: 2}),
+			port(bpf.LoadMemShift{Off: nl}, bpf.LoadIndirect{Off: nl + 2, Size: 2}))),
+		and(p.protocol("ip6"), or(ip6Protos...), p.direction(q.dir,
+			port(bpf.LoadAbsolute{Off: nl + 40, Size: 2}),
+			port(bpf.LoadAbsolute{Off: nl + 42, Size: 2}))),
+	), nil
+}
+
+func (p *parser) parseProto(q qualifiers) (node, error) {
+	if q.dir != "" {
+		return nil, p.errorf(p.peek(), "invalid direction %q for proto", q.dir)
+	}
+	id, t, err := p.id("")
+	if err != nil {
+		return nil, err
+	}
+
+	if q.proto == "ether" {
+		etherType, ok := etherTypes[id]
+		if !ok {
+			val, err := strconv.ParseUint(id, 0, 16)
+			if err != nil {
+				return nil, p.errorf(t, "invalid ether proto %q", id)
+			}
+			etherType = uint16(val)
+		}
+		return p.linkProto(etherType), nil
+	}
+
+	proto, ok := ipProtocols[id]
+	if !ok {
+		val, err := strconv.ParseUint(id, 0, 8)
+		if err != nil {
+			return nil, p.errorf(t, "invalid proto %q", id)
+		}
+		proto = uint8(val)
+	}
+
+	switch q.proto {
+	case "":
+		return or(p.ipProto(proto), p.ip6Proto(proto)), nil
+	case "ip":
+		return p.ipProto(proto), nil
+	case "ip6":
+		return p.ip6Proto(proto), nil
+	}
+	return nil, p.errorf(t, "invalid qualifier %q for proto", q.proto)
+}
+
+// netOff returns the offset of the network layer header.
+func (p *parser) netOff() uint32 {
+	if p.linkType == layers.LinkTypeEthernet {
+		return uint32(14 + 4*p.vlans)
+	}
+	return 0
+}
+
+func (p *parser) cmpLoad(load bpf.Instruction, val uint32) node {
+	return cmpNode{load: []bpf.Instruction{load}, cond: bpf.JumpEqual, val: val}
+}
+
+// linkProto returns the node checking the link layer for a network protocol.
+func (p *parser) linkProto(etherType uint16) node {
+	if p.linkType == layers.LinkTypeEthernet {
+		return p.cmpLoad(bpf.LoadAbsolute{Off: p.netOff() - 2, Size: 2}, uint32(etherType))
+	}
+
+	// Raw IP, the IP version is the high nibble of the first byte
+	var version uint32
+	switch etherType {
+	case 0x0800:
+		version = 0x40
+	case 0x86dd:
+		version = 0x60
+	default:
+		return constNode(false)
+	}
+	return cmpNode{
+		load: []bpf.Instruction{bpf.LoadAbsolute{Off: 0, Size: 1}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0}},
+		cond: bpf.JumpEqual,
+		val:  version,
+	}
+}
+
+// protocol returns the node for a primitive consisting of a protocol only, e.g. `tcp`.
+func (p *parser) protocol(name string) node {
+	switch name {
+	case "icmp":
+		return p.ipProto(1)
+	case "icmp6":
+		return p.ip6Proto(58)
+	case "tcp", "udp", "sctp":
+		return or(p.ipProto(ipProtocols[name]), p.ip6Proto(ipProtocols[name]))
+	}
+	return p.linkProto(etherTypes[name])
+}
+
+func (p *parser) ipProto(proto uint8) node {
+	return and(p.linkProto(etherTypes["ip"]), p.cmpLoad(bpf.LoadAbsolute{Off: p.netOff() + 9, Size: 1}, uint32(proto)))
+}
+
+// ip6Proto checks the next header of the IPv6 header and of a directly following fragment header.
+func (p *parser) ip6Proto(proto uint8) node {
+	nl := p.netOff()
+	return and(p.linkProto(etherTypes["ip6"]), or(
+		p.cmpLoad(bpf.LoadAbsolute{Off: nl + 6, Size: 1}, uint32(proto)),
+		and(p.cmpLoad(bpf.LoadAbsolute{Off: nl + 6, Size: 1}, 44), p.cmpLoad(bpf.LoadAbsolute{Off: nl + 40, Size: 1}, uint32(proto))),
+	))
+}
+
+// notFragment is true for IPv4 packets, which are not a fragment or the first fragment.
+func (p *parser) notFragment() node {
+	return cmpNode{load: []bpf.Instruction{bpf.LoadAbsolute{Off: p.netOff() + 6, Size: 2}}, cond: bpf.JumpBitsNotSet, val: 0x1fff}
+}
+
+// addr compares the address at offset off of the network layer header with ip.
+func (p *parser) addr(off uint32, ip net.IP, mask net.IPMask) node {
+	var nodes []node
+	for i := 0; i < len(ip); i += 4 {
+		m := uint32(mask[i])<<24 | uint32(mask[i+1])<<16 | uint32(mask[i+2])<<8 | uint32(mask[i+3])
+		if m == 0 {
+			continue
+		}
+		val := uint32(ip[i])<<24 | uint32(ip[i+1])<<16 | uint32(ip[i+2])<<8 | uint32(ip[i+3])
+		load := []bpf.Instruction{bpf.LoadAbsolute{Off: p.netOff() + off + uint32(i), Size: 4}}
+		if m != 0xffffffff {
+			load = append(load, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: m})
+		}
+		nodes = append(nodes, cmpNode{load: load, cond: bpf.JumpEqual, val: val})
+	}
+	return and(nodes...)
+}
+
+func (p *parser) etherHost(off uint32, mac net.HardwareAddr) node {
+	return and(
+		p.cmpLoad(bpf.LoadAbsolute{Off: off + 2, Size: 4}, uint32(mac[2])<<24|uint32(mac[3])<<16|uint32(mac[4])<<8|uint32(mac[5])),
+		p.cmpLoad(bpf.LoadAbsolute{Off: off, Size: 2}, uint32(mac[0])<<8|uint32(mac[1])),
+	)
+}
+
+// direction combines the nodes for source and destination according to dir.
+func (p *parser) direction(dir string, src, dst node) node {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	case "src and dst":
+		return and(src, dst)
+	}
+	return or(src, dst)
+}
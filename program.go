@@ -0,0 +1,382 @@
+package bpfutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/bpf"
+)
+
+// Program is a BPF program, which is encoded as JSON and YAML with one object per instruction.
+// Every object has the bpf_asm mnemonic of the instruction in `op` and its operands in fields
+// named after the fields of the instructions in golang.org/x/net/bpf:
+//
+//	[
+//	  {"op": "ldh", "off": 12, "size": 2},
+//	  {"op": "jeq", "val": 2048, "skip_true": 0, "skip_false": 1},
+//	  {"op": "ret", "val": 65535},
+//	  {"op": "ret", "val": 0}
+//	]
+//
+// The fields are:
+// * off: the offset of a packet load, `ld`, `ldh` and `ldb` as well as `ldx` for `ldx 4*([k]&0xf)`
+// * size: the size of a packet load, which may be omitted as it is given by op
+// * x: true, if the load is relative to X (`ld [x + k]`) or the operand is X (`add x`, `jeq x`)
+// * n: the index of the scratch memory of `ld`, `ldx`, `st` and `stx`
+// * ext: the name of the extension of `ld`, e.g. `len`
+// * val: the constant of loads, ALU operations, conditional jumps and `ret`
+// * skip: the skip count of `jmp`
+// * skip_true, skip_false: the skip counts of conditional jumps, skip_false may be omitted if 0
+// * a: true for `ret a`
+//
+// Unlike bpf_asm, conditional jumps are never negated, the mnemonic for bpf.JumpBitsNotSet is
+// `jnset`. Unknown fields and fields, which do not belong to op, are rejected.
+type Program []bpf.Instruction
+
+// instructionSchema is the JSON and YAML encoding of a single instruction.
+type instructionSchema struct {
+	Op        string  `json:"op" yaml:"op"`
+	Off       *uint32 `json:"off,omitempty" yaml:"off,omitempty"`
+	Size      *int    `json:"size,omitempty" yaml:"size,omitempty"`
+	X         bool    `json:"x,omitempty" yaml:"x,omitempty"`
+	N         *int    `json:"n,omitempty" yaml:"n,omitempty"`
+	Ext       string  `json:"ext,omitempty" yaml:"ext,omitempty"`
+	Val       *uint32 `json:"val,omitempty" yaml:"val,omitempty"`
+	Skip      *uint32 `json:"skip,omitempty" yaml:"skip,omitempty"`
+	SkipTrue  *uint8  `json:"skip_true,omitempty" yaml:"skip_true,omitempty"`
+	SkipFalse *uint8  `json:"skip_false,omitempty" yaml:"skip_false,omitempty"`
+	A         bool    `json:"a,omitempty" yaml:"a,omitempty"`
+}
+
+var programJumpConds = map[string]bpf.JumpTest{
+	"jeq":   bpf.JumpEqual,
+	"jneq":  bpf.JumpNotEqual,
+	"jgt":   bpf.JumpGreaterThan,
+	"jlt":   bpf.JumpLessThan,
+	"jge":   bpf.JumpGreaterOrEqual,
+	"jle":   bpf.JumpLessOrEqual,
+	"jset":  bpf.JumpBitsSet,
+	"jnset": bpf.JumpBitsNotSet,
+}
+
+// MarshalJSON returns the program as JSON array with one object per instruction.
+func (p Program) MarshalJSON() ([]byte, error) {
+	schemas, err := p.schemas()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(schemas)
+}
+
+// UnmarshalJSON reads a program encoded by MarshalJSON.
+func (p *Program) UnmarshalJSON(data []byte) error {
+	var schemas []instructionSchema
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&schemas); err != nil {
+		return err
+	}
+	return p.fromSchemas(schemas)
+}
+
+// MarshalYAML returns the program for the encoding as YAML sequence with one mapping per
+// instruction. It implements the Marshaler interface of gopkg.in/yaml.v2 and gopkg.in/yaml.v3.
+func (p Program) MarshalYAML() (interface{}, error) {
+	return p.schemas()
+}
+
+// UnmarshalYAML reads a program encoded by MarshalYAML. It implements the Unmarshaler
+// interface of gopkg.in/yaml.v2, which is supported by gopkg.in/yaml.v3 as well.
+func (p *Program) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var schemas []instructionSchema
+	if err := unmarshal(&schemas); err != nil {
+		return err
+	}
+	return p.fromSchemas(schemas)
+}
+
+func (p Program) schemas() ([]instructionSchema, error) {
+	schemas := make([]instructionSchema, 0, len(p))
+	for i, inst := range p {
+		s, err := newInstructionSchema(inst)
+		if err != nil {
+			return nil, fmt.Errorf("instruction %d: %s", i, err.Error())
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+func (p *Program) fromSchemas(schemas []instructionSchema) error {
+	prog := make(Program, 0, len(schemas))
+	for i, s := range schemas {
+		inst, err := s.instruction()
+		if err != nil {
+			return fmt.Errorf("instruction %d: %s", i, err.Error())
+		}
+		prog = append(prog, inst)
+	}
+	*p = prog
+	return nil
+}
+
+// newInstructionSchema returns the encoding of instr.
+func newInstructionSchema(instr bpf.Instruction) (instructionSchema, error) {
+	switch inst := instr.(type) {
+	case bpf.ALUOpConstant:
+		op, ok := aluName(inst.Op)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, Val: &inst.Val}, nil
+
+	case bpf.ALUOpX:
+		op, ok := aluName(inst.Op)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, X: true}, nil
+
+	case bpf.NegateA:
+		return instructionSchema{Op: "neg"}, nil
+
+	case bpf.Jump:
+		return instructionSchema{Op: "jmp", Skip: &inst.Skip}, nil
+
+	case bpf.JumpIf:
+		op, ok := jumpName(inst.Cond)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, Val: &inst.Val, SkipTrue: &inst.SkipTrue, SkipFalse: &inst.SkipFalse}, nil
+
+	case bpf.JumpIfX:
+		op, ok := jumpName(inst.Cond)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, X: true, SkipTrue: &inst.SkipTrue, SkipFalse: &inst.SkipFalse}, nil
+
+	case bpf.LoadAbsolute:
+		op, ok := loadName(inst.Size)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, Off: &inst.Off, Size: &inst.Size}, nil
+
+	case bpf.LoadIndirect:
+		op, ok := loadName(inst.Size)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, Off: &inst.Off, Size: &inst.Size, X: true}, nil
+
+	case bpf.LoadMemShift:
+		return instructionSchema{Op: "ldx", Off: &inst.Off}, nil
+
+	case bpf.LoadConstant:
+		op, ok := registerName("ld", inst.Dst)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, Val: &inst.Val}, nil
+
+	case bpf.LoadExtension:
+		ext, ok := extensionNames[inst.Num]
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: "ld", Ext: ext}, nil
+
+	case bpf.LoadScratch:
+		op, ok := registerName("ld", inst.Dst)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, N: &inst.N}, nil
+
+	case bpf.StoreScratch:
+		op, ok := registerName("st", inst.Src)
+		if !ok {
+			break
+		}
+		return instructionSchema{Op: op, N: &inst.N}, nil
+
+	case bpf.TAX:
+		return instructionSchema{Op: "tax"}, nil
+
+	case bpf.TXA:
+		return instructionSchema{Op: "txa"}, nil
+
+	case bpf.RetA:
+		return instructionSchema{Op: "ret", A: true}, nil
+
+	case bpf.RetConstant:
+		return instructionSchema{Op: "ret", Val: &inst.Val}, nil
+	}
+
+	return instructionSchema{}, fmt.Errorf("unknown instruction: %#v", instr)
+}
+
+// instruction returns the instruction encoded by s.
+func (s instructionSchema) instruction() (bpf.Instruction, error) {
+	inst, err := s.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	// fields, which do not belong to op, are detected by the comparison with the encoding
+	// of the decoded instruction
+	canonical, err := newInstructionSchema(inst)
+	if err != nil {
+		return nil, err
+	}
+	if s.Size == nil {
+		s.Size = canonical.Size
+	}
+	if s.SkipFalse == nil {
+		s.SkipFalse = canonical.SkipFalse
+	}
+	if s.Ext != "" {
+		// aliases of the extension names
+		s.Ext = canonical.Ext
+	}
+	if !reflect.DeepEqual(s, canonical) {
+		return nil, fmt.Errorf("invalid fields for %q", s.Op)
+	}
+	return inst, nil
+}
+
+// decode returns the instruction selected by op and the present fields of s.
+func (s instructionSchema) decode() (bpf.Instruction, error) {
+	switch s.Op {
+	case "ld", "ldh", "ldb":
+		switch {
+		case s.Ext != "":
+			num, ok := asmExtensions[s.Ext]
+			if !ok {
+				return nil, fmt.Errorf("unknown extension %q", s.Ext)
+			}
+			return bpf.LoadExtension{Num: num}, nil
+		case s.N != nil:
+			return bpf.LoadScratch{Dst: bpf.RegA, N: *s.N}, nil
+		case s.Val != nil:
+			return bpf.LoadConstant{Dst: bpf.RegA, Val: *s.Val}, nil
+		case s.Off != nil && s.X:
+			return bpf.LoadIndirect{Off: *s.Off, Size: asmLoadSizes[s.Op]}, nil
+		case s.Off != nil:
+			return bpf.LoadAbsolute{Off: *s.Off, Size: asmLoadSizes[s.Op]}, nil
+		}
+
+	case "ldx":
+		switch {
+		case s.N != nil:
+			return bpf.LoadScratch{Dst: bpf.RegX, N: *s.N}, nil
+		case s.Val != nil:
+			return bpf.LoadConstant{Dst: bpf.RegX, Val: *s.Val}, nil
+		case s.Off != nil:
+			return bpf.LoadMemShift{Off: *s.Off}, nil
+		}
+
+	case "st", "stx":
+		if s.N != nil {
+			src := bpf.RegA
+			if s.Op == "stx" {
+				src = bpf.RegX
+			}
+			return bpf.StoreScratch{Src: src, N: *s.N}, nil
+		}
+
+	case "neg":
+		return bpf.NegateA{}, nil
+
+	case "tax":
+		return bpf.TAX{}, nil
+
+	case "txa":
+		return bpf.TXA{}, nil
+
+	case "jmp":
+		if s.Skip != nil {
+			return bpf.Jump{Skip: *s.Skip}, nil
+		}
+
+	case "ret":
+		switch {
+		case s.A:
+			return bpf.RetA{}, nil
+		case s.Val != nil:
+			return bpf.RetConstant{Val: *s.Val}, nil
+		}
+
+	default:
+		if op, ok := asmALUOps[s.Op]; ok {
+			switch {
+			case s.X:
+				return bpf.ALUOpX{Op: op}, nil
+			case s.Val != nil:
+				return bpf.ALUOpConstant{Op: op, Val: *s.Val}, nil
+			}
+			break
+		}
+		if cond, ok := programJumpConds[s.Op]; ok {
+			if s.SkipTrue == nil {
+				return nil, fmt.Errorf("missing skip_true for %q", s.Op)
+			}
+			var skipFalse uint8
+			if s.SkipFalse != nil {
+				skipFalse = *s.SkipFalse
+			}
+			switch {
+			case s.X:
+				return bpf.JumpIfX{Cond: cond, SkipTrue: *s.SkipTrue, SkipFalse: skipFalse}, nil
+			case s.Val != nil:
+				return bpf.JumpIf{Cond: cond, Val: *s.Val, SkipTrue: *s.SkipTrue, SkipFalse: skipFalse}, nil
+			}
+			break
+		}
+		return nil, fmt.Errorf("unknown op %q", s.Op)
+	}
+
+	return nil, fmt.Errorf("missing operand for %q", s.Op)
+}
+
+func aluName(op bpf.ALUOp) (string, bool) {
+	for name, aluOp := range asmALUOps {
+		if aluOp == op {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func jumpName(cond bpf.JumpTest) (string, bool) {
+	for name, jumpCond := range programJumpConds {
+		if jumpCond == cond {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func loadName(size int) (string, bool) {
+	for name, loadSize := range asmLoadSizes {
+		if loadSize == size {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// registerName returns mnemonic for register A and mnemonic with the suffix `x` for register X.
+func registerName(mnemonic string, reg bpf.Register) (string, bool) {
+	switch reg {
+	case bpf.RegA:
+		return mnemonic, true
+	case bpf.RegX:
+		return mnemonic + "x", true
+	}
+	return "", false
+}
@@ -0,0 +1,149 @@
+package bpfutils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestProgramJSON(t *testing.T) {
+	prog := Program{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	}
+	expect := `[{"op":"ldh","off":12,"size":2},{"op":"jeq","val":2048,"skip_true":0,"skip_false":1},{"op":"ret","val":65535},{"op":"ret","val":0}]`
+
+	got, err := json.Marshal(prog)
+	if err != nil {
+		t.Fatalf("failed to marshal with error: %s", err.Error())
+	}
+	if string(got) != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expect)
+	}
+}
+
+func TestProgramRoundTrip(t *testing.T) {
+	prog := Program{
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 42},
+		bpf.LoadConstant{Dst: bpf.RegX, Val: 42},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+		bpf.LoadScratch{Dst: bpf.RegX, N: 15},
+		bpf.LoadAbsolute{Off: 42, Size: 1},
+		bpf.LoadAbsolute{Off: 42, Size: 2},
+		bpf.LoadAbsolute{Off: 42, Size: 4},
+		bpf.LoadIndirect{Off: 42, Size: 1},
+		bpf.LoadIndirect{Off: 42, Size: 2},
+		bpf.LoadIndirect{Off: 42, Size: 4},
+		bpf.LoadMemShift{Off: 42},
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.LoadExtension{Num: bpf.ExtVLANTagPresent},
+		bpf.StoreScratch{Src: bpf.RegA, N: 3},
+		bpf.StoreScratch{Src: bpf.RegX, N: 15},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 42},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2},
+		bpf.ALUOpX{Op: bpf.ALUOpMod},
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.NegateA{},
+		bpf.Jump{Skip: 10},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 42, SkipTrue: 0, SkipFalse: 8},
+		bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 42, SkipTrue: 7},
+		bpf.JumpIf{Cond: bpf.JumpBitsNotSet, Val: 42, SkipTrue: 6, SkipFalse: 5},
+		bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipTrue: 4, SkipFalse: 3},
+		bpf.JumpIfX{Cond: bpf.JumpBitsSet, SkipTrue: 2},
+		bpf.TAX{},
+		bpf.TXA{},
+		bpf.RetA{},
+		bpf.RetConstant{Val: 42},
+	}
+
+	data, err := json.MarshalIndent(prog, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to marshal with error: %s", err.Error())
+	}
+	var got Program
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to unmarshal with error: %s\n%s", err.Error(), data)
+	}
+	if !reflect.DeepEqual(got, prog) {
+		t.Errorf("JSON round trip failed, got:\n%s\nexpected:\n%s", AsmString(got), AsmString(prog))
+	}
+
+	// the YAML encoding uses the same schema, decode it with encoding/json in place of a
+	// YAML library
+	value, err := prog.MarshalYAML()
+	if err != nil {
+		t.Fatalf("failed to marshal YAML with error: %s", err.Error())
+	}
+	if data, err = json.Marshal(value); err != nil {
+		t.Fatalf("failed to marshal YAML value with error: %s", err.Error())
+	}
+	got = nil
+	err = got.UnmarshalYAML(func(v interface{}) error {
+		return json.Unmarshal(data, v)
+	})
+	if err != nil {
+		t.Fatalf("failed to unmarshal YAML with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, prog) {
+		t.Errorf("YAML round trip failed, got:\n%s\nexpected:\n%s", AsmString(got), AsmString(prog))
+	}
+}
+
+func TestProgramUnmarshalJSON(t *testing.T) {
+	input := `[
+		{"op": "ldb", "off": 23},
+		{"op": "jeq", "val": 6, "skip_true": 1},
+		{"op": "ld", "ext": "vlan_pr"},
+		{"op": "ret", "a": true}
+	]`
+	expect := Program{
+		bpf.LoadAbsolute{Off: 23, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 1},
+		bpf.LoadExtension{Num: bpf.ExtVLANTagPresent},
+		bpf.RetA{},
+	}
+
+	var got Program
+	if err := json.Unmarshal([]byte(input), &got); err != nil {
+		t.Fatalf("failed to unmarshal with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got:\n%s\nexpected:\n%s", AsmString(got), AsmString(expect))
+	}
+}
+
+func TestProgramUnmarshalJSONError(t *testing.T) {
+	cases := []struct {
+		input string
+		err   string
+	}{
+		{input: `[{"op": "foo"}]`, err: `instruction 0: unknown op "foo"`},
+		{input: `[{"op": "tax"}, {"op": "ldh"}]`, err: `instruction 1: missing operand for "ldh"`},
+		{input: `[{"op": "ldh", "off": 12, "size": 4}]`, err: `instruction 0: invalid fields for "ldh"`},
+		{input: `[{"op": "ldh", "val": 12}]`, err: `instruction 0: invalid fields for "ldh"`},
+		{input: `[{"op": "tax", "val": 1}]`, err: `instruction 0: invalid fields for "tax"`},
+		{input: `[{"op": "ret", "val": 1, "skip": 2}]`, err: `instruction 0: invalid fields for "ret"`},
+		{input: `[{"op": "jeq", "val": 1}]`, err: `instruction 0: missing skip_true for "jeq"`},
+		{input: `[{"op": "ld", "ext": "foo"}]`, err: `instruction 0: unknown extension "foo"`},
+		{input: `[{"op": "ret", "value": 1}]`, err: `json: unknown field "value"`},
+	}
+
+	for _, test := range cases {
+		var got Program
+		err := json.Unmarshal([]byte(test.input), &got)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error: %v, expected: %s", test.input, err, test.err)
+		}
+	}
+}
+
+func TestProgramMarshalJSONError(t *testing.T) {
+	prog := Program{bpf.RetA{}, InvalidInstruction{}}
+	if _, err := json.Marshal(prog); err == nil {
+		t.Errorf("expected error for invalid instruction")
+	}
+}
@@ -0,0 +1,314 @@
+package bpfutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+
+	"golang.org/x/net/bpf"
+
+	"github.com/breml/bpfutils/internal/reloc"
+)
+
+// linkLayer describes the link layer header of a link type.
+type linkLayer struct {
+	// headerLen is the length of the link layer header.
+	headerLen uint32
+	// protoOff and protoSize locate the field containing the network layer protocol,
+	// protoSize is 0 if there is no such field.
+	protoOff, protoSize uint32
+	// family is true, if the protocol is an address family (AF_*) instead of an ethertype.
+	family bool
+}
+
+var linkLayers = map[layers.LinkType]linkLayer{
+	layers.LinkTypeEthernet: {headerLen: 14, protoOff: 12, protoSize: 2},
+	layers.LinkTypeLinuxSLL: {headerLen: 16, protoOff: 14, protoSize: 2},
+	layers.LinkTypeNull:     {headerLen: 4, protoOff: 0, protoSize: 4, family: true},
+	layers.LinkTypeRaw:      {},
+}
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+)
+
+// Offsets of the special areas for negative load offsets in the kernel.
+const (
+	// skfLLOff (SKF_LL_OFF) addresses the packet relative to the link layer header.
+	skfLLOff uint32 = 0xffe00000
+	// skfNetOff (SKF_NET_OFF) addresses the packet relative to the network layer header.
+	skfNetOff uint32 = 0xfff00000
+	// skfADOff (SKF_AD_OFF) addresses the ancillary data extensions.
+	skfADOff uint32 = 0xfffff000
+)
+
+// Address families of DLT_NULL in host byte order, as loaded by `ld [0]` on little and big
+// endian hosts. AF_INET6 differs between the BSDs (24), FreeBSD (28) and Darwin (30).
+var (
+	familiesIPv4 = []uint32{0x02000000, 2}
+	familiesIPv6 = []uint32{0x18000000, 0x1c000000, 0x1e000000, 24, 28, 30}
+)
+
+// RebaseError is returned by Rebase, if a program can not be rebased.
+type RebaseError struct {
+	// Index of the offending instruction, -1 if the problem concerns the whole program.
+	Index int
+	// Instruction is the offending instruction in bpf_asm syntax.
+	Instruction string
+	Msg         string
+}
+
+// Error returns the error in the form `index: instruction: message`.
+func (e *RebaseError) Error() string {
+	return Diagnostic(*e).String()
+}
+
+// Rebase rewrites prog, which expects packets with the link layer header of from, for packets
+// with the link layer header of to. Supported link types are layers.LinkTypeEthernet,
+// layers.LinkTypeLinuxSLL, layers.LinkTypeNull (BSD loopback) and layers.LinkTypeRaw.
+//
+// The offsets of LoadAbsolute, LoadIndirect and LoadMemShift beyond the link layer header are
+// moved by the difference of the header lengths. Loads of the protocol field of from are
+// replaced by instructions, which load the equivalent value from the protocol field of to.
+// For layers.LinkTypeRaw, which has no protocol field, the ethertype is derived from the IP
+// version. If from has no protocol field, a check for IPv4 or IPv6 is prepended, if to has one.
+// The packet length loaded by `ld #len` is adjusted by the difference of the header lengths as
+// well, packets shorter than this difference are treated as packets of length 0.
+// Loads relative to SKF_LL_OFF are moved like the other loads, loads relative to SKF_NET_OFF
+// and of other ancillary data are independent of the link type and kept unchanged.
+//
+// A RebaseError is returned, if prog can not be rebased:
+// * loads of other fields of the link layer header, e.g. Ethernet addresses
+// * indirect loads with an offset inside of the link layer header or relative to SKF_LL_OFF
+// * indirect loads, for which X is not known to be 0 or a header length loaded by
+//   `ldx 4*([k]&0xf)`, as X may contain an offset including the link layer header
+// * loads of the address family of layers.LinkTypeNull, as AF_INET6 is ambiguous
+func Rebase(prog []bpf.Instruction, from, to layers.LinkType) ([]bpf.Instruction, error) {
+	fromLink, ok := linkLayers[from]
+	if !ok {
+		return nil, fmt.Errorf("unsupported link type %s", from)
+	}
+	toLink, ok := linkLayers[to]
+	if !ok {
+		return nil, fmt.Errorf("unsupported link type %s", to)
+	}
+	if diags := Verify(prog); diags != nil {
+		return nil, &RebaseError{Index: diags[0].Index, Instruction: diags[0].Instruction, Msg: "invalid program: " + diags[0].Msg}
+	}
+	if from == to {
+		return append([]bpf.Instruction{}, prog...), nil
+	}
+
+	var rebaseErr *RebaseError
+	fail := func(i int, format string, args ...interface{}) bool {
+		if rebaseErr == nil {
+			rebaseErr = &RebaseError{
+				Index:       i,
+				Instruction: strings.TrimRight(asmString(prog[i], skipCount), "\n"),
+				Msg:         fmt.Sprintf(format, args...),
+			}
+		}
+		return true
+	}
+	offset := func(off uint32) uint32 {
+		return off - fromLink.headerLen + toLink.headerLen
+	}
+	xHeaderLen := headerLenX(prog)
+
+	p := &reloc.Program{}
+	if fromLink.protoSize == 0 && toLink.protoSize != 0 {
+		// from only carries IP packets
+		start := p.NewLabel()
+		vals := []uint32{etherTypeIPv4, etherTypeIPv6}
+		if toLink.family {
+			vals = append(append([]uint32{}, familiesIPv4...), familiesIPv6...)
+		}
+		p.Append(bpf.LoadAbsolute{Off: toLink.protoOff, Size: int(toLink.protoSize)})
+		for _, val := range vals {
+			next := p.NewLabel()
+			p.JumpIf(bpf.JumpEqual, val, start, next)
+			p.Mark(next)
+		}
+		p.Append(bpf.RetConstant{Val: 0})
+		p.Mark(start)
+	}
+
+	err := p.AppendRelocated(prog, p.NewLabels(len(prog)+1), func(i int, instr bpf.Instruction) bool {
+		switch inst := instr.(type) {
+		case bpf.LoadExtension:
+			if inst.Num == bpf.ExtLen {
+				loadLen(p, fromLink, toLink)
+				return true
+			}
+		case bpf.LoadAbsolute:
+			switch {
+			case inst.Size == 4 && inst.Off == skfADOff+uint32(bpf.ExtLen):
+				loadLen(p, fromLink, toLink)
+				return true
+			case inst.Off >= skfNetOff:
+				// SKF_NET_OFF and the ancillary data are independent of the link type
+				return false
+			case inst.Off >= skfLLOff:
+				if inst.Off-skfLLOff < fromLink.headerLen {
+					return fail(i, "the %s header has no equivalent in %s", from, to)
+				}
+				inst.Off = skfLLOff + offset(inst.Off-skfLLOff)
+				p.Append(inst)
+				return true
+			case int32(inst.Off) < 0:
+				// out of bounds for every packet
+				return false
+			case inst.Off >= fromLink.headerLen:
+				inst.Off = offset(inst.Off)
+				p.Append(inst)
+				return true
+			case fromLink.protoSize != 0 && inst.Off == fromLink.protoOff && uint32(inst.Size) == fromLink.protoSize:
+				if fromLink.family {
+					return fail(i, "the address family of %s can not be derived from %s", from, to)
+				}
+				loadEtherType(p, toLink)
+				return true
+			}
+			return fail(i, "the %s header has no equivalent in %s", from, to)
+		case bpf.LoadIndirect:
+			switch {
+			case inst.Off >= skfNetOff:
+				return false
+			case int32(inst.Off) < 0:
+				return fail(i, "indirect load relative to the %s header", from)
+			case !xHeaderLen[i]:
+				return fail(i, "indirect load with X not known to be a header length")
+			case inst.Off < fromLink.headerLen:
+				return fail(i, "indirect load with offset inside of the %s header", from)
+			}
+			inst.Off = offset(inst.Off)
+			p.Append(inst)
+			return true
+		case bpf.LoadMemShift:
+			switch {
+			case inst.Off >= skfNetOff:
+				return false
+			case inst.Off >= skfLLOff:
+				if inst.Off-skfLLOff < fromLink.headerLen {
+					return fail(i, "the %s header has no equivalent in %s", from, to)
+				}
+				inst.Off = skfLLOff + offset(inst.Off-skfLLOff)
+			case int32(inst.Off) < 0:
+				return false
+			case inst.Off < fromLink.headerLen:
+				return fail(i, "the %s header has no equivalent in %s", from, to)
+			default:
+				inst.Off = offset(inst.Off)
+			}
+			p.Append(inst)
+			return true
+		}
+		return false
+	})
+	if rebaseErr != nil {
+		return nil, rebaseErr
+	}
+	if err != nil {
+		return nil, &RebaseError{Index: -1, Msg: err.Error()}
+	}
+
+	return p.Instructions(), nil
+}
+
+// headerLenX returns for every instruction of prog, whether X is either 0 or a header length
+// loaded by `ldx 4*([k]&0xf)` on all paths to the instruction. prog must pass Verify.
+func headerLenX(prog []bpf.Instruction) []bool {
+	headerLen := make([]bool, len(prog)+1)
+	for i := range headerLen {
+		headerLen[i] = true
+	}
+	for i, instr := range prog {
+		x := headerLen[i]
+		next := []int{i + 1}
+		switch inst := instr.(type) {
+		case bpf.LoadMemShift:
+			x = true
+		case bpf.LoadConstant:
+			if inst.Dst == bpf.RegX {
+				x = inst.Val == 0
+			}
+		case bpf.LoadScratch:
+			if inst.Dst == bpf.RegX {
+				x = false
+			}
+		case bpf.TAX, bpf.RawInstruction:
+			x = false
+		case bpf.Jump:
+			next = []int{i + 1 + int(inst.Skip)}
+		case bpf.JumpIf:
+			next = []int{i + 1 + int(inst.SkipTrue), i + 1 + int(inst.SkipFalse)}
+		case bpf.JumpIfX:
+			next = []int{i + 1 + int(inst.SkipTrue), i + 1 + int(inst.SkipFalse)}
+		case bpf.RetA, bpf.RetConstant:
+			next = nil
+		}
+		for _, n := range next {
+			headerLen[n] = headerLen[n] && x
+		}
+	}
+	return headerLen[:len(prog)]
+}
+
+// loadLen adds instructions, which load the length of the packet with the link layer header of
+// to as the length the packet would have with the link layer header of from into A.
+func loadLen(p *reloc.Program, from, to linkLayer) {
+	p.Append(bpf.LoadExtension{Num: bpf.ExtLen})
+	switch {
+	case from.headerLen > to.headerLen:
+		p.Append(bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: from.headerLen - to.headerLen})
+	case from.headerLen < to.headerLen:
+		// avoid the underflow for packets shorter than the difference
+		diff := to.headerLen - from.headerLen
+		sub, short := p.NewLabel(), p.NewLabel()
+		p.JumpIf(bpf.JumpGreaterOrEqual, diff, sub, short)
+		p.Mark(short)
+		p.Append(bpf.LoadConstant{Dst: bpf.RegA, Val: diff})
+		p.Mark(sub)
+		p.Append(bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: diff})
+	}
+}
+
+// loadEtherType adds instructions, which load the ethertype of the packet from the link layer
+// header of link into A.
+func loadEtherType(p *reloc.Program, link linkLayer) {
+	if link.protoSize != 0 && !link.family {
+		p.Append(bpf.LoadAbsolute{Off: link.protoOff, Size: int(link.protoSize)})
+		return
+	}
+
+	ipv4, ipv6, end := p.NewLabel(), p.NewLabel(), p.NewLabel()
+	ipv4Vals, ipv6Vals := familiesIPv4, familiesIPv6
+	if link.family {
+		p.Append(bpf.LoadAbsolute{Off: link.protoOff, Size: int(link.protoSize)})
+	} else {
+		// the version of the IP header
+		p.Append(bpf.LoadAbsolute{Off: 0, Size: 1})
+		p.Append(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0})
+		ipv4Vals, ipv6Vals = []uint32{0x40}, []uint32{0x60}
+	}
+	for _, val := range ipv4Vals {
+		next := p.NewLabel()
+		p.JumpIf(bpf.JumpEqual, val, ipv4, next)
+		p.Mark(next)
+	}
+	for _, val := range ipv6Vals {
+		next := p.NewLabel()
+		p.JumpIf(bpf.JumpEqual, val, ipv6, next)
+		p.Mark(next)
+	}
+	p.Append(bpf.LoadConstant{Dst: bpf.RegA, Val: 0})
+	p.Jump(end)
+	p.Mark(ipv4)
+	p.Append(bpf.LoadConstant{Dst: bpf.RegA, Val: etherTypeIPv4})
+	p.Jump(end)
+	p.Mark(ipv6)
+	p.Append(bpf.LoadConstant{Dst: bpf.RegA, Val: etherTypeIPv6})
+	p.Mark(end)
+}
@@ -0,0 +1,401 @@
+package bpfutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+
+	"golang.org/x/net/bpf"
+)
+
+// withLinkType replaces the DLT_NULL header of a packet from test_loopback.pcap by the link
+// layer header of linkType.
+func withLinkType(packet []byte, linkType layers.LinkType) []byte {
+	var header []byte
+	switch linkType {
+	case layers.LinkTypeNull:
+		return packet
+	case layers.LinkTypeEthernet:
+		header = append(make([]byte, 12), 0x86, 0xdd)
+	case layers.LinkTypeLinuxSLL:
+		header = append(make([]byte, 14), 0x86, 0xdd)
+	}
+	return append(header, packet[4:]...)
+}
+
+var ethernetFilters = map[string][]bpf.Instruction{
+	"ip6 and tcp": {
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x86dd, SkipTrue: 3},
+		bpf.LoadAbsolute{Off: 20, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	},
+	"ip6 and tcp src port 58806": {
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x86dd, SkipTrue: 5},
+		bpf.LoadAbsolute{Off: 20, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 6, SkipTrue: 3},
+		bpf.LoadAbsolute{Off: 54, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 58806, SkipTrue: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	},
+	"ip or ip6": {
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	},
+	"ip": {
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	},
+	"greater 500": {
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 500, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	},
+}
+
+func TestRebaseSemantics(t *testing.T) {
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	for name, filter := range ethernetFilters {
+		for _, linkType := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeNull, layers.LinkTypeRaw} {
+			rebased, err := Rebase(filter, layers.LinkTypeEthernet, linkType)
+			if err != nil {
+				t.Errorf("'%s' to %s: failed with error: %s", name, linkType, err.Error())
+				continue
+			}
+			if diags := Verify(rebased); diags != nil {
+				t.Errorf("'%s' to %s: rebased program is invalid: %v\n%s", name, linkType, diags, AsmString(rebased))
+				continue
+			}
+
+			for i, packet := range packets {
+				expect := runFilter(t, filter, withLinkType(packet, layers.LinkTypeEthernet))
+				if got := runFilter(t, rebased, withLinkType(packet, linkType)); got != expect {
+					t.Errorf("'%s' to %s: packet %d returned %d, expected %d\n%s", name, linkType, i, got, expect, AsmString(rebased))
+				}
+			}
+		}
+	}
+}
+
+func TestRebaseFromRaw(t *testing.T) {
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	// ip6[6] == 6 for raw IP
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x60, SkipTrue: 3},
+		bpf.LoadAbsolute{Off: 6, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	}
+
+	for _, linkType := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeNull} {
+		rebased, err := Rebase(filter, layers.LinkTypeRaw, linkType)
+		if err != nil {
+			t.Errorf("to %s: failed with error: %s", linkType, err.Error())
+			continue
+		}
+		for i, packet := range packets {
+			if got := runFilter(t, rebased, withLinkType(packet, linkType)); got != 65535 {
+				t.Errorf("to %s: packet %d returned %d, expected 65535\n%s", linkType, i, got, AsmString(rebased))
+			}
+		}
+
+		// packets of other protocols are dropped by the prepended check
+		// withLinkType returns packets[0] itself for DLT_NULL
+		arp := append([]byte{}, withLinkType(packets[0], linkType)...)
+		for i := range arp {
+			arp[i] = 0
+		}
+		if got := runFilter(t, rebased, arp); got != 0 {
+			t.Errorf("to %s: packet without IP returned %d, expected 0\n%s", linkType, got, AsmString(rebased))
+		}
+	}
+}
+
+func TestRebase(t *testing.T) {
+	cases := []struct {
+		description string
+		from, to    layers.LinkType
+		prog        []bpf.Instruction
+		expected    []bpf.Instruction
+	}{
+		{
+			description: "ethernet to linux sll",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeLinuxSLL,
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 12, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x800, SkipTrue: 3},
+				bpf.LoadMemShift{Off: 14},
+				bpf.LoadIndirect{Off: 16, Size: 2},
+				bpf.RetA{},
+				bpf.RetConstant{Val: 0},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 14, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x800, SkipTrue: 3},
+				bpf.LoadMemShift{Off: 16},
+				bpf.LoadIndirect{Off: 18, Size: 2},
+				bpf.RetA{},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			description: "offsets relative to the link and network layer header",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeLinuxSLL,
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfLLOff + 23, Size: 1},
+				bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1},
+				bpf.LoadMemShift{Off: skfLLOff + 14},
+				bpf.LoadMemShift{Off: skfNetOff},
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 14},
+				bpf.LoadIndirect{Off: skfNetOff + 2, Size: 2},
+				bpf.RetA{},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfLLOff + 25, Size: 1},
+				bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1},
+				bpf.LoadMemShift{Off: skfLLOff + 16},
+				bpf.LoadMemShift{Off: skfNetOff},
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 14},
+				bpf.LoadIndirect{Off: skfNetOff + 2, Size: 2},
+				bpf.RetA{},
+			},
+		},
+		{
+			description: "indirect load with X of 0 or a header length on all paths",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeLinuxSLL,
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 23, Size: 1},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 2},
+				bpf.TAX{},
+				bpf.RetA{},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipTrue: 1},
+				bpf.LoadMemShift{Off: 14},
+				bpf.LoadIndirect{Off: 14, Size: 2},
+				bpf.RetA{},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 25, Size: 1},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 2},
+				bpf.TAX{},
+				bpf.RetA{},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipTrue: 1},
+				bpf.LoadMemShift{Off: 16},
+				bpf.LoadIndirect{Off: 16, Size: 2},
+				bpf.RetA{},
+			},
+		},
+		{
+			description: "ethernet to raw",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 12, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+				bpf.RetConstant{Val: 65535},
+				bpf.RetConstant{Val: 0},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 0, Size: 1},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40, SkipTrue: 3},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x60, SkipTrue: 4},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
+				bpf.Jump{Skip: 3},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0x800},
+				bpf.Jump{Skip: 1},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0x86dd},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+				bpf.RetConstant{Val: 65535},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			description: "raw to ethernet",
+			from:        layers.LinkTypeRaw,
+			to:          layers.LinkTypeEthernet,
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 9, Size: 1},
+				bpf.RetA{},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 12, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipTrue: 1},
+				bpf.RetConstant{Val: 0},
+				bpf.LoadAbsolute{Off: 23, Size: 1},
+				bpf.RetA{},
+			},
+		},
+		{
+			description: "length to a shorter header",
+			from:        layers.LinkTypeLinuxSLL,
+			to:          layers.LinkTypeNull,
+			prog: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 12},
+				bpf.RetA{},
+			},
+		},
+		{
+			description: "length to a longer header",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeLinuxSLL,
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 0xfffff000 + uint32(bpf.ExtLen), Size: 4},
+				bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 100, SkipFalse: 1},
+				bpf.RetConstant{Val: 65535},
+				bpf.RetConstant{Val: 0},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 2, SkipTrue: 1},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 2},
+				bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 2},
+				bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 100, SkipFalse: 1},
+				bpf.RetConstant{Val: 65535},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			description: "same link type, network offsets are unchanged",
+			from:        layers.LinkTypeNull,
+			to:          layers.LinkTypeNull,
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 0, Size: 4},
+				bpf.LoadAbsolute{Off: 0xfff00000 + 9, Size: 1},
+				bpf.RetA{},
+			},
+			expected: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 0, Size: 4},
+				bpf.LoadAbsolute{Off: 0xfff00000 + 9, Size: 1},
+				bpf.RetA{},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		got, err := Rebase(test.prog, test.from, test.to)
+		if err != nil {
+			t.Errorf("case '%s': failed with error: %s", test.description, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("case '%s'\ngot:\n%s\nexpected:\n%s", test.description, AsmString(got), AsmString(test.expected))
+		}
+	}
+}
+
+func TestRebaseError(t *testing.T) {
+	cases := []struct {
+		description string
+		from, to    layers.LinkType
+		prog        []bpf.Instruction
+		err         string
+	}{
+		{
+			description: "unsupported link type",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeIEEE802_11,
+			prog:        []bpf.Instruction{bpf.RetConstant{Val: 0}},
+			err:         "unsupported link type 802.11",
+		},
+		{
+			description: "invalid program",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			err:         "invalid program: empty program",
+		},
+		{
+			description: "ethernet address",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeLinuxSLL,
+			prog:        []bpf.Instruction{bpf.LoadAbsolute{Off: 6, Size: 4}, bpf.RetA{}},
+			err:         "0: ld [6]: the Ethernet header has no equivalent in Linux SLL",
+		},
+		{
+			description: "part of the ethertype",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			prog:        []bpf.Instruction{bpf.LoadAbsolute{Off: 13, Size: 1}, bpf.RetA{}},
+			err:         "0: ldb [13]: the Ethernet header has no equivalent in Raw",
+		},
+		{
+			description: "indirect load",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			prog:        []bpf.Instruction{bpf.LoadMemShift{Off: 14}, bpf.LoadIndirect{Off: 0, Size: 1}, bpf.RetA{}},
+			err:         "1: ldb [x + 0]: indirect load with offset inside of the Ethernet header",
+		},
+		{
+			description: "indirect load with constant X",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			prog:        []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegX, Val: 14}, bpf.LoadIndirect{Off: 0, Size: 1}, bpf.RetA{}},
+			err:         "1: ldb [x + 0]: indirect load with X not known to be a header length",
+		},
+		{
+			description: "indirect load with X from A on one path",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			prog: []bpf.Instruction{
+				bpf.LoadMemShift{Off: 14},
+				bpf.LoadAbsolute{Off: 23, Size: 1},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 1},
+				bpf.TAX{},
+				bpf.LoadIndirect{Off: 14, Size: 2},
+				bpf.RetA{},
+			},
+			err: "4: ldh [x + 14]: indirect load with X not known to be a header length",
+		},
+		{
+			description: "link layer header relative to SKF_LL_OFF",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			prog:        []bpf.Instruction{bpf.LoadAbsolute{Off: skfLLOff + 12, Size: 2}, bpf.RetA{}},
+			err:         "0: ldh [ll+12]: the Ethernet header has no equivalent in Raw",
+		},
+		{
+			description: "indirect load relative to SKF_LL_OFF",
+			from:        layers.LinkTypeEthernet,
+			to:          layers.LinkTypeRaw,
+			prog:        []bpf.Instruction{bpf.LoadIndirect{Off: skfLLOff + 14, Size: 1}, bpf.RetA{}},
+			err:         "0: ldb [x + ll+14]: indirect load relative to the Ethernet header",
+		},
+		{
+			description: "address family",
+			from:        layers.LinkTypeNull,
+			to:          layers.LinkTypeEthernet,
+			prog:        loopbackFilters["ip6 and tcp"],
+			err:         "0: ld [0]: the address family of Null can not be derived from Ethernet",
+		},
+	}
+
+	for _, test := range cases {
+		if _, err := Rebase(test.prog, test.from, test.to); err == nil || err.Error() != test.err {
+			t.Errorf("case '%s': got error %v, expected '%s'", test.description, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package bpfutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// PacketMetadata provides the values for the Linux ancillary data loads (e.g. `ld #proto`),
+// which are not derived from the packet data itself. Extension returns false, if the value
+// for ext is not available.
+type PacketMetadata interface {
+	Extension(ext bpf.Extension) (uint32, bool)
+}
+
+// StaticMetadata is a PacketMetadata with a fixed value per extension.
+type StaticMetadata map[bpf.Extension]uint32
+
+// Extension returns the value for ext.
+func (m StaticMetadata) Extension(ext bpf.Extension) (uint32, bool) {
+	val, ok := m[ext]
+	return val, ok
+}
+
+// TraceStep is the state of the interpreter after the execution of a single instruction.
+type TraceStep struct {
+	PC          int
+	Instruction bpf.Instruction
+	A, X        uint32
+	M           [16]uint32
+	// Taken is true, if the condition of a conditional jump was true.
+	Taken bool
+	// Next is the index of the next instruction, -1 if the program has returned.
+	Next int
+}
+
+// Trace is the per instruction trace of a program executed by Run.
+type Trace []TraceStep
+
+// String returns the trace with one executed instruction per line in bpf_asm syntax,
+// followed by the registers after the execution.
+func (t Trace) String() string {
+	var buffer bytes.Buffer
+	for _, step := range t {
+		inst := strings.TrimRight(asmString(step.Instruction, skipCount), "\n")
+		buffer.WriteString(fmt.Sprintf("%4d: %-24s A=%#x X=%#x", step.PC, inst, step.A, step.X))
+		switch step.Instruction.(type) {
+		case bpf.JumpIf, bpf.JumpIfX:
+			buffer.WriteString(fmt.Sprintf(" %t", step.Taken))
+		}
+		if step.Next >= 0 && step.Next != step.PC+1 {
+			buffer.WriteString(fmt.Sprintf(" -> %d", step.Next))
+		}
+		buffer.WriteString("\n")
+	}
+	return buffer.String()
+}
+
+// RunOption configures Run.
+type RunOption func(*runConfig)
+
+type runConfig struct {
+	trace     bool
+	metadata  PacketMetadata
+	headers   bool
+	linkLayer []byte
+	network   int
+}
+
+// WithTrace enables the recording of the per instruction Trace.
+func WithTrace() RunOption {
+	return func(c *runConfig) {
+		c.trace = true
+	}
+}
+
+// WithMetadata sets the PacketMetadata used for the ancillary data loads.
+func WithMetadata(md PacketMetadata) RunOption {
+	return func(c *runConfig) {
+		c.metadata = md
+	}
+}
+
+// WithHeaders sets the position of the headers for the loads relative to the link layer header
+// (SKF_LL_OFF, e.g. `ldh [ll+12]`) and the network layer header (SKF_NET_OFF, e.g.
+// `ldb [net+9]`). linkLayer is the link layer header, if it is not part of the packet like on
+// cooked (SOCK_DGRAM) sockets, and nil otherwise. network is the offset of the network layer
+// header in the packet.
+func WithHeaders(linkLayer []byte, network int) RunOption {
+	return func(c *runConfig) {
+		c.headers = true
+		c.linkLayer = linkLayer
+		c.network = network
+	}
+}
+
+// Run executes prog for the packet pkt and returns the value of the `ret` instruction,
+// which is the number of bytes of the packet to accept (0 drops the packet).
+//
+// Like the Linux kernel, Run returns 0 if a load is out of the bounds of the packet or if
+// register X is zero for a division. Besides `ld #len`, the ancillary data loads are served
+// by the PacketMetadata provided with WithMetadata. Loads relative to the link layer or the
+// network layer header require WithHeaders.
+//
+// If WithTrace is given, the state after every executed instruction is recorded and returned
+// as Trace, also if an error occurs.
+func Run(prog []bpf.Instruction, pkt []byte, opts ...RunOption) (uint32, Trace, error) {
+	config := runConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	vm := interpreter{pkt: pkt, metadata: config.metadata}
+	if config.headers {
+		vm.headers = true
+		vm.frame = append(append([]byte{}, config.linkLayer...), pkt...)
+		vm.network = len(config.linkLayer) + config.network
+	}
+	var trace Trace
+
+	for pc := 0; pc < len(prog); {
+		next, ret, done, err := vm.step(prog[pc], pc)
+		if err != nil {
+			return 0, trace, fmt.Errorf("instruction %d: %s", pc, err.Error())
+		}
+		if done {
+			next = -1
+		}
+		if config.trace {
+			trace = append(trace, TraceStep{
+				PC:          pc,
+				Instruction: prog[pc],
+				A:           vm.a,
+				X:           vm.x,
+				M:           vm.m,
+				Taken:       vm.taken,
+				Next:        next,
+			})
+		}
+		if done {
+			return ret, trace, nil
+		}
+		if next > len(prog) {
+			return 0, trace, fmt.Errorf("instruction %d: jump beyond end of program", pc)
+		}
+		pc = next
+	}
+
+	return 0, trace, fmt.Errorf("program does not end with a return")
+}
+
+// interpreter is the state of the classic BPF machine.
+type interpreter struct {
+	a, x     uint32
+	m        [16]uint32
+	taken    bool
+	pkt      []byte
+	metadata PacketMetadata
+	// frame is the packet including the link layer header and network is the offset of the
+	// network layer header in frame, if headers is true.
+	headers bool
+	frame   []byte
+	network int
+}
+
+// step executes the instruction at pc. It returns the index of the next instruction or the
+// return value and done set to true, if the program has returned.
+func (vm *interpreter) step(instr bpf.Instruction, pc int) (next int, ret uint32, done bool, err error) {
+	next = pc + 1
+	vm.taken = false
+
+	switch inst := instr.(type) {
+	case bpf.ALUOpConstant:
+		if (inst.Op == bpf.ALUOpDiv || inst.Op == bpf.ALUOpMod) && inst.Val == 0 {
+			return 0, 0, false, fmt.Errorf("division by constant zero")
+		}
+		vm.a, err = alu(inst.Op, vm.a, inst.Val)
+
+	case bpf.ALUOpX:
+		if (inst.Op == bpf.ALUOpDiv || inst.Op == bpf.ALUOpMod) && vm.x == 0 {
+			return 0, 0, true, nil
+		}
+		vm.a, err = alu(inst.Op, vm.a, vm.x)
+
+	case bpf.NegateA:
+		vm.a = -vm.a
+
+	case bpf.Jump:
+		next += int(inst.Skip)
+
+	case bpf.JumpIf:
+		vm.taken, err = jumpTest(inst.Cond, vm.a, inst.Val)
+		next += jumpSkip(vm.taken, inst.SkipTrue, inst.SkipFalse)
+
+	case bpf.JumpIfX:
+		vm.taken, err = jumpTest(inst.Cond, vm.a, vm.x)
+		next += jumpSkip(vm.taken, inst.SkipTrue, inst.SkipFalse)
+
+	case bpf.LoadAbsolute:
+		if inst.Size == 4 && inst.Off > 0xFFFFFFFF-0x1000 {
+			vm.a, err = vm.loadExtension(bpf.Extension(inst.Off + 0x1000))
+			break
+		}
+		if !validLoadSize(inst.Size) {
+			return 0, 0, false, fmt.Errorf("invalid load size %d", inst.Size)
+		}
+		var ok bool
+		if vm.a, ok, err = vm.load(uint64(inst.Off), inst.Size); err == nil && !ok {
+			return 0, 0, true, nil
+		}
+
+	case bpf.LoadIndirect:
+		if !validLoadSize(inst.Size) {
+			return 0, 0, false, fmt.Errorf("invalid load size %d", inst.Size)
+		}
+		var ok bool
+		if vm.a, ok, err = vm.load(uint64(vm.x)+uint64(inst.Off), inst.Size); err == nil && !ok {
+			return 0, 0, true, nil
+		}
+
+	case bpf.LoadMemShift:
+		var b uint32
+		var ok bool
+		if b, ok, err = vm.load(uint64(inst.Off), 1); err == nil && !ok {
+			return 0, 0, true, nil
+		}
+		vm.x = 4 * (b & 0xf)
+
+	case bpf.LoadConstant:
+		switch inst.Dst {
+		case bpf.RegA:
+			vm.a = inst.Val
+		case bpf.RegX:
+			vm.x = inst.Val
+		default:
+			err = fmt.Errorf("invalid register %d", inst.Dst)
+		}
+
+	case bpf.LoadExtension:
+		vm.a, err = vm.loadExtension(inst.Num)
+
+	case bpf.LoadScratch:
+		if inst.N < 0 || inst.N >= len(vm.m) {
+			return 0, 0, false, fmt.Errorf("invalid scratch slot %d", inst.N)
+		}
+		switch inst.Dst {
+		case bpf.RegA:
+			vm.a = vm.m[inst.N]
+		case bpf.RegX:
+			vm.x = vm.m[inst.N]
+		default:
+			err = fmt.Errorf("invalid register %d", inst.Dst)
+		}
+
+	case bpf.StoreScratch:
+		if inst.N < 0 || inst.N >= len(vm.m) {
+			return 0, 0, false, fmt.Errorf("invalid scratch slot %d", inst.N)
+		}
+		switch inst.Src {
+		case bpf.RegA:
+			vm.m[inst.N] = vm.a
+		case bpf.RegX:
+			vm.m[inst.N] = vm.x
+		default:
+			err = fmt.Errorf("invalid register %d", inst.Src)
+		}
+
+	case bpf.TAX:
+		vm.x = vm.a
+
+	case bpf.TXA:
+		vm.a = vm.x
+
+	case bpf.RetA:
+		return 0, vm.a, true, nil
+
+	case bpf.RetConstant:
+		return 0, inst.Val, true, nil
+
+	default:
+		err = fmt.Errorf("unknown instruction: %#v", inst)
+	}
+
+	return next, 0, false, err
+}
+
+func validLoadSize(size int) bool {
+	return size == 1 || size == 2 || size == 4
+}
+
+// load reads size bytes in network byte order from offset off of the packet. Offsets in the
+// range of SKF_NET_OFF and SKF_LL_OFF are relative to the network layer and link layer header.
+func (vm *interpreter) load(off uint64, size int) (uint32, bool, error) {
+	if off < uint64(skfLLOff) || off >= uint64(skfADOff) {
+		val, ok := loadBytes(vm.pkt, off, size)
+		return val, ok, nil
+	}
+	header := "link layer"
+	if off >= uint64(skfNetOff) {
+		header = "network layer"
+	}
+	if !vm.headers {
+		return 0, false, fmt.Errorf("no header offsets for load relative to the %s header", header)
+	}
+	if off >= uint64(skfNetOff) {
+		off = uint64(vm.network) + off - uint64(skfNetOff)
+	} else {
+		off -= uint64(skfLLOff)
+	}
+	val, ok := loadBytes(vm.frame, off, size)
+	return val, ok, nil
+}
+
+// loadBytes reads size bytes in network byte order from offset off of data.
+func loadBytes(data []byte, off uint64, size int) (uint32, bool) {
+	if off+uint64(size) > uint64(len(data)) {
+		return 0, false
+	}
+	switch size {
+	case 1:
+		return uint32(data[off]), true
+	case 2:
+		return uint32(binary.BigEndian.Uint16(data[off:])), true
+	case 4:
+		return binary.BigEndian.Uint32(data[off:]), true
+	}
+	return 0, false
+}
+
+func (vm *interpreter) loadExtension(ext bpf.Extension) (uint32, error) {
+	if ext == bpf.ExtLen {
+		return uint32(len(vm.pkt)), nil
+	}
+	if vm.metadata != nil {
+		if val, ok := vm.metadata.Extension(ext); ok {
+			return val, nil
+		}
+	}
+	return 0, fmt.Errorf("no metadata for extension %d", ext)
+}
+
+func alu(op bpf.ALUOp, a, val uint32) (uint32, error) {
+	switch op {
+	case bpf.ALUOpAdd:
+		return a + val, nil
+	case bpf.ALUOpSub:
+		return a - val, nil
+	case bpf.ALUOpMul:
+		return a * val, nil
+	case bpf.ALUOpDiv:
+		return a / val, nil
+	case bpf.ALUOpMod:
+		return a % val, nil
+	case bpf.ALUOpAnd:
+		return a & val, nil
+	case bpf.ALUOpOr:
+		return a | val, nil
+	case bpf.ALUOpXor:
+		return a ^ val, nil
+	case bpf.ALUOpShiftLeft:
+		return a << val, nil
+	case bpf.ALUOpShiftRight:
+		return a >> val, nil
+	}
+	return 0, fmt.Errorf("invalid ALU operation %d", op)
+}
+
+func jumpTest(cond bpf.JumpTest, a, val uint32) (bool, error) {
+	switch cond {
+	case bpf.JumpEqual:
+		return a == val, nil
+	case bpf.JumpNotEqual:
+		return a != val, nil
+	case bpf.JumpGreaterThan:
+		return a > val, nil
+	case bpf.JumpLessThan:
+		return a < val, nil
+	case bpf.JumpGreaterOrEqual:
+		return a >= val, nil
+	case bpf.JumpLessOrEqual:
+		return a <= val, nil
+	case bpf.JumpBitsSet:
+		return a&val != 0, nil
+	case bpf.JumpBitsNotSet:
+		return a&val == 0, nil
+	}
+	return false, fmt.Errorf("invalid jump condition %d", cond)
+}
+
+func jumpSkip(taken bool, skipTrue, skipFalse uint8) int {
+	if taken {
+		return int(skipTrue)
+	}
+	return int(skipFalse)
+}
@@ -0,0 +1,289 @@
+package bpfutils
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+		packet      []byte
+		metadata    PacketMetadata
+		expect      uint32
+	}{
+		{
+			description: "load out of bounds",
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 2, Size: 4},
+				bpf.RetConstant{Val: 1},
+			},
+			packet: []byte{1, 2, 3, 4, 5},
+			expect: 0,
+		},
+		{
+			description: "load indirect",
+			prog: []bpf.Instruction{
+				bpf.LoadMemShift{Off: 0},
+				bpf.LoadIndirect{Off: 1, Size: 2},
+				bpf.RetA{},
+			},
+			packet: []byte{0x01, 0, 0, 0, 0, 0xab, 0xcd},
+			expect: 0xabcd,
+		},
+		{
+			description: "division by zero",
+			prog: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 10},
+				bpf.ALUOpX{Op: bpf.ALUOpDiv},
+				bpf.RetConstant{Val: 1},
+			},
+			expect: 0,
+		},
+		{
+			description: "scratch memory and alu",
+			prog: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 3},
+				bpf.StoreScratch{Src: bpf.RegX, N: 15},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 10},
+				bpf.ALUOpX{Op: bpf.ALUOpMul},
+				bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 2},
+				bpf.TAX{},
+				bpf.LoadScratch{Dst: bpf.RegA, N: 15},
+				bpf.ALUOpX{Op: bpf.ALUOpAdd},
+				bpf.RetA{},
+			},
+			expect: 31,
+		},
+		{
+			description: "jump if x",
+			prog: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 3},
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipTrue: 1},
+				bpf.RetConstant{Val: 1},
+				bpf.RetConstant{Val: 2},
+			},
+			packet: []byte{1, 2, 3, 4},
+			expect: 2,
+		},
+		{
+			description: "extensions",
+			prog: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtProto},
+				bpf.TAX{},
+				bpf.LoadAbsolute{Off: 0xfffff038, Size: 4},
+				bpf.ALUOpX{Op: bpf.ALUOpAdd},
+				bpf.RetA{},
+			},
+			metadata: StaticMetadata{bpf.ExtProto: 0x800, bpf.ExtRand: 1},
+			expect:   0x801,
+		},
+	}
+
+	for _, test := range cases {
+		got, _, err := Run(test.prog, test.packet, WithMetadata(test.metadata))
+		if err != nil {
+			t.Errorf("case '%s': Run failed with error: %s", test.description, err.Error())
+			continue
+		}
+		if got != test.expect {
+			t.Errorf("case '%s': got: %d, expected: %d", test.description, got, test.expect)
+		}
+	}
+}
+
+func TestRunError(t *testing.T) {
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+	}{
+		{
+			description: "no return",
+			prog:        []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegA, Val: 1}},
+		},
+		{
+			description: "jump beyond end",
+			prog:        []bpf.Instruction{bpf.Jump{Skip: 2}, bpf.RetA{}},
+		},
+		{
+			description: "division by constant zero",
+			prog:        []bpf.Instruction{bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: 0}, bpf.RetA{}},
+		},
+		{
+			description: "missing metadata",
+			prog:        []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtType}, bpf.RetA{}},
+		},
+		{
+			description: "missing header offsets",
+			prog:        []bpf.Instruction{bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1}, bpf.RetA{}},
+		},
+		{
+			description: "invalid load size",
+			prog:        []bpf.Instruction{bpf.LoadIndirect{Off: 0, Size: 3}, bpf.RetA{}},
+		},
+		{
+			description: "invalid instruction",
+			prog:        []bpf.Instruction{InvalidInstruction{}, bpf.RetA{}},
+		},
+	}
+
+	for _, test := range cases {
+		if _, _, err := Run(test.prog, nil); err == nil {
+			t.Errorf("case '%s': expected error", test.description)
+		}
+	}
+}
+
+func TestRunHeaders(t *testing.T) {
+	// IPv4/UDP packet without the link layer header, as received on a cooked socket
+	ip := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2, 0x30, 0x39, 0x00, 0x35, 0, 8, 0, 0}
+	ethernet := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 0x08, 0x00}
+
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+		packet      []byte
+		linkLayer   []byte
+		network     int
+		expect      uint32
+	}{
+		{
+			description: "network layer on cooked socket",
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1},
+				bpf.RetA{},
+			},
+			packet:    ip,
+			linkLayer: ethernet,
+			expect:    17,
+		},
+		{
+			description: "link layer on cooked socket",
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfLLOff + 12, Size: 2},
+				bpf.RetA{},
+			},
+			packet:    ip,
+			linkLayer: ethernet,
+			expect:    0x800,
+		},
+		{
+			description: "link layer spanning the network layer header",
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfLLOff + 12, Size: 4},
+				bpf.RetA{},
+			},
+			packet:    ip,
+			linkLayer: ethernet,
+			expect:    0x08004500,
+		},
+		{
+			description: "network layer on raw socket",
+			prog: []bpf.Instruction{
+				bpf.LoadMemShift{Off: skfNetOff},
+				bpf.LoadIndirect{Off: skfNetOff + 2, Size: 2},
+				bpf.RetA{},
+			},
+			packet:  append(append([]byte{}, ethernet...), ip...),
+			network: 14,
+			expect:  53,
+		},
+		{
+			description: "link layer on raw socket",
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfLLOff + 12, Size: 2},
+				bpf.RetA{},
+			},
+			packet:  append(append([]byte{}, ethernet...), ip...),
+			network: 14,
+			expect:  0x800,
+		},
+		{
+			description: "out of bounds",
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: skfNetOff + 26, Size: 4},
+				bpf.RetConstant{Val: 1},
+			},
+			packet:    ip,
+			linkLayer: ethernet,
+			expect:    0,
+		},
+	}
+
+	for _, test := range cases {
+		got, _, err := Run(test.prog, test.packet, WithHeaders(test.linkLayer, test.network))
+		if err != nil {
+			t.Errorf("case '%s': Run failed with error: %s", test.description, err.Error())
+			continue
+		}
+		if got != test.expect {
+			t.Errorf("case '%s': got: %d, expected: %d", test.description, got, test.expect)
+		}
+	}
+}
+
+func TestRunTrace(t *testing.T) {
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.StoreScratch{Src: bpf.RegA, N: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 7, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.TAX{},
+		bpf.RetA{},
+	}
+
+	got, trace, err := Run(prog, []byte{7}, WithTrace())
+	if err != nil {
+		t.Fatalf("Run failed with error: %s", err.Error())
+	}
+	if got != 7 {
+		t.Errorf("got: %d, expected: 7", got)
+	}
+
+	m := [16]uint32{1: 7}
+	expect := Trace{
+		{PC: 0, Instruction: prog[0], A: 7, Next: 1},
+		{PC: 1, Instruction: prog[1], A: 7, M: m, Next: 2},
+		{PC: 2, Instruction: prog[2], A: 7, M: m, Taken: true, Next: 4},
+		{PC: 4, Instruction: prog[4], A: 7, X: 7, M: m, Next: 5},
+		{PC: 5, Instruction: prog[5], A: 7, X: 7, M: m, Next: -1},
+	}
+	if !reflect.DeepEqual(trace, expect) {
+		t.Errorf("got trace:\n%s\nexpected:\n%s", trace, expect)
+	}
+
+	expectString := `   0: ldb [0]                  A=0x7 X=0x0
+   1: st M[1]                  A=0x7 X=0x0
+   2: jeq #7,1                 A=0x7 X=0x0 true -> 4
+   4: tax                      A=0x7 X=0x7
+   5: ret a                    A=0x7 X=0x7
+`
+	if trace.String() != expectString {
+		t.Errorf("got trace string:\n%s\nexpected:\n%s", trace.String(), expectString)
+	}
+}
+
+func TestRunChainFilter(t *testing.T) {
+	packets := readPackets(t, "pcap/test_loopback.pcap")
+
+	for nameA, a := range loopbackFilters {
+		for nameB, b := range loopbackFilters {
+			for _, ct := range []ChainType{AND, OR, NOT, XOR, ANDNOT} {
+				chained := ChainFilter(a, b, ct)
+				for i, packet := range packets {
+					got, _, err := Run(chained, packet)
+					if err != nil {
+						t.Fatalf("packet %d: Run failed for '%s' %s '%s' with error: %s", i, nameA, ct, nameB, err.Error())
+					}
+					if expect := runFilter(t, chained, packet); int(got) != expect {
+						t.Errorf("packet %d: '%s' %s '%s' returned %d, expected %d", i, nameA, ct, nameB, got, expect)
+					}
+				}
+			}
+		}
+	}
+}
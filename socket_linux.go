@@ -0,0 +1,157 @@
+package bpfutils
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// AttachFilter attaches prog as socket filter to the socket fd (SO_ATTACH_FILTER). A filter
+// already attached to the socket is replaced.
+func AttachFilter(fd int, prog []bpf.Instruction) error {
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return fmt.Errorf("failed to assemble filter: %s", err.Error())
+	}
+	return AttachRawFilter(fd, raw)
+}
+
+// AttachRawFilter attaches the assembled program raw as socket filter to the socket fd
+// (SO_ATTACH_FILTER).
+func AttachRawFilter(fd int, raw []bpf.RawInstruction) error {
+	if len(raw) == 0 || len(raw) > MaxInstructions {
+		return fmt.Errorf("invalid filter length %d", len(raw))
+	}
+	filters := toSockFilters(raw)
+	fprog := unix.SockFprog{
+		Len:    uint16(len(filters)),
+		Filter: &filters[0],
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+		return fmt.Errorf("failed to attach filter: %s", err.Error())
+	}
+	return nil
+}
+
+// DetachFilter removes the socket filter from the socket fd (SO_DETACH_FILTER).
+func DetachFilter(fd int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0); err != nil {
+		return fmt.Errorf("failed to detach filter: %s", err.Error())
+	}
+	return nil
+}
+
+// LockFilter locks the socket filter of the socket fd (SO_LOCK_FILTER). Once locked, the
+// filter can neither be replaced nor detached for the lifetime of the socket.
+func LockFilter(fd int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_LOCK_FILTER, 1); err != nil {
+		return fmt.Errorf("failed to lock filter: %s", err.Error())
+	}
+	return nil
+}
+
+// GetFilter returns the socket filter attached to the socket fd (SO_GET_FILTER) or nil,
+// if no filter is attached.
+func GetFilter(fd int) ([]bpf.Instruction, error) {
+	raw, err := GetRawFilter(fd)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	prog, ok := bpf.Disassemble(raw)
+	if !ok {
+		return nil, fmt.Errorf("failed to disassemble filter")
+	}
+	return prog, nil
+}
+
+// GetRawFilter returns the socket filter attached to the socket fd (SO_GET_FILTER) as
+// []bpf.RawInstruction or nil, if no filter is attached.
+func GetRawFilter(fd int) ([]bpf.RawInstruction, error) {
+	for {
+		// the length of SO_GET_FILTER is given in instructions, with a length of 0 the
+		// kernel returns the length of the attached filter
+		n, err := getFilter(fd, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get filter: %s", err.Error())
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		filters := make([]unix.SockFilter, n)
+		n, err = getFilter(fd, filters)
+		if err == unix.EINVAL {
+			// the filter has been replaced by a longer one in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get filter: %s", err.Error())
+		}
+		return fromSockFilters(filters[:n]), nil
+	}
+}
+
+// getFilter calls getsockopt with SO_GET_FILTER, which is not provided by golang.org/x/sys/unix,
+// and returns the number of instructions of the attached filter.
+func getFilter(fd int, filters []unix.SockFilter) (int, error) {
+	var ptr unsafe.Pointer
+	if len(filters) > 0 {
+		ptr = unsafe.Pointer(&filters[0])
+	}
+	n := uint32(len(filters))
+	//#nosec
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_GET_FILTER, uintptr(ptr), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// sockFilterLayoutMatches is true, if unix.SockFilter and bpf.RawInstruction have the same
+// memory layout, see pcapLayoutMatches.
+var sockFilterLayoutMatches = unsafe.Sizeof(unix.SockFilter{}) == unsafe.Sizeof(bpf.RawInstruction{}) &&
+	unsafe.Offsetof(unix.SockFilter{}.Code) == unsafe.Offsetof(bpf.RawInstruction{}.Op) &&
+	unsafe.Sizeof(unix.SockFilter{}.Code) == unsafe.Sizeof(bpf.RawInstruction{}.Op) &&
+	unsafe.Offsetof(unix.SockFilter{}.Jt) == unsafe.Offsetof(bpf.RawInstruction{}.Jt) &&
+	unsafe.Sizeof(unix.SockFilter{}.Jt) == unsafe.Sizeof(bpf.RawInstruction{}.Jt) &&
+	unsafe.Offsetof(unix.SockFilter{}.Jf) == unsafe.Offsetof(bpf.RawInstruction{}.Jf) &&
+	unsafe.Sizeof(unix.SockFilter{}.Jf) == unsafe.Sizeof(bpf.RawInstruction{}.Jf) &&
+	unsafe.Offsetof(unix.SockFilter{}.K) == unsafe.Offsetof(bpf.RawInstruction{}.K) &&
+	unsafe.Sizeof(unix.SockFilter{}.K) == unsafe.Sizeof(bpf.RawInstruction{}.K)
+
+// toSockFilters converts a []bpf.RawInstruction into a []unix.SockFilter
+//#nosec
+func toSockFilters(in []bpf.RawInstruction) []unix.SockFilter {
+	if !sockFilterLayoutMatches {
+		out := make([]unix.SockFilter, len(in))
+		for i, inst := range in {
+			out[i] = unix.SockFilter{Code: inst.Op, Jt: inst.Jt, Jf: inst.Jf, K: inst.K}
+		}
+		return out
+	}
+	return *(*[]unix.SockFilter)(unsafe.Pointer(&in))
+}
+
+// fromSockFilters converts a []unix.SockFilter into a []bpf.RawInstruction
+//#nosec
+func fromSockFilters(in []unix.SockFilter) []bpf.RawInstruction {
+	if !sockFilterLayoutMatches {
+		out := make([]bpf.RawInstruction, len(in))
+		for i, inst := range in {
+			out[i] = bpf.RawInstruction{Op: inst.Code, Jt: inst.Jt, Jf: inst.Jf, K: inst.K}
+		}
+		return out
+	}
+	return *(*[]bpf.RawInstruction)(unsafe.Pointer(&in))
+}
+
+// NewSocketFilterManager returns a FilterManager for the socket fd, which replaces the filter
+// with SO_ATTACH_FILTER.
+func NewSocketFilterManager(fd int) *FilterManager {
+	return &FilterManager{
+		set: func(raw []bpf.RawInstruction) error {
+			return AttachRawFilter(fd, raw)
+		},
+	}
+}
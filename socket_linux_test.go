@@ -0,0 +1,228 @@
+package bpfutils
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+// udpPair returns a UDP socket listening on loopback and a socket connected to it.
+func udpPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("failed to listen on loopback with error: %s", err.Error())
+	}
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		server.Close()
+		t.Fatalf("failed to dial with error: %s", err.Error())
+	}
+	return server, client
+}
+
+// withFd calls f with the file descriptor of conn.
+func withFd(t *testing.T, conn *net.UDPConn, f func(fd int) error) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to get raw connection with error: %s", err.Error())
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		t.Fatalf("failed to control connection with error: %s", err.Error())
+	}
+	return ferr
+}
+
+// received sends the payloads over client and returns the payloads received by server.
+func received(t *testing.T, server, client *net.UDPConn, payloads ...string) []string {
+	for _, payload := range payloads {
+		if _, err := client.Write([]byte(payload)); err != nil {
+			t.Fatalf("failed to send with error: %s", err.Error())
+		}
+	}
+	var got []string
+	buf := make([]byte, 1500)
+	for {
+		server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := server.Read(buf)
+		if err != nil {
+			return got
+		}
+		got = append(got, string(buf[:n]))
+	}
+}
+
+func TestAttachFilter(t *testing.T) {
+	server, client := udpPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	// the filter of a UDP socket sees the packet starting with the UDP header, accept only
+	// datagrams with a payload of 5 bytes
+	prog := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 8 + 5, SkipFalse: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	}
+
+	expect, err := bpf.Assemble(prog)
+	if err != nil {
+		t.Fatalf("failed to assemble with error: %s", err.Error())
+	}
+
+	var attached []bpf.RawInstruction
+	err = withFd(t, server, func(fd int) error {
+		if got, err := GetFilter(fd); err != nil || got != nil {
+			t.Errorf("got %v and error %v without filter, expected nil", got, err)
+		}
+		if err := AttachFilter(fd, prog); err != nil {
+			return err
+		}
+		var err error
+		attached, err = GetRawFilter(fd)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(attached, expect) {
+		t.Errorf("got attached filter %v, expected %v", attached, expect)
+	}
+
+	if got := received(t, server, client, "hello", "hi", "world"); !reflect.DeepEqual(got, []string{"hello", "world"}) {
+		t.Errorf("got %q with filter, expected only payloads of 5 bytes", got)
+	}
+
+	if err := withFd(t, server, DetachFilter); err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+	if got := received(t, server, client, "hello", "hi"); !reflect.DeepEqual(got, []string{"hello", "hi"}) {
+		t.Errorf("got %q after detach, expected all payloads", got)
+	}
+}
+
+func TestLockFilter(t *testing.T) {
+	server, client := udpPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	drop := []bpf.Instruction{bpf.RetConstant{Val: 0}}
+	err := withFd(t, server, func(fd int) error {
+		if err := AttachFilter(fd, drop); err != nil {
+			return err
+		}
+		return LockFilter(fd)
+	})
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+
+	if err := withFd(t, server, DetachFilter); err == nil {
+		t.Errorf("expected error for detaching a locked filter")
+	}
+	accept := []bpf.Instruction{bpf.RetConstant{Val: 0xffff}}
+	if err := withFd(t, server, func(fd int) error { return AttachFilter(fd, accept) }); err == nil {
+		t.Errorf("expected error for replacing a locked filter")
+	}
+	if got := received(t, server, client, "hello"); got != nil {
+		t.Errorf("got %q with locked filter, expected no payloads", got)
+	}
+}
+
+func TestAttachFilterError(t *testing.T) {
+	server, client := udpPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+	}{
+		{
+			description: "empty program",
+		},
+		{
+			description: "no return",
+			prog:        []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegA, Val: 1}},
+		},
+		{
+			description: "invalid instruction",
+			prog:        []bpf.Instruction{InvalidInstruction{}, bpf.RetA{}},
+		},
+	}
+
+	for _, test := range cases {
+		if err := withFd(t, server, func(fd int) error { return AttachFilter(fd, test.prog) }); err == nil {
+			t.Errorf("case '%s': expected error", test.description)
+		}
+	}
+}
+
+func TestSocketFilterManager(t *testing.T) {
+	server, client := udpPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	// payloadLen accepts datagrams with a payload of n bytes
+	payloadLen := func(n uint32) FilterExpr {
+		return Filter([]bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtLen},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 8 + n, SkipFalse: 1},
+			bpf.RetConstant{Val: 0xffff},
+			bpf.RetConstant{Val: 0},
+		})
+	}
+
+	var m *FilterManager
+	withFd(t, server, func(fd int) error {
+		m = NewSocketFilterManager(fd)
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	for i := uint32(1); i <= 8; i++ {
+		wg.Add(1)
+		go func(n uint32) {
+			defer wg.Done()
+			if err := m.Update(payloadLen(n)); err != nil {
+				t.Errorf("failed to update with error: %s", err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	expect, err := bpf.Assemble(m.Current())
+	if err != nil {
+		t.Fatalf("failed to assemble with error: %s", err.Error())
+	}
+	var attached []bpf.RawInstruction
+	err = withFd(t, server, func(fd int) error {
+		var err error
+		attached, err = GetRawFilter(fd)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(attached, expect) {
+		t.Errorf("got attached filter %v, expected current filter %v", attached, expect)
+	}
+
+	if err := m.Update(Or(payloadLen(2), payloadLen(5))); err != nil {
+		t.Fatalf("failed to update with error: %s", err.Error())
+	}
+	if got := received(t, server, client, "hello", "abc", "hi"); !reflect.DeepEqual(got, []string{"hello", "hi"}) {
+		t.Errorf("got %q, expected payloads of 2 and 5 bytes", got)
+	}
+	if err := m.Rollback(); err != nil {
+		t.Fatalf("failed to roll back with error: %s", err.Error())
+	}
+	if got := received(t, server, client, "hello", "hi"); len(got) > 1 {
+		t.Errorf("got %q after rollback, expected at most one payload", got)
+	}
+}
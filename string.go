@@ -3,6 +3,7 @@ package bpfutils
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 
 	"github.com/google/gopacket/pcap"
 
@@ -28,7 +29,7 @@ func String(a []pcap.BPFInstruction) string {
 func AsmString(a []bpf.Instruction) string {
 	var buffer bytes.Buffer
 	for _, bpfInst := range a {
-		_, err := buffer.WriteString(asmString(bpfInst))
+		_, err := buffer.WriteString(asmString(bpfInst, skipCount))
 		if err != nil {
 			// Write to bytes.Buffer should actually never fail
 			// TODO: Should we change the function sig and return this err?
@@ -38,8 +39,59 @@ func AsmString(a []bpf.Instruction) string {
 	return buffer.String()
 }
 
-// TODO: Implement support for labels when printing the disassembled assembler code
-func asmString(instr bpf.Instruction) string {
+// AsmStringWithLabels returns []bpf.Instruction as bpf_asm instructions like AsmString,
+// but the targets of all jumps are replaced by generated labels. The label of an instruction
+// is derived from its index in the program, e.g. `L3:` for the fourth instruction.
+// Jumps with a target outside of the program keep their raw skip count.
+func AsmStringWithLabels(a []bpf.Instruction) string {
+	targets := jumpTargets(a)
+
+	var buffer bytes.Buffer
+	for i, bpfInst := range a {
+		if targets[i] {
+			buffer.WriteString(fmt.Sprintf("L%d:\n", i))
+		}
+		_, err := buffer.WriteString(asmString(bpfInst, labelTarget(i, len(a))))
+		if err != nil {
+			// Write to bytes.Buffer should actually never fail
+			return ""
+		}
+	}
+	return buffer.String()
+}
+
+// jumpTargets returns the set of instruction indexes, which are referenced as jump target
+// in the bpf_asm representation of a.
+func jumpTargets(a []bpf.Instruction) map[int]bool {
+	targets := make(map[int]bool)
+	for i, bpfInst := range a {
+		asmString(bpfInst, func(skip uint32) string {
+			targets[i+1+int(skip)] = true
+			return ""
+		})
+	}
+	return targets
+}
+
+// skipCount formats the target of a jump as raw skip count.
+func skipCount(skip uint32) string {
+	return strconv.FormatUint(uint64(skip), 10)
+}
+
+// labelTarget returns a function, which formats the target of a jump at index i as label.
+func labelTarget(i, length int) func(skip uint32) string {
+	return func(skip uint32) string {
+		target := i + 1 + int(skip)
+		if target >= length {
+			return skipCount(skip)
+		}
+		return fmt.Sprintf("L%d", target)
+	}
+}
+
+// asmString returns the bpf_asm representation of instr. The target of jumps is
+// formatted with target.
+func asmString(instr bpf.Instruction, target func(skip uint32) string) string {
 	switch inst := instr.(type) {
 	case bpf.ALUOpConstant:
 		switch inst.Op {
@@ -94,57 +146,25 @@ func asmString(instr bpf.Instruction) string {
 		}
 
 	case bpf.Jump:
-		return fmt.Sprintf("jmp %d\n", inst.Skip)
+		return fmt.Sprintf("jmp %s\n", target(inst.Skip))
 
 	case bpf.JumpIf:
-		switch inst.Cond {
-		// K == A
-		case bpf.JumpEqual:
-			return conditionalJump(inst, "jeq", "jneq")
-		// K != A
-		case bpf.JumpNotEqual:
-			return fmt.Sprintf("jneq #%d,%d\n", inst.Val, inst.SkipTrue)
-		// K > A
-		case bpf.JumpGreaterThan:
-			return conditionalJump(inst, "jgt", "jle")
-		// K < A
-		case bpf.JumpLessThan:
-			return fmt.Sprintf("jlt #%d,%d\n", inst.Val, inst.SkipTrue)
-
-		// K >= A
-		case bpf.JumpGreaterOrEqual:
-			return conditionalJump(inst, "jge", "jlt")
-		// K <= A
-		case bpf.JumpLessOrEqual:
-			return fmt.Sprintf("jle #%d,%d\n", inst.Val, inst.SkipTrue)
-		// K & A != 0
-		case bpf.JumpBitsSet:
-			if inst.SkipFalse > 0 {
-				return fmt.Sprintf("jset #%d,%d,%d\n", inst.Val, inst.SkipTrue, inst.SkipFalse)
-			}
-			return fmt.Sprintf("jset #%d,%d\n", inst.Val, inst.SkipTrue)
-		// K & A == 0
-		//case bpf.JumpBitsNotSet:
-		//	if inst.SkipFalse > 0 {
-		//		return fmt.Sprintf("jnset #%d,%d,%d\n", inst.Val, inst.SkipTrue, inst.SkipFalse)
-		//	} else {
-		//		return fmt.Sprintf("jnset #%d,%d\n", inst.Val, inst.SkipTrue)
-		//	}
-		default:
-			return fmt.Sprintf("!! unknown instruction: %#v\n", inst)
-		}
+		return conditionalJump(inst, inst.Cond, fmt.Sprintf("#%d", inst.Val), inst.SkipTrue, inst.SkipFalse, target)
+
+	case bpf.JumpIfX:
+		return conditionalJump(inst, inst.Cond, "x", inst.SkipTrue, inst.SkipFalse, target)
 
 	case bpf.LoadAbsolute:
 		switch inst.Size {
 		case 1: // byte
-			return fmt.Sprintf("ldb [%d]\n", inst.Off)
+			return fmt.Sprintf("ldb [%s]\n", loadOffset(inst.Off))
 		case 2: // half word
-			return fmt.Sprintf("ldh [%d]\n", inst.Off)
+			return fmt.Sprintf("ldh [%s]\n", loadOffset(inst.Off))
 		case 4: // word
 			if inst.Off > 0xFFFFFFFF-0x1000 {
 				return loadExtension(bpf.LoadExtension{Num: bpf.Extension(inst.Off + 0x1000)})
 			}
-			return fmt.Sprintf("ld [%d]\n", inst.Off)
+			return fmt.Sprintf("ld [%s]\n", loadOffset(inst.Off))
 		default:
 			return fmt.Sprintf("!! unknown instruction: %#v\n", inst)
 		}
@@ -165,17 +185,17 @@ func asmString(instr bpf.Instruction) string {
 	case bpf.LoadIndirect:
 		switch inst.Size {
 		case 1: // byte
-			return fmt.Sprintf("ldb [x + %d]\n", inst.Off)
+			return fmt.Sprintf("ldb [x + %s]\n", loadOffset(inst.Off))
 		case 2: // half word
-			return fmt.Sprintf("ldh [x + %d]\n", inst.Off)
+			return fmt.Sprintf("ldh [x + %s]\n", loadOffset(inst.Off))
 		case 4: // word
-			return fmt.Sprintf("ld [x + %d]\n", inst.Off)
+			return fmt.Sprintf("ld [x + %s]\n", loadOffset(inst.Off))
 		default:
 			return fmt.Sprintf("!! unknown instruction: %#v\n", inst)
 		}
 
 	case bpf.LoadMemShift:
-		return fmt.Sprintf("ldx 4*([%d]&0xf)\n", inst.Off)
+		return fmt.Sprintf("ldx 4*([%s]&0xf)\n", loadOffset(inst.Off))
 
 	case bpf.LoadScratch:
 		switch inst.Dst {
@@ -217,27 +237,99 @@ func asmString(instr bpf.Instruction) string {
 	}
 }
 
-func conditionalJump(inst bpf.JumpIf, positiveJump, negativeJump string) string {
-	if inst.SkipTrue > 0 {
-		if inst.SkipFalse > 0 {
-			return fmt.Sprintf("%s #%d,%d,%d\n", positiveJump, inst.Val, inst.SkipTrue, inst.SkipFalse)
-		}
-		return fmt.Sprintf("%s #%d,%d\n", positiveJump, inst.Val, inst.SkipTrue)
+// conditionalJump formats a conditional jump of inst, which compares A with operand.
+func conditionalJump(inst bpf.Instruction, cond bpf.JumpTest, operand string, skipTrue, skipFalse uint8, target func(skip uint32) string) string {
+	switch cond {
+	// K == A
+	case bpf.JumpEqual:
+		return negatableJump("jeq", "jneq", operand, skipTrue, skipFalse, target)
+	// K != A
+	case bpf.JumpNotEqual:
+		return jump("jneq", operand, skipTrue, skipFalse, target)
+	// K > A
+	case bpf.JumpGreaterThan:
+		return negatableJump("jgt", "jle", operand, skipTrue, skipFalse, target)
+	// K < A
+	case bpf.JumpLessThan:
+		return jump("jlt", operand, skipTrue, skipFalse, target)
+	// K >= A
+	case bpf.JumpGreaterOrEqual:
+		return negatableJump("jge", "jlt", operand, skipTrue, skipFalse, target)
+	// K <= A
+	case bpf.JumpLessOrEqual:
+		return jump("jle", operand, skipTrue, skipFalse, target)
+	// K & A != 0
+	case bpf.JumpBitsSet:
+		return jump("jset", operand, skipTrue, skipFalse, target)
+	// K & A == 0
+	//case bpf.JumpBitsNotSet:
+	//	if inst.SkipFalse > 0 {
+	//		return fmt.Sprintf("jnset #%d,%d,%d\n", inst.Val, inst.SkipTrue, inst.SkipFalse)
+	//	} else {
+	//		return fmt.Sprintf("jnset #%d,%d\n", inst.Val, inst.SkipTrue)
+	//	}
+	default:
+		return fmt.Sprintf("!! unknown instruction: %#v\n", inst)
+	}
+}
+
+// negatableJump formats a conditional jump, which is printed with the negated mnemonic, if the
+// true branch is the next instruction.
+func negatableJump(positiveJump, negativeJump, operand string, skipTrue, skipFalse uint8, target func(skip uint32) string) string {
+	if skipTrue == 0 {
+		return fmt.Sprintf("%s %s,%s\n", negativeJump, operand, target(uint32(skipFalse)))
 	}
-	return fmt.Sprintf("%s #%d,%d\n", negativeJump, inst.Val, inst.SkipFalse)
+	return jump(positiveJump, operand, skipTrue, skipFalse, target)
+}
+
+// jump formats a conditional jump. The false target is only omitted, if it is the next
+// instruction.
+func jump(mnemonic, operand string, skipTrue, skipFalse uint8, target func(skip uint32) string) string {
+	if skipFalse > 0 {
+		return fmt.Sprintf("%s %s,%s,%s\n", mnemonic, operand, target(uint32(skipTrue)), target(uint32(skipFalse)))
+	}
+	return fmt.Sprintf("%s %s,%s\n", mnemonic, operand, target(uint32(skipTrue)))
+}
+
+// extensionNames contains the bpf_asm names of the Linux ancillary data extensions (SKF_AD_*).
+var extensionNames = map[bpf.Extension]string{
+	bpf.ExtLen:               "len",
+	bpf.ExtProto:             "proto",
+	bpf.ExtType:              "type",
+	bpf.ExtPayloadOffset:     "poff",
+	bpf.ExtInterfaceIndex:    "ifidx",
+	bpf.ExtNetlinkAttr:       "nla",
+	bpf.ExtNetlinkAttrNested: "nlan",
+	bpf.ExtMark:              "mark",
+	bpf.ExtQueue:             "queue",
+	bpf.ExtLinkLayerType:     "hatype",
+	bpf.ExtRXHash:            "rxhash",
+	bpf.ExtCPUID:             "cpu",
+	bpf.ExtVLANTag:           "vlan_tci",
+	bpf.ExtVLANTagPresent:    "vlan_avail",
+	bpf.ExtVLANProto:         "vlan_tpid",
+	bpf.ExtRand:              "rand",
 }
 
 func loadExtension(inst bpf.LoadExtension) string {
-	switch inst.Num {
-	case bpf.ExtLen:
-		return "ld #len\n"
-	case bpf.ExtProto:
-		return "ld #proto\n"
-	case bpf.ExtType:
-		return "ld #type\n"
-	case bpf.ExtRand:
-		return "ld #rand\n"
-	default:
+	name, ok := extensionNames[inst.Num]
+	if !ok {
 		return fmt.Sprintf("!! unknown instruction: %#v\n", inst)
 	}
+	return fmt.Sprintf("ld #%s\n", name)
+}
+
+// loadOffset returns the offset of a packet load. Offsets relative to the network layer header
+// (SKF_NET_OFF) are written as `net+k`, offsets relative to the link layer header (SKF_LL_OFF)
+// as `ll+k`.
+func loadOffset(off uint32) string {
+	switch {
+	case off >= skfADOff:
+		return fmt.Sprintf("%d", off)
+	case off >= skfNetOff:
+		return fmt.Sprintf("net+%d", off-skfNetOff)
+	case off >= skfLLOff:
+		return fmt.Sprintf("ll+%d", off-skfLLOff)
+	}
+	return fmt.Sprintf("%d", off)
 }
@@ -81,6 +81,22 @@ func TestAsmString(t *testing.T) {
 			input:  bpf.LoadMemShift{Off: 42},
 			expect: "ldx 4*([42]&0xf)",
 		},
+		{
+			input:  bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1},
+			expect: "ldb [net+9]",
+		},
+		{
+			input:  bpf.LoadAbsolute{Off: skfLLOff + 12, Size: 2},
+			expect: "ldh [ll+12]",
+		},
+		{
+			input:  bpf.LoadIndirect{Off: skfNetOff + 2, Size: 2},
+			expect: "ldh [x + net+2]",
+		},
+		{
+			input:  bpf.LoadMemShift{Off: skfNetOff},
+			expect: "ldx 4*([net+0]&0xf)",
+		},
 		{
 			input:  bpf.LoadExtension{Num: bpf.ExtLen},
 			expect: "ld #len",
@@ -101,6 +117,58 @@ func TestAsmString(t *testing.T) {
 			input:  bpf.LoadAbsolute{Off: 0xfffff038, Size: 4},
 			expect: "ld #rand",
 		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtPayloadOffset},
+			expect: "ld #poff",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtInterfaceIndex},
+			expect: "ld #ifidx",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtNetlinkAttr},
+			expect: "ld #nla",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtNetlinkAttrNested},
+			expect: "ld #nlan",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtMark},
+			expect: "ld #mark",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtQueue},
+			expect: "ld #queue",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtLinkLayerType},
+			expect: "ld #hatype",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtRXHash},
+			expect: "ld #rxhash",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtCPUID},
+			expect: "ld #cpu",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtVLANTag},
+			expect: "ld #vlan_tci",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtVLANTagPresent},
+			expect: "ld #vlan_avail",
+		},
+		{
+			input:  bpf.LoadExtension{Num: bpf.ExtVLANProto},
+			expect: "ld #vlan_tpid",
+		},
+		{
+			input:  bpf.LoadAbsolute{Off: 0xfffff02c, Size: 4},
+			expect: "ld #vlan_tci",
+		},
 		{
 			input:  bpf.LoadExtension{Num: 0xfff},
 			expect: "!! unknown instruction: bpf.LoadExtension{Num:4095}",
@@ -229,14 +297,26 @@ func TestAsmString(t *testing.T) {
 			input:  bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 42, SkipTrue: 8},
 			expect: "jneq #42,8",
 		},
+		{
+			input:  bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 42, SkipTrue: 8, SkipFalse: 9},
+			expect: "jneq #42,8,9",
+		},
 		{
 			input:  bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 42, SkipTrue: 7},
 			expect: "jlt #42,7",
 		},
+		{
+			input:  bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 42, SkipTrue: 7, SkipFalse: 9},
+			expect: "jlt #42,7,9",
+		},
 		{
 			input:  bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 42, SkipTrue: 6},
 			expect: "jle #42,6",
 		},
+		{
+			input:  bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 42, SkipTrue: 6, SkipFalse: 9},
+			expect: "jle #42,6,9",
+		},
 		{
 			input:  bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 42, SkipTrue: 4, SkipFalse: 5},
 			expect: "jgt #42,4,5",
@@ -261,6 +341,26 @@ func TestAsmString(t *testing.T) {
 			input:  bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 42, SkipTrue: 2},
 			expect: "jset #42,2",
 		},
+		{
+			input:  bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 8, SkipFalse: 9},
+			expect: "jeq x,8,9",
+		},
+		{
+			input:  bpf.JumpIfX{Cond: bpf.JumpEqual, SkipFalse: 8},
+			expect: "jneq x,8",
+		},
+		{
+			input:  bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipTrue: 4},
+			expect: "jgt x,4",
+		},
+		{
+			input:  bpf.JumpIfX{Cond: bpf.JumpLessOrEqual, SkipTrue: 6, SkipFalse: 9},
+			expect: "jle x,6,9",
+		},
+		{
+			input:  bpf.JumpIfX{Cond: bpf.JumpBitsSet, SkipTrue: 2},
+			expect: "jset x,2",
+		},
 		{
 			input:  bpf.JumpIf{Cond: 0xffff, Val: 42, SkipTrue: 1, SkipFalse: 2},
 			expect: "!! unknown instruction: bpf.JumpIf{Cond:0xffff, Val:0x2a, SkipTrue:0x1, SkipFalse:0x2}",
@@ -323,3 +423,67 @@ bpf.RetConstant{Val:0x0}
 	}
 
 }
+
+func TestAsmStringWithLabels(t *testing.T) {
+	input := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 2048, SkipTrue: 0, SkipFalse: 3},
+		bpf.LoadAbsolute{Off: 23, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 1, SkipFalse: 2},
+		bpf.Jump{Skip: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+		bpf.Jump{Skip: 10},
+	}
+	expect := `ldh [12]
+jneq #2048,L5
+ldb [23]
+jeq #6,L5,L6
+jmp L6
+L5:
+ret #65535
+L6:
+ret #0
+jmp 10
+`
+
+	got := AsmStringWithLabels(input)
+	if got != expect {
+		t.Errorf("AsmStringWithLabels failed, got:\n%s\nexpected:\n%s", got, expect)
+	}
+}
+
+func TestAsmStringWithLabelsRun(t *testing.T) {
+	conds := []bpf.JumpTest{bpf.JumpEqual, bpf.JumpNotEqual, bpf.JumpGreaterThan, bpf.JumpLessThan, bpf.JumpGreaterOrEqual, bpf.JumpLessOrEqual, bpf.JumpBitsSet}
+
+	for _, cond := range conds {
+		input := []bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtLen},
+			bpf.JumpIf{Cond: cond, Val: 10, SkipTrue: 1, SkipFalse: 2},
+			bpf.RetConstant{Val: 1},
+			bpf.RetConstant{Val: 2},
+			bpf.RetConstant{Val: 3},
+		}
+
+		got, err := ParseAsm(strings.NewReader(AsmStringWithLabels(input)))
+		if err != nil {
+			t.Fatalf("cond %v: ParseAsm failed with error: %s", cond, err.Error())
+		}
+
+		expectVM, err := bpf.NewVM(input)
+		if err != nil {
+			t.Fatalf("cond %v: NewVM failed with error: %s", cond, err.Error())
+		}
+		gotVM, err := bpf.NewVM(got)
+		if err != nil {
+			t.Fatalf("cond %v: NewVM failed with error: %s\n%s", cond, err.Error(), AsmStringWithLabels(got))
+		}
+
+		for _, length := range []int{2, 9, 10, 11} {
+			expect, _ := expectVM.Run(make([]byte, length))
+			if ret, _ := gotVM.Run(make([]byte, length)); ret != expect {
+				t.Errorf("cond %v, packet length %d: got %d, expected %d\n%s", cond, length, ret, expect, AsmStringWithLabels(input))
+			}
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package bpfutils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// TcpdumpFormat is one of the formats tcpdump dumps a compiled filter in.
+type TcpdumpFormat int
+
+// Formats of tcpdump
+const (
+	// TcpdumpAsm is the human readable format of `tcpdump -d`, e.g. `(000) ldh      [12]`.
+	TcpdumpAsm TcpdumpFormat = iota + 1
+	// TcpdumpC is the C array format of `tcpdump -dd`, e.g. `{ 0x28, 0, 0, 0x0000000c },`.
+	TcpdumpC
+	// TcpdumpDecimal is the decimal format of `tcpdump -ddd`, the number of instructions on the
+	// first line, followed by one line per instruction, e.g. `40 0 0 12`.
+	TcpdumpDecimal
+)
+
+func (f TcpdumpFormat) String() string {
+	switch f {
+	case TcpdumpAsm:
+		return "-d"
+	case TcpdumpC:
+		return "-dd"
+	case TcpdumpDecimal:
+		return "-ddd"
+	default:
+		return "unknown"
+	}
+}
+
+// tcpdumpMnemonic is the mnemonic and the format of the operand of an opcode in the output of
+// `tcpdump -d` (bpf_image in libpcap). The operand is formatted with %d as signed and with %x
+// as unsigned value of k.
+type tcpdumpMnemonic struct {
+	op      string
+	operand string
+}
+
+var tcpdumpImages = map[uint16]tcpdumpMnemonic{
+	0x06: {"ret", "#%d"},
+	0x16: {"ret", ""},
+	0x20: {"ld", "[%d]"},
+	0x28: {"ldh", "[%d]"},
+	0x30: {"ldb", "[%d]"},
+	0x80: {"ld", "#pktlen"},
+	0x40: {"ld", "[x + %d]"},
+	0x48: {"ldh", "[x + %d]"},
+	0x50: {"ldb", "[x + %d]"},
+	0x00: {"ld", "#0x%x"},
+	0x01: {"ldx", "#0x%x"},
+	0x81: {"ldx", "#pktlen"},
+	0xb1: {"ldxb", "4*([%d]&0xf)"},
+	0x60: {"ld", "M[%d]"},
+	0x61: {"ldx", "M[%d]"},
+	0x02: {"st", "M[%d]"},
+	0x03: {"stx", "M[%d]"},
+	0x05: {"ja", "%d"},
+	0x15: {"jeq", "#0x%x"},
+	0x25: {"jgt", "#0x%x"},
+	0x35: {"jge", "#0x%x"},
+	0x45: {"jset", "#0x%x"},
+	0x1d: {"jeq", "x"},
+	0x2d: {"jgt", "x"},
+	0x3d: {"jge", "x"},
+	0x4d: {"jset", "x"},
+	0x04: {"add", "#%d"},
+	0x14: {"sub", "#%d"},
+	0x24: {"mul", "#%d"},
+	0x34: {"div", "#%d"},
+	0x94: {"mod", "#%d"},
+	0x54: {"and", "#0x%x"},
+	0x44: {"or", "#0x%x"},
+	0xa4: {"xor", "#0x%x"},
+	0x64: {"lsh", "#%d"},
+	0x74: {"rsh", "#%d"},
+	0x0c: {"add", "x"},
+	0x1c: {"sub", "x"},
+	0x2c: {"mul", "x"},
+	0x3c: {"div", "x"},
+	0x9c: {"mod", "x"},
+	0x5c: {"and", "x"},
+	0x4c: {"or", "x"},
+	0xac: {"xor", "x"},
+	0x6c: {"lsh", "x"},
+	0x7c: {"rsh", "x"},
+	0x84: {"neg", ""},
+	0x07: {"tax", ""},
+	0x87: {"txa", ""},
+}
+
+const (
+	opJumpAlways = 0x05
+	classMask    = 0x07
+	classJump    = 0x05
+)
+
+// TcpdumpString returns the BPF filter in one of the formats of tcpdump. The output is
+// identical to the output of tcpdump for the same filter.
+func TcpdumpString(a []pcap.BPFInstruction, format TcpdumpFormat) string {
+	var buffer bytes.Buffer
+	switch format {
+	case TcpdumpAsm:
+		for i, inst := range a {
+			buffer.WriteString(tcpdumpImage(inst, i))
+			buffer.WriteString("\n")
+		}
+	case TcpdumpC:
+		for _, inst := range a {
+			buffer.WriteString(fmt.Sprintf("{ 0x%x, %d, %d, 0x%08x },\n", inst.Code, inst.Jt, inst.Jf, inst.K))
+		}
+	case TcpdumpDecimal:
+		buffer.WriteString(fmt.Sprintf("%d\n", len(a)))
+		for _, inst := range a {
+			buffer.WriteString(fmt.Sprintf("%d %d %d %d\n", inst.Code, inst.Jt, inst.Jf, inst.K))
+		}
+	}
+	return buffer.String()
+}
+
+// tcpdumpImage returns the instruction inst at index i in the format of `tcpdump -d`.
+func tcpdumpImage(inst pcap.BPFInstruction, i int) string {
+	image, ok := tcpdumpImages[inst.Code]
+	if !ok {
+		return fmt.Sprintf("(%03d) %-8s 0x%x", i, "unimp", inst.Code)
+	}
+
+	var operand string
+	switch {
+	case inst.Code == opJumpAlways:
+		operand = fmt.Sprintf(image.operand, i+1+int(inst.K))
+	case strings.Contains(image.operand, "%d"):
+		operand = fmt.Sprintf(image.operand, int32(inst.K))
+	case strings.Contains(image.operand, "%x"):
+		operand = fmt.Sprintf(image.operand, inst.K)
+	default:
+		operand = image.operand
+	}
+
+	if inst.Code&classMask == classJump && inst.Code != opJumpAlways {
+		return fmt.Sprintf("(%03d) %-8s %-16s jt %d\tjf %d", i, image.op, operand, i+1+int(inst.Jt), i+1+int(inst.Jf))
+	}
+	return fmt.Sprintf("(%03d) %-8s %s", i, image.op, operand)
+}
+
+// tcpdumpAsmLine matches a line of `tcpdump -d`, the submatches are the index, the mnemonic,
+// the operand and the targets of a conditional jump.
+var tcpdumpAsmLine = regexp.MustCompile(`^\s*\((\d+)\)\s+(\S+)\s*(.*?)\s*(?:jt\s+(\d+)\s+jf\s+(\d+))?\s*$`)
+
+// ParseTcpdump reads a BPF filter in one of the formats of tcpdump. It is the inverse of
+// TcpdumpString. Empty lines are ignored. For TcpdumpAsm, `ret a` is accepted as well as `ret`
+// for returning register A.
+func ParseTcpdump(r io.Reader, format TcpdumpFormat) ([]pcap.BPFInstruction, error) {
+	var instructions []pcap.BPFInstruction
+	count := -1
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		var inst pcap.BPFInstruction
+		var err error
+		switch format {
+		case TcpdumpAsm:
+			inst, err = parseTcpdumpImage(text, line, len(instructions))
+		case TcpdumpC:
+			inst, err = parseTcpdumpC(text, line)
+		case TcpdumpDecimal:
+			if count < 0 {
+				count, err = parseTcpdumpCount(text, line)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			inst, err = parseTcpdumpDecimal(text, line)
+		default:
+			return nil, fmt.Errorf("unknown tcpdump format %d", format)
+		}
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if format == TcpdumpDecimal && count < 0 {
+		return nil, &ParseError{Line: line, Column: 1, Msg: "missing instruction count"}
+	}
+	if format == TcpdumpDecimal && count != len(instructions) {
+		return nil, &ParseError{Line: line, Column: 1, Msg: fmt.Sprintf("expected %d instructions, got %d", count, len(instructions))}
+	}
+
+	return instructions, nil
+}
+
+func parseTcpdumpImage(text string, line, index int) (pcap.BPFInstruction, error) {
+	m := tcpdumpAsmLine.FindStringSubmatchIndex(text)
+	if m == nil {
+		return pcap.BPFInstruction{}, &ParseError{Line: line, Column: 1, Msg: "invalid instruction"}
+	}
+	sub := func(n int) string {
+		if m[2*n] < 0 {
+			return ""
+		}
+		return text[m[2*n]:m[2*n+1]]
+	}
+	errorf := func(n int, format string, args ...interface{}) error {
+		return &ParseError{Line: line, Column: m[2*n] + 1, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	if n, _ := strconv.Atoi(sub(1)); n != index {
+		return pcap.BPFInstruction{}, errorf(1, "expected instruction %03d, got %s", index, sub(1))
+	}
+
+	op, operand := sub(2), strings.Replace(sub(3), " ", "", -1)
+	if op == "ret" && operand == "a" {
+		operand = ""
+	}
+
+	known := false
+	for code, image := range tcpdumpImages {
+		if image.op != op {
+			continue
+		}
+		known = true
+		k, ok := matchTcpdumpOperand(image.operand, operand)
+		if !ok {
+			continue
+		}
+
+		inst := pcap.BPFInstruction{Code: code, K: k}
+		if code == opJumpAlways {
+			if int64(k) <= int64(index) {
+				return pcap.BPFInstruction{}, errorf(3, "invalid jump target %d", k)
+			}
+			inst.K = k - uint32(index) - 1
+		}
+
+		isCondJump := code&classMask == classJump && code != opJumpAlways
+		switch {
+		case isCondJump && m[8] < 0:
+			return pcap.BPFInstruction{}, errorf(2, "missing jt and jf for %s", op)
+		case !isCondJump && m[8] >= 0:
+			return pcap.BPFInstruction{}, errorf(4, "jt and jf are only valid for conditional jumps")
+		}
+		if isCondJump {
+			for _, branch := range []struct {
+				n    int
+				skip *uint8
+			}{{4, &inst.Jt}, {5, &inst.Jf}} {
+				target, err := strconv.Atoi(sub(branch.n))
+				if err != nil || target <= index || target-index-1 > 0xff {
+					return pcap.BPFInstruction{}, errorf(branch.n, "invalid jump target %s", sub(branch.n))
+				}
+				*branch.skip = uint8(target - index - 1)
+			}
+		}
+		return inst, nil
+	}
+
+	if known {
+		return pcap.BPFInstruction{}, errorf(3, "invalid operand %q for %s", sub(3), op)
+	}
+	return pcap.BPFInstruction{}, errorf(2, "unknown instruction %s", op)
+}
+
+// matchTcpdumpOperand matches operand against the format of an operand in tcpdumpImages and
+// returns the value of k. Spaces are removed from operand.
+func matchTcpdumpOperand(format, operand string) (uint32, bool) {
+	format = strings.Replace(format, " ", "", -1)
+	verb := strings.Index(format, "%")
+	if verb < 0 {
+		return 0, format == operand
+	}
+	prefix, suffix := format[:verb], format[verb+2:]
+	if verb >= 2 && format[verb-2:verb+2] == "0x%x" {
+		prefix = format[:verb-2]
+	}
+	if len(operand) < len(prefix)+len(suffix) || !strings.HasPrefix(operand, prefix) || !strings.HasSuffix(operand, suffix) {
+		return 0, false
+	}
+
+	val, err := strconv.ParseInt(operand[len(prefix):len(operand)-len(suffix)], 0, 64)
+	if err != nil || val < -0x80000000 || val > 0xffffffff {
+		return 0, false
+	}
+	return uint32(val), true
+}
+
+func parseTcpdumpC(text string, line int) (pcap.BPFInstruction, error) {
+	fields := strings.TrimSpace(text)
+	fields = strings.TrimSuffix(fields, ",")
+	if !strings.HasPrefix(fields, "{") || !strings.HasSuffix(fields, "}") {
+		return pcap.BPFInstruction{}, &ParseError{Line: line, Column: 1, Msg: "expected { code, jt, jf, k }"}
+	}
+	fields = fields[1 : len(fields)-1]
+	return parseTcpdumpFields(strings.Split(fields, ","), line)
+}
+
+func parseTcpdumpDecimal(text string, line int) (pcap.BPFInstruction, error) {
+	return parseTcpdumpFields(strings.Fields(text), line)
+}
+
+func parseTcpdumpCount(text string, line int) (int, error) {
+	count, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || count < 0 {
+		return 0, &ParseError{Line: line, Column: 1, Msg: fmt.Sprintf("invalid instruction count %q", strings.TrimSpace(text))}
+	}
+	return count, nil
+}
+
+// parseTcpdumpFields parses the four fields code, jt, jf and k of an instruction.
+func parseTcpdumpFields(fields []string, line int) (pcap.BPFInstruction, error) {
+	if len(fields) != 4 {
+		return pcap.BPFInstruction{}, &ParseError{Line: line, Column: 1, Msg: fmt.Sprintf("expected 4 fields, got %d", len(fields))}
+	}
+
+	var vals [4]uint64
+	bits := [4]int{16, 8, 8, 32}
+	for i, field := range fields {
+		var err error
+		vals[i], err = strconv.ParseUint(strings.TrimSpace(field), 0, bits[i])
+		if err != nil {
+			return pcap.BPFInstruction{}, &ParseError{Line: line, Column: 1, Msg: fmt.Sprintf("invalid field %d %q", i+1, strings.TrimSpace(field))}
+		}
+	}
+
+	return pcap.BPFInstruction{Code: uint16(vals[0]), Jt: uint8(vals[1]), Jf: uint8(vals[2]), K: uint32(vals[3])}, nil
+}
@@ -0,0 +1,230 @@
+package bpfutils
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// tcpdumpIP is the filter `ip` compiled by tcpdump for Ethernet
+var tcpdumpIP = []pcap.BPFInstruction{
+	{Code: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+	{Code: 0x15, Jt: 0, Jf: 1, K: 0x00000800},
+	{Code: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+	{Code: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+}
+
+func TestTcpdumpString(t *testing.T) {
+	cases := []struct {
+		format TcpdumpFormat
+		expect string
+	}{
+		{
+			format: TcpdumpAsm,
+			expect: "(000) ldh      [12]\n" +
+				"(001) jeq      #0x800           jt 2\tjf 3\n" +
+				"(002) ret      #262144\n" +
+				"(003) ret      #0\n",
+		},
+		{
+			format: TcpdumpC,
+			expect: "{ 0x28, 0, 0, 0x0000000c },\n" +
+				"{ 0x15, 0, 1, 0x00000800 },\n" +
+				"{ 0x6, 0, 0, 0x00040000 },\n" +
+				"{ 0x6, 0, 0, 0x00000000 },\n",
+		},
+		{
+			format: TcpdumpDecimal,
+			expect: "4\n" +
+				"40 0 0 12\n" +
+				"21 0 1 2048\n" +
+				"6 0 0 262144\n" +
+				"6 0 0 0\n",
+		},
+	}
+
+	for _, test := range cases {
+		if got := TcpdumpString(tcpdumpIP, test.format); got != test.expect {
+			t.Errorf("format %s: got:\n%s\nexpected:\n%s", test.format, got, test.expect)
+		}
+
+		got, err := ParseTcpdump(strings.NewReader(test.expect), test.format)
+		if err != nil {
+			t.Errorf("format %s: failed to parse with error: %s", test.format, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, tcpdumpIP) {
+			t.Errorf("format %s: parsed %v, expected %v", test.format, got, tcpdumpIP)
+		}
+	}
+}
+
+func TestTcpdumpStringImage(t *testing.T) {
+	cases := []struct {
+		input  pcap.BPFInstruction
+		expect string
+	}{
+		{input: pcap.BPFInstruction{Code: 0x16}, expect: "(005) ret      "},
+		{input: pcap.BPFInstruction{Code: 0x20, K: 0xfffff000}, expect: "(005) ld       [-4096]"},
+		{input: pcap.BPFInstruction{Code: 0x80}, expect: "(005) ld       #pktlen"},
+		{input: pcap.BPFInstruction{Code: 0x50, K: 14}, expect: "(005) ldb      [x + 14]"},
+		{input: pcap.BPFInstruction{Code: 0x01, K: 42}, expect: "(005) ldx      #0x2a"},
+		{input: pcap.BPFInstruction{Code: 0xb1, K: 14}, expect: "(005) ldxb     4*([14]&0xf)"},
+		{input: pcap.BPFInstruction{Code: 0x61, K: 3}, expect: "(005) ldx      M[3]"},
+		{input: pcap.BPFInstruction{Code: 0x03, K: 15}, expect: "(005) stx      M[15]"},
+		{input: pcap.BPFInstruction{Code: 0x05, K: 10}, expect: "(005) ja       16"},
+		{input: pcap.BPFInstruction{Code: 0x4d, Jt: 1, Jf: 0}, expect: "(005) jset     x                jt 7\tjf 6"},
+		{input: pcap.BPFInstruction{Code: 0x54, K: 0x1fff}, expect: "(005) and      #0x1fff"},
+		{input: pcap.BPFInstruction{Code: 0x64, K: 2}, expect: "(005) lsh      #2"},
+		{input: pcap.BPFInstruction{Code: 0xac}, expect: "(005) xor      x"},
+		{input: pcap.BPFInstruction{Code: 0x87}, expect: "(005) txa      "},
+		{input: pcap.BPFInstruction{Code: 0xffff}, expect: "(005) unimp    0xffff"},
+	}
+
+	for _, test := range cases {
+		if got := tcpdumpImage(test.input, 5); got != test.expect {
+			t.Errorf("got %q, expected %q", got, test.expect)
+		}
+	}
+}
+
+func TestTcpdumpRoundTrip(t *testing.T) {
+	// Every known opcode, followed by a return. The format of `tcpdump -d` does not contain k,
+	// if the operand does not use it.
+	var codes []int
+	for code := range tcpdumpImages {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	var prog []pcap.BPFInstruction
+	for i, code := range codes {
+		inst := pcap.BPFInstruction{Code: uint16(code)}
+		if strings.Contains(tcpdumpImages[uint16(code)].operand, "%") {
+			inst.K = uint32(i) * 0x01010101
+		}
+		switch {
+		case code == opJumpAlways:
+			inst.K = 1
+		case code&classMask == classJump:
+			inst.Jt, inst.Jf = uint8(len(codes)-i), uint8(i%3)
+		}
+		prog = append(prog, inst)
+	}
+	prog = append(prog, pcap.BPFInstruction{Code: 0x06, K: 0xffffffff})
+
+	for _, format := range []TcpdumpFormat{TcpdumpAsm, TcpdumpC, TcpdumpDecimal} {
+		got, err := ParseTcpdump(strings.NewReader(TcpdumpString(prog, format)), format)
+		if err != nil {
+			t.Errorf("format %s: failed to parse with error: %s", format, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, prog) {
+			t.Errorf("format %s: parsed:\n%v\nexpected:\n%v", format, got, prog)
+		}
+	}
+}
+
+func TestParseTcpdumpAliases(t *testing.T) {
+	input := `
+		(000)   ld #pktlen
+		(001) jgt #1000 jt 2 jf 3
+
+		(002) ret a
+		(003) ret #0
+	`
+	expect := []pcap.BPFInstruction{
+		{Code: 0x80},
+		{Code: 0x25, Jt: 0, Jf: 1, K: 1000},
+		{Code: 0x16},
+		{Code: 0x06},
+	}
+
+	got, err := ParseTcpdump(strings.NewReader(input), TcpdumpAsm)
+	if err != nil {
+		t.Fatalf("failed to parse with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("parsed %v, expected %v", got, expect)
+	}
+}
+
+func TestParseTcpdumpError(t *testing.T) {
+	cases := []struct {
+		format TcpdumpFormat
+		input  string
+		err    string
+	}{
+		{format: TcpdumpAsm, input: "ldh [12]", err: "line 1, column 1: invalid instruction"},
+		{format: TcpdumpAsm, input: "(001) ldh [12]", err: "line 1, column 2: expected instruction 000, got 001"},
+		{format: TcpdumpAsm, input: "(000) foo [12]", err: "line 1, column 7: unknown instruction foo"},
+		{format: TcpdumpAsm, input: "(000) ldh #12", err: `line 1, column 11: invalid operand "#12" for ldh`},
+		{format: TcpdumpAsm, input: "(000) jeq #1", err: "line 1, column 7: missing jt and jf for jeq"},
+		{format: TcpdumpAsm, input: "(000) ret #0 jt 1 jf 2", err: "line 1, column 17: jt and jf are only valid for conditional jumps"},
+		{format: TcpdumpAsm, input: "(000) jeq #1 jt 0 jf 1", err: "line 1, column 17: invalid jump target 0"},
+		{format: TcpdumpAsm, input: "(000) jeq #1 jt 1 jf 300", err: "line 1, column 22: invalid jump target 300"},
+		{format: TcpdumpAsm, input: "(000) ja 0", err: "line 1, column 10: invalid jump target 0"},
+		{format: TcpdumpC, input: "0x28, 0, 0, 12", err: "line 1, column 1: expected { code, jt, jf, k }"},
+		{format: TcpdumpC, input: "{ 0x28, 0, 0 },", err: "line 1, column 1: expected 4 fields, got 3"},
+		{format: TcpdumpC, input: "{ 0x28, 0, 256, 12 },", err: `line 1, column 1: invalid field 3 "256"`},
+		{format: TcpdumpDecimal, input: "", err: "line 0, column 1: missing instruction count"},
+		{format: TcpdumpDecimal, input: "x\n6 0 0 0", err: `line 1, column 1: invalid instruction count "x"`},
+		{format: TcpdumpDecimal, input: "2\n6 0 0 0", err: "line 2, column 1: expected 2 instructions, got 1"},
+		{format: TcpdumpDecimal, input: "1\n6 0 0 0x100000000", err: `line 2, column 1: invalid field 4 "0x100000000"`},
+		{format: 0, input: "6 0 0 0", err: "unknown tcpdump format 0"},
+	}
+
+	for _, test := range cases {
+		_, err := ParseTcpdump(strings.NewReader(test.input), test.format)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("format %s, input %q: got error %v, expected %s", test.format, test.input, err, test.err)
+		}
+	}
+}
+
+func TestTcpdumpChainPcapFilter(t *testing.T) {
+	ip6 := "4\n40 0 0 12\n21 0 1 34525\n6 0 0 262144\n6 0 0 0\n"
+
+	a, err := ParseTcpdump(strings.NewReader(TcpdumpString(tcpdumpIP, TcpdumpDecimal)), TcpdumpDecimal)
+	if err != nil {
+		t.Fatalf("failed to parse with error: %s", err.Error())
+	}
+	b, err := ParseTcpdump(strings.NewReader(ip6), TcpdumpDecimal)
+	if err != nil {
+		t.Fatalf("failed to parse with error: %s", err.Error())
+	}
+
+	chained, err := ChainPcapFilter(a, b, OR)
+	if err != nil {
+		t.Fatalf("failed to chain with error: %s", err.Error())
+	}
+
+	got, err := ParseTcpdump(strings.NewReader(TcpdumpString(chained, TcpdumpAsm)), TcpdumpAsm)
+	if err != nil {
+		t.Fatalf("failed to parse with error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, chained) {
+		t.Errorf("parsed %v, expected %v", got, chained)
+	}
+}
+
+func TestTcpdumpFormatString(t *testing.T) {
+	cases := []struct {
+		format TcpdumpFormat
+		expect string
+	}{
+		{format: TcpdumpAsm, expect: "-d"},
+		{format: TcpdumpC, expect: "-dd"},
+		{format: TcpdumpDecimal, expect: "-ddd"},
+		{format: 0, expect: "unknown"},
+	}
+
+	for _, test := range cases {
+		if got := test.format.String(); got != test.expect {
+			t.Errorf("got %s, expected %s", got, test.expect)
+		}
+	}
+}
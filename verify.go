@@ -0,0 +1,168 @@
+package bpfutils
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// MaxInstructions is the maximum number of instructions of a classic BPF program
+// accepted by the Linux kernel (BPF_MAXINSNS).
+const MaxInstructions = 4096
+
+// Diagnostic describes a problem found by Verify.
+type Diagnostic struct {
+	// Index of the offending instruction, -1 if the problem concerns the whole program.
+	Index int
+	// Instruction is the offending instruction in bpf_asm syntax.
+	Instruction string
+	Msg         string
+}
+
+// String returns the diagnostic in the form `index: instruction: message`.
+func (d Diagnostic) String() string {
+	if d.Index < 0 {
+		return d.Msg
+	}
+	return fmt.Sprintf("%d: %s: %s", d.Index, d.Instruction, d.Msg)
+}
+
+// validExtensions contains the ancillary data extensions known to the Linux kernel (SKF_AD_*).
+var validExtensions = map[bpf.Extension]bool{
+	bpf.ExtLen:               true,
+	bpf.ExtProto:             true,
+	bpf.ExtType:              true,
+	bpf.ExtInterfaceIndex:    true,
+	bpf.ExtNetlinkAttr:       true,
+	bpf.ExtNetlinkAttrNested: true,
+	bpf.ExtMark:              true,
+	bpf.ExtQueue:             true,
+	bpf.ExtLinkLayerType:     true,
+	bpf.ExtRXHash:            true,
+	bpf.ExtCPUID:             true,
+	40:                       true, // SKF_AD_ALU_XOR_X
+	bpf.ExtVLANTag:           true,
+	bpf.ExtVLANTagPresent:    true,
+	bpf.ExtPayloadOffset:     true,
+	bpf.ExtRand:              true,
+	bpf.ExtVLANProto:         true,
+}
+
+// Verify checks prog against the rules, the Linux kernel applies to classic BPF programs
+// in sk_chk_filter (bpf_check_classic) before a filter is attached to a socket:
+// * the program is not empty and has at most MaxInstructions instructions
+// * all instructions are valid and can be assembled
+// * jumps are forward only and stay within the program
+// * the program ends with a return
+// * scratch memory is only read after it has been written on all paths
+// * there is no division or modulo by constant zero and no shift by a constant of 32 or more
+// * only known ancillary data extensions are used
+//
+// Verify returns nil, if no problem is found.
+func Verify(prog []bpf.Instruction) []Diagnostic {
+	var diags []Diagnostic
+	report := func(i int, format string, args ...interface{}) {
+		d := Diagnostic{Index: i, Msg: fmt.Sprintf(format, args...)}
+		if i >= 0 {
+			d.Instruction = strings.TrimRight(asmString(prog[i], skipCount), "\n")
+		}
+		diags = append(diags, d)
+	}
+
+	if len(prog) == 0 {
+		report(-1, "empty program")
+		return diags
+	}
+	if len(prog) > MaxInstructions {
+		report(MaxInstructions, "program exceeds %d instructions", MaxInstructions)
+	}
+
+	inBounds := func(i int, skip uint32) bool {
+		return uint64(i)+1+uint64(skip) < uint64(len(prog))
+	}
+
+	for i, instr := range prog {
+		if instr == nil {
+			report(i, "missing instruction")
+			continue
+		}
+		if _, err := instr.Assemble(); err != nil {
+			report(i, "invalid instruction: %s", err.Error())
+			continue
+		}
+
+		switch inst := instr.(type) {
+		case bpf.ALUOpConstant:
+			if (inst.Op == bpf.ALUOpDiv || inst.Op == bpf.ALUOpMod) && inst.Val == 0 {
+				report(i, "division by zero")
+			}
+			if (inst.Op == bpf.ALUOpShiftLeft || inst.Op == bpf.ALUOpShiftRight) && inst.Val >= 32 {
+				report(i, "shift by %d bits, which is not less than 32", inst.Val)
+			}
+		case bpf.Jump:
+			if !inBounds(i, inst.Skip) {
+				report(i, "jump out of bounds")
+			}
+		case bpf.JumpIf:
+			if !inBounds(i, uint32(inst.SkipTrue)) || !inBounds(i, uint32(inst.SkipFalse)) {
+				report(i, "jump out of bounds")
+			}
+		case bpf.JumpIfX:
+			if !inBounds(i, uint32(inst.SkipTrue)) || !inBounds(i, uint32(inst.SkipFalse)) {
+				report(i, "jump out of bounds")
+			}
+		case bpf.LoadExtension:
+			if !validExtensions[inst.Num] {
+				report(i, "unknown extension %d", inst.Num)
+			}
+		case bpf.LoadAbsolute:
+			if inst.Size == 4 && inst.Off > 0xFFFFFFFF-0x1000 && !validExtensions[bpf.Extension(inst.Off+0x1000)] {
+				report(i, "unknown extension %d", bpf.Extension(inst.Off+0x1000))
+			}
+		}
+	}
+
+	if !isReturn(prog[len(prog)-1]) {
+		report(len(prog)-1, "program does not end with a return")
+	}
+
+	if len(diags) > 0 {
+		// The data flow analysis of the scratch memory relies on a structurally valid program
+		return diags
+	}
+
+	// Data flow analysis of the scratch memory as done by check_load_and_stores in the kernel
+	masks := make([]uint16, len(prog))
+	for i := range masks {
+		masks[i] = 0xffff
+	}
+	var memValid uint16
+	for i, instr := range prog {
+		memValid &= masks[i]
+		switch inst := instr.(type) {
+		case bpf.StoreScratch:
+			memValid |= 1 << uint(inst.N)
+		case bpf.LoadScratch:
+			if memValid&(1<<uint(inst.N)) == 0 {
+				report(i, "scratch memory M[%d] is read before it is written", inst.N)
+			}
+		case bpf.Jump:
+			masks[i+1+int(inst.Skip)] &= memValid
+			memValid = 0xffff
+		case bpf.JumpIf:
+			masks[i+1+int(inst.SkipTrue)] &= memValid
+			masks[i+1+int(inst.SkipFalse)] &= memValid
+			memValid = 0xffff
+		case bpf.JumpIfX:
+			masks[i+1+int(inst.SkipTrue)] &= memValid
+			masks[i+1+int(inst.SkipFalse)] &= memValid
+			memValid = 0xffff
+		case bpf.RetA, bpf.RetConstant:
+			// the next instruction is only reachable by jumps
+			memValid = 0xffff
+		}
+	}
+
+	return diags
+}
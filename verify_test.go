@@ -0,0 +1,157 @@
+package bpfutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		description string
+		prog        []bpf.Instruction
+		expect      []Diagnostic
+	}{
+		{
+			description: "valid program",
+			prog:        loopbackFilters["ip6 payload < 100"],
+		},
+		{
+			description: "empty program",
+			expect:      []Diagnostic{{Index: -1, Msg: "empty program"}},
+		},
+		{
+			description: "missing instruction",
+			prog:        []bpf.Instruction{nil, bpf.RetA{}},
+			expect: []Diagnostic{
+				{Index: 0, Instruction: "!! unknown instruction: <nil>", Msg: "missing instruction"},
+			},
+		},
+		{
+			description: "jump out of bounds",
+			prog: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1, SkipFalse: 2},
+				bpf.Jump{Skip: 1},
+				bpf.RetConstant{Val: 1},
+			},
+			expect: []Diagnostic{
+				{Index: 1, Instruction: "jeq #1,1,2", Msg: "jump out of bounds"},
+				{Index: 2, Instruction: "jmp 1", Msg: "jump out of bounds"},
+			},
+		},
+		{
+			description: "no return at the end",
+			prog: []bpf.Instruction{
+				bpf.RetConstant{Val: 1},
+				bpf.LoadExtension{Num: bpf.ExtLen},
+			},
+			expect: []Diagnostic{
+				{Index: 1, Instruction: "ld #len", Msg: "program does not end with a return"},
+			},
+		},
+		{
+			description: "invalid instructions",
+			prog: []bpf.Instruction{
+				bpf.ALUOpConstant{Op: bpf.ALUOpDiv, Val: 0},
+				bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: 0},
+				bpf.LoadExtension{Num: 0xfff},
+				bpf.LoadAbsolute{Off: 0xfffff000 + 2, Size: 4},
+				bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 31},
+				bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 32},
+				bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 40},
+				bpf.RetA{},
+			},
+			expect: []Diagnostic{
+				{Index: 0, Instruction: "div #0", Msg: "division by zero"},
+				{Index: 1, Instruction: "mod #0", Msg: "division by zero"},
+				{Index: 2, Instruction: "!! unknown instruction: bpf.LoadExtension{Num:4095}", Msg: "unknown extension 4095"},
+				{Index: 3, Instruction: "!! unknown instruction: bpf.LoadExtension{Num:2}", Msg: "unknown extension 2"},
+				{Index: 5, Instruction: "lsh #32", Msg: "shift by 32 bits, which is not less than 32"},
+				{Index: 6, Instruction: "rsh #40", Msg: "shift by 40 bits, which is not less than 32"},
+			},
+		},
+		{
+			description: "scratch memory read before write",
+			prog: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 100, SkipTrue: 1},
+				bpf.StoreScratch{Src: bpf.RegA, N: 2},
+				bpf.StoreScratch{Src: bpf.RegA, N: 3},
+				bpf.LoadScratch{Dst: bpf.RegX, N: 3},
+				bpf.LoadScratch{Dst: bpf.RegA, N: 2},
+				bpf.RetA{},
+			},
+			expect: []Diagnostic{
+				{Index: 5, Instruction: "ld M[2]", Msg: "scratch memory M[2] is read before it is written"},
+			},
+		},
+		{
+			description: "scratch memory written on every path after a return",
+			prog: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipFalse: 2},
+				bpf.StoreScratch{Src: bpf.RegA, N: 0},
+				bpf.Jump{Skip: 1},
+				bpf.RetConstant{Val: 0},
+				bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+				bpf.RetA{},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		got := Verify(test.prog)
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("case '%s': got: %v, expected: %v", test.description, got, test.expect)
+		}
+	}
+}
+
+func TestVerifyInvalidInstruction(t *testing.T) {
+	prog := []bpf.Instruction{
+		bpf.LoadScratch{Dst: bpf.RegA, N: 16},
+		bpf.LoadIndirect{Off: 1, Size: 3},
+		InvalidInstruction{},
+		bpf.RetA{},
+	}
+
+	got := Verify(prog)
+	if len(got) != 3 {
+		t.Fatalf("got: %v, expected 3 diagnostics", got)
+	}
+	for i, diag := range got {
+		if diag.Index != i || !strings.HasPrefix(diag.Msg, "invalid instruction: ") {
+			t.Errorf("got: %v, expected invalid instruction at index %d", diag, i)
+		}
+	}
+}
+
+func TestVerifyMaxInstructions(t *testing.T) {
+	prog := make([]bpf.Instruction, MaxInstructions+1)
+	for i := range prog {
+		prog[i] = bpf.RetConstant{Val: 0}
+	}
+
+	expect := []Diagnostic{{Index: MaxInstructions, Instruction: "ret #0", Msg: "program exceeds 4096 instructions"}}
+	if got := Verify(prog); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v, expected: %v", got, expect)
+	}
+	if got := Verify(prog[:MaxInstructions]); got != nil {
+		t.Errorf("got: %v, expected no diagnostics", got)
+	}
+}
+
+func TestVerifyChainFilter(t *testing.T) {
+	for nameA, a := range loopbackFilters {
+		for nameB, b := range loopbackFilters {
+			for _, ct := range []ChainType{AND, OR, NOT, XOR, ANDNOT} {
+				if diags := Verify(ChainFilter(a, b, ct)); diags != nil {
+					t.Errorf("'%s' %s '%s': %v", nameA, ct, nameB, diags)
+				}
+			}
+		}
+	}
+}